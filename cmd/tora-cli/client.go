@@ -2,10 +2,12 @@ package main
 
 import (
 	"context"
+	"github.com/gorilla/websocket"
 	"github.com/json-iterator/go"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"time"
 )
 
@@ -68,10 +70,32 @@ func (c *Client) Get(module string, url string) (*http.Request, error) {
 	return c.request(module, "GET", url, nil)
 }
 
+func (c *Client) Head(module string, url string) (*http.Request, error) {
+	return c.request(module, "HEAD", url, nil)
+}
+
 func (c *Client) Put(module string, url string, body io.Reader) (*http.Request, error) {
 	return c.request(module, "PUT", url, body)
 }
 
+func (c *Client) Post(module string, url string, body io.Reader) (*http.Request, error) {
+	return c.request(module, "POST", url, body)
+}
+
 func (c *Client) Delete(module string, url string, body io.Reader) (*http.Request, error) {
 	return c.request(module, "DELETE", url, body)
 }
+
+// 建立WebSocket连接
+func (c *Client) Dial(module string, url string) (*websocket.Conn, *http.Response, error) {
+	header := http.Header{}
+	header.Set("x-token", c.token)
+	header.Set("x-module", module)
+	addr := c.addr
+	if strings.HasPrefix(addr, "https://") {
+		addr = "wss://" + addr[len("https://"):]
+	} else if strings.HasPrefix(addr, "http://") {
+		addr = "ws://" + addr[len("http://"):]
+	}
+	return websocket.DefaultDialer.Dial(addr+url, header)
+}
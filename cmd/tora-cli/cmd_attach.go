@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/json-iterator/go"
+	"github.com/leizongmin/tora/module/shell"
+	"golang.org/x/crypto/ssh/terminal"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+)
+
+func cmdAttach(args []string, cmd *flag.FlagSet, options *baseOptions) {
+	var cwd string
+	cmd.StringVar(&cwd, "cwd", "", "Working directory on remote server (attach only)")
+	cmd.Parse(args)
+
+	command := cmd.Arg(0)
+	if len(command) < 1 {
+		fmt.Println("Missing first argument <command>")
+		os.Exit(1)
+	}
+
+	stdin := int(os.Stdin.Fd())
+	query := url.Values{}
+	query.Set("command", command)
+	query["arg"] = cmd.Args()[1:]
+	query.Set("cwd", cwd)
+	if term := os.Getenv("TERM"); len(term) > 0 {
+		query.Set("term", term)
+	}
+	if terminal.IsTerminal(stdin) {
+		if cols, rows, err := terminal.GetSize(stdin); err == nil {
+			query.Set("cols", strconv.Itoa(cols))
+			query.Set("rows", strconv.Itoa(rows))
+		}
+	}
+
+	client := NewClient(options.server, options.token)
+	conn, res, err := client.Dial("shell", "/pty?"+query.Encode())
+	if err != nil {
+		if res != nil {
+			body, _ := ioutil.ReadAll(res.Body)
+			fmt.Println(jsonPretty(body))
+		} else {
+			fmt.Println(err)
+		}
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	// 将本地终端切换为raw模式，所有输入原样发送到远程终端
+	var state *terminal.State
+	if terminal.IsTerminal(stdin) {
+		state, err = terminal.MakeRaw(stdin)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var writeMu sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		return conn.WriteMessage(messageType, data)
+	}
+	watchTerminalResize(stdin, func(cols int, rows int) {
+		b, _ := jsoniter.Marshal(shell.PtyMessage{Type: shell.PtyMessageResize, Cols: uint16(cols), Rows: uint16(rows)})
+		writeMessage(websocket.TextMessage, b)
+	})
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			n, err := os.Stdin.Read(buf)
+			if n > 0 {
+				if err := writeMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+					return
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	exitCode := 1
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			break
+		}
+		if messageType == websocket.BinaryMessage {
+			os.Stdout.Write(data)
+			continue
+		}
+		msg := shell.PtyMessage{}
+		if err := jsoniter.Unmarshal(data, &msg); err == nil && msg.Type == shell.PtyMessageExit {
+			exitCode = msg.ExitCode
+			if len(msg.Error) > 0 {
+				fmt.Fprintf(os.Stderr, "\r\n%s\r\n", msg.Error)
+			}
+		}
+	}
+	if exitCode < 0 {
+		exitCode = 1
+	}
+	conn.Close()
+	if state != nil {
+		terminal.Restore(stdin, state)
+	}
+	os.Exit(exitCode)
+}
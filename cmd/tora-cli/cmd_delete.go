@@ -6,7 +6,7 @@ import (
 	"os"
 )
 
-func cmdDelete(args []string, cmd *flag.FlagSet, options baseOptions) {
+func cmdDelete(args []string, cmd *flag.FlagSet, options *baseOptions) {
 	cmd.Parse(args)
 
 	remotePath := cmd.Arg(0)
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"github.com/json-iterator/go"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+func cmdExec(args []string, cmd *flag.FlagSet, options *baseOptions) {
+	cmd.Parse(args)
+
+	infoFile := cmd.Arg(0)
+	if len(infoFile) < 1 {
+		fmt.Println("Missing first argument <execInfoFile>")
+		os.Exit(1)
+	}
+	var info []byte
+	var err error
+	if infoFile == "-" {
+		info, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		info, err = ioutil.ReadFile(formatLocalPath(infoFile))
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	client := NewClient(options.server, options.token)
+
+	req, err := client.Post("shell", "/exec", bytes.NewReader(info))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	req.Header.Set("accept", "text/event-stream")
+	res, err := client.Response(req)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+
+	if !strings.HasPrefix(res.Header.Get("content-type"), "text/event-stream") {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(jsonPretty(body))
+		os.Exit(1)
+	}
+
+	exitCode := 1
+	err = readEvents(res.Body, func(event string, data jsoniter.Any) {
+		switch event {
+		case "stepStart":
+			notes := make([]string, 0)
+			if group := data.Get("group").ToInt(); group > 0 {
+				notes = append(notes, fmt.Sprintf("parallel #%d", group))
+			}
+			if attempt := data.Get("attempt").ToInt(); attempt > 1 {
+				notes = append(notes, fmt.Sprintf("attempt %d", attempt))
+			}
+			if len(notes) > 0 {
+				fmt.Printf("[%s] $ %s (%s)\n", data.Get("stage").ToString(), data.Get("command").ToString(), strings.Join(notes, ", "))
+			} else {
+				fmt.Printf("[%s] $ %s\n", data.Get("stage").ToString(), data.Get("command").ToString())
+			}
+		case "stdout":
+			fmt.Fprint(os.Stdout, data.Get("data").ToString())
+		case "stderr":
+			fmt.Fprint(os.Stderr, data.Get("data").ToString())
+		case "stepEnd":
+			if code := data.Get("exitCode").ToInt(); code != 0 {
+				fmt.Printf("  - Exit Code: %d %s\n", code, data.Get("error").ToString())
+			}
+		case "end":
+			exitCode = data.Get("exitCode").ToInt()
+			fmt.Println()
+			fmt.Printf("Success: %t, Exit Code: %d\n", data.Get("success").ToBool(), exitCode)
+		}
+	})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if exitCode < 0 {
+		exitCode = 1
+	}
+	os.Exit(exitCode)
+}
+
+// 读取 Server-Sent Events 事件流
+func readEvents(r io.Reader, fn func(event string, data jsoniter.Any)) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	var event string
+	var data []byte
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if len(event) > 0 {
+				fn(event, jsoniter.Get(data))
+			}
+			event = ""
+			data = nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(line[6:])
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimSpace(line[5:])...)
+		}
+	}
+	return scanner.Err()
+}
@@ -3,13 +3,27 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/leizongmin/tora/common"
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
 )
 
-func cmdGet(args []string, cmd *flag.FlagSet, options baseOptions) {
+func cmdGet(args []string, cmd *flag.FlagSet, options *baseOptions) {
+	var parallel int
+	var checksum string
+	var archive string
+	cmd.IntVar(&parallel, "p", 4, "Number of segments to download in parallel (get only)")
+	cmd.StringVar(&checksum, "checksum", "", "Verify downloaded file with checksums from remote server, supports "+strings.Join(common.ChecksumAlgorithms, ",")+" (get only)")
+	cmd.StringVar(&archive, "archive", "", "Download directory as archive, supports "+strings.Join(common.ArchiveFormats, ",")+", extract to localPath unless it ends with the format extension (get only)")
 	cmd.Parse(args)
+	algorithms, err := common.ParseChecksumAlgorithms(checksum)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	remotePath := cmd.Arg(0)
 	if len(remotePath) < 1 {
@@ -26,6 +40,48 @@ func cmdGet(args []string, cmd *flag.FlagSet, options baseOptions) {
 
 	client := NewClient(options.server, options.token)
 
+	if len(archive) > 0 {
+		getArchive(client, remotePath, localPath, archive)
+		return
+	}
+
+	// 保存到本地文件时先获取文件信息，支持Range时分段下载并可以断点续传
+	expected := make(map[string]string)
+	if len(localPath) > 0 {
+		req, err := client.Head("file", remotePath)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		req.Header.Set("x-checksum", strings.Join(algorithms, ","))
+		res, err := client.Response(req)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		res.Body.Close()
+		if res.Header.Get("x-ok") == "false" {
+			fmt.Println(res.Header.Get("x-error"))
+			os.Exit(1)
+		}
+		for _, a := range algorithms {
+			expected[a] = res.Header.Get("x-content-" + a)
+		}
+		size, err := strconv.ParseInt(res.Header.Get("x-file-size"), 10, 64)
+		etag := res.Header.Get("etag")
+		if res.Header.Get("x-file-type") == "file" && res.Header.Get("accept-ranges") == "bytes" && err == nil && len(etag) > 0 {
+			fmt.Println("File Size:  ", size)
+			if err := downloadFile(client, remotePath, localPath, parallel, size, etag); err != nil {
+				fmt.Println()
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("Write to:", localPath)
+			verifyDownload(localPath, expected)
+			return
+		}
+	}
+
 	req, err := client.Get("file", remotePath)
 	if err != nil {
 		fmt.Println(err)
@@ -41,6 +97,7 @@ func cmdGet(args []string, cmd *flag.FlagSet, options baseOptions) {
 	if fileType == "file" {
 		if len(localPath) > 0 {
 			writeToFile(localPath, res.Body)
+			verifyDownload(localPath, expected)
 		} else {
 			fmt.Println()
 			fmt.Println()
@@ -58,6 +115,46 @@ func cmdGet(args []string, cmd *flag.FlagSet, options baseOptions) {
 	}
 }
 
+// 打包下载目录，localPath以格式的扩展名结尾时保存为文件，否则解压到该目录
+func getArchive(client *Client, remotePath string, localPath string, format string) {
+	if len(localPath) < 1 {
+		fmt.Println("Missing second argument <localPath>")
+		os.Exit(1)
+	}
+	req, err := client.Get("file", remotePath+"?archive="+format)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	res, err := client.Response(req)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer res.Body.Close()
+	if res.Header.Get("x-file-type") != "archive" {
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println()
+		fmt.Println(jsonPretty(body))
+		os.Exit(1)
+	}
+	if strings.HasSuffix(localPath, "."+format) {
+		writeToFile(localPath, res.Body)
+		return
+	}
+	n, err := common.ExtractArchive(res.Body, format, localPath, false)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("Extracted:  ", n, "files")
+	fmt.Println("Extract to:", localPath)
+}
+
 func writeToFile(file string, data io.Reader) {
 	fd, err := os.Create(file)
 	if err != nil {
@@ -80,3 +177,32 @@ func writeToScreen(data io.Reader) {
 	}
 	fmt.Println()
 }
+
+// 校验下载的文件与服务器返回的摘要是否一致，服务器不支持的算法跳过
+func verifyDownload(file string, expected map[string]string) {
+	algorithms := make([]string, 0)
+	for _, a := range common.ChecksumAlgorithms {
+		if v, ok := expected[a]; ok {
+			if len(v) < 1 {
+				fmt.Printf("Checksum:    %s not returned by remote server, skipped\n", a)
+				continue
+			}
+			algorithms = append(algorithms, a)
+		}
+	}
+	if len(algorithms) < 1 {
+		return
+	}
+	sums, err := common.FileChecksums(file, algorithms)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	for _, a := range algorithms {
+		if sums[a] != strings.ToLower(expected[a]) {
+			fmt.Printf("Checksum:    %s mismatch, expected %s but got %s\n", a, expected[a], sums[a])
+			os.Exit(1)
+		}
+		fmt.Printf("Checksum:    %s=%s\n", a, sums[a])
+	}
+}
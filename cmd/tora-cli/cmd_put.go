@@ -1,20 +1,30 @@
 package main
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/TylerBrock/colorjson"
 	"github.com/json-iterator/go"
+	"github.com/leizongmin/tora/common"
 	"io"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
-func cmdPut(args []string, cmd *flag.FlagSet, options baseOptions) {
+func cmdPut(args []string, cmd *flag.FlagSet, options *baseOptions) {
+	var checksum string
+	var extract bool
+	cmd.StringVar(&checksum, "checksum", "md5,sha256", "Checksums verified by remote server, supports "+strings.Join(common.ChecksumAlgorithms, ",")+" (put only)")
+	cmd.BoolVar(&extract, "extract", false, "Upload directory as one tar.gz archive and extract it on remote server, replacing the remote directory (put only)")
 	cmd.Parse(args)
+	algorithms, err := common.ParseChecksumAlgorithms(checksum)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
 	remotePath := cmd.Arg(0)
 	if len(remotePath) < 1 {
@@ -38,12 +48,15 @@ func cmdPut(args []string, cmd *flag.FlagSet, options baseOptions) {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-	if info.IsDir() {
+	if info.IsDir() && extract {
+		fmt.Println("File Type:   Dir")
+		err = uploadDirArchive(client, remotePath, localPath, algorithms)
+	} else if info.IsDir() {
 		fmt.Println("File Type:   Dir")
-		err = uploadDir(client, remotePath, localPath)
+		err = uploadDir(client, remotePath, localPath, algorithms)
 	} else {
 		fmt.Println("File Type:   file")
-		err = uploadFile(client, remotePath, localPath)
+		err = uploadFile(client, remotePath, localPath, algorithms)
 	}
 	if err != nil {
 		fmt.Println(err)
@@ -51,19 +64,19 @@ func cmdPut(args []string, cmd *flag.FlagSet, options baseOptions) {
 	}
 }
 
-func uploadDir(client *Client, remotePath string, localPath string) error {
+func uploadDir(client *Client, remotePath string, localPath string, algorithms []string) error {
 	files, err := ioutil.ReadDir(localPath)
 	if err != nil {
 		return err
 	}
 	for _, f := range files {
 		if f.IsDir() {
-			err := uploadDir(client, remotePath+"/"+f.Name(), filepath.Join(localPath, f.Name()))
+			err := uploadDir(client, remotePath+"/"+f.Name(), filepath.Join(localPath, f.Name()), algorithms)
 			if err != nil {
 				return err
 			}
 		} else {
-			err := uploadFile(client, remotePath+"/"+f.Name(), filepath.Join(localPath, f.Name()))
+			err := uploadFile(client, remotePath+"/"+f.Name(), filepath.Join(localPath, f.Name()), algorithms)
 			if err != nil {
 				return err
 			}
@@ -72,12 +85,56 @@ func uploadDir(client *Client, remotePath string, localPath string) error {
 	return nil
 }
 
-func uploadFile(client *Client, remotePath string, localPath string) error {
+// 将目录打包到临时文件后一次上传，由服务器解压并替换远程目录
+func uploadDirArchive(client *Client, remotePath string, localPath string, algorithms []string) error {
+	fmt.Printf("Upload: [%s] %s (tar.gz)\n", remotePath, localPath)
+	tmp, err := ioutil.TempFile("", "tora-put-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	sum, err := common.NewChecksumWriter(algorithms)
+	if err != nil {
+		return err
+	}
+	if err := common.WriteArchive(io.MultiWriter(tmp, sum), "tar.gz", localPath, nil); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	req, err := client.Put("file", remotePath+"?extract=tar.gz", tmp)
+	if err != nil {
+		return err
+	}
+	sums := sum.Sums()
+	setChecksumHeaders(req, sums)
+	_, data, err := client.ResponseJson(req)
+	if err != nil {
+		return err
+	}
+	if data.Get("ok").ToBool() {
+		printUploadSuccess(sums, data)
+		fmt.Printf("  - Extracted: %d files\n", data.Get("data", "files").ToInt())
+		return nil
+	}
+	return fmt.Errorf("upload failed: %s", data.Get("error"))
+}
+
+func uploadFile(client *Client, remotePath string, localPath string, algorithms []string) error {
 	fmt.Printf("Upload: [%s] %s\n", remotePath, localPath)
-	md5, err := getFileMd5(localPath)
+	sums, err := common.FileChecksums(localPath, algorithms)
 	if err != nil {
 		return err
 	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+	if info.Size() > chunkedUploadThreshold {
+		return uploadFileChunked(client, remotePath, localPath, info, sums)
+	}
 	file, err := os.Open(localPath)
 	if err != nil {
 		return err
@@ -86,32 +143,35 @@ func uploadFile(client *Client, remotePath string, localPath string) error {
 	if err != nil {
 		return err
 	}
-	req.Header.Set("x-content-md5", md5)
+	setChecksumHeaders(req, sums)
 	_, data, err := client.ResponseJson(req)
 	if err != nil {
 		return err
 	}
 	if data.Get("ok").ToBool() {
-		fmt.Printf("  - Success: md5=%s checked=%s\n", md5, data.Get("data", "checkedMd5").ToString())
+		printUploadSuccess(sums, data)
 		return nil
 	}
 	return fmt.Errorf("upload failed: %s", data.Get("error"))
 }
 
-func getFileMd5(filePath string) (string, error) {
-	var returnMD5String string
-	file, err := os.Open(filePath)
-	if err != nil {
-		return returnMD5String, err
+// 将摘要设置到请求头 x-content-<算法>，由服务器校验
+func setChecksumHeaders(req *http.Request, sums map[string]string) {
+	for a, v := range sums {
+		req.Header.Set("x-content-"+a, v)
 	}
-	defer file.Close()
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return returnMD5String, err
+}
+
+func printUploadSuccess(sums map[string]string, data jsoniter.Any) {
+	list := make([]string, 0)
+	for _, a := range common.ChecksumAlgorithms {
+		if v, ok := sums[a]; ok {
+			list = append(list, a+"="+v)
+		}
 	}
-	hashInBytes := hash.Sum(nil)[:16]
-	returnMD5String = hex.EncodeToString(hashInBytes)
-	return returnMD5String, nil
+	checked := make([]string, 0)
+	data.Get("data", "checked").ToVal(&checked)
+	fmt.Printf("  - Success: %s checked=%s\n", strings.Join(list, " "), strings.Join(checked, ","))
 }
 
 func formatRemotePath(remotePath string) string {
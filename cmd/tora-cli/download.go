@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 分段下载时每段的最小字节数
+const minSegmentSize = 4 * 1024 * 1024
+
+// 下载进度保存到状态文件的间隔字节数
+const saveStateInterval = 4 * 1024 * 1024
+
+// 下载过程中远程文件被修改
+var errRemoteChanged = errors.New("remote file changed during download, please run again")
+
+// 下载状态，保存在 <localPath>.part.json 中，再次下载同一个文件时从中断的位置继续
+type downloadState struct {
+	ETag     string            `json:"etag"`
+	Size     int64             `json:"size"`
+	Segments []downloadSegment `json:"segments"`
+}
+
+type downloadSegment struct {
+	Start  int64 `json:"start"`
+	End    int64 `json:"end"`    // 结束位置（不包含）
+	Offset int64 `json:"offset"` // 已经下载到的位置
+}
+
+type download struct {
+	client     *Client
+	remotePath string
+	localPath  string
+	state      downloadState
+	mu         sync.Mutex
+	done       int64 // 已经下载的字节数
+	unsaved    int64 // 上次保存状态后下载的字节数
+}
+
+func (d *download) partFile() string {
+	return d.localPath + ".part"
+}
+
+func (d *download) stateFile() string {
+	return d.localPath + ".part.json"
+}
+
+// 下载文件，远程文件支持Range时分为parallel段同时下载，中断后再次执行时从中断的位置继续
+func downloadFile(client *Client, remotePath string, localPath string, parallel int, size int64, etag string) error {
+	d := &download{client: client, remotePath: remotePath, localPath: localPath}
+	resumed := d.loadState(size, etag)
+	if !resumed {
+		d.state = downloadState{ETag: etag, Size: size, Segments: splitSegments(size, parallel)}
+	}
+	flag := os.O_CREATE | os.O_WRONLY
+	if !resumed {
+		flag |= os.O_TRUNC
+	}
+	fd, err := os.OpenFile(d.partFile(), flag, 0666)
+	if err != nil {
+		return err
+	}
+	for _, seg := range d.state.Segments {
+		d.done += seg.Offset - seg.Start
+	}
+	if resumed {
+		fmt.Printf("Resume:      %d/%d bytes\n", d.done, size)
+	}
+	fmt.Printf("Segments:    %d\n", len(d.state.Segments))
+
+	stop := make(chan struct{})
+	go d.printProgress(stop)
+	errs := make([]error, len(d.state.Segments))
+	var wg sync.WaitGroup
+	for i := range d.state.Segments {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = d.fetch(fd, i)
+		}(i)
+	}
+	wg.Wait()
+	close(stop)
+	closeErr := fd.Close()
+	for _, err := range errs {
+		if err == errRemoteChanged {
+			os.Remove(d.stateFile())
+			return err
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			d.saveState()
+			return fmt.Errorf("download interrupted at %d/%d bytes, run again to resume: %s", d.done, size, err)
+		}
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	if err := os.Rename(d.partFile(), localPath); err != nil {
+		return err
+	}
+	os.Remove(d.stateFile())
+	fmt.Printf("\r  - Downloaded %d bytes\n", size)
+	return nil
+}
+
+// 将文件平均分为最多parallel段，每段不小于minSegmentSize
+func splitSegments(size int64, parallel int) []downloadSegment {
+	n := int64(parallel)
+	if max := size / minSegmentSize; n > max {
+		n = max
+	}
+	if n < 1 {
+		n = 1
+	}
+	list := make([]downloadSegment, n)
+	step := size / n
+	for i := int64(0); i < n; i++ {
+		list[i] = downloadSegment{Start: i * step, End: (i + 1) * step, Offset: i * step}
+	}
+	list[n-1].End = size
+	return list
+}
+
+// 读取上次中断时保存的状态，远程文件已经改变或者本地文件不完整时返回false
+func (d *download) loadState(size int64, etag string) bool {
+	b, err := ioutil.ReadFile(d.stateFile())
+	if err != nil {
+		return false
+	}
+	var state downloadState
+	if err := json.Unmarshal(b, &state); err != nil || state.ETag != etag || state.Size != size || len(state.Segments) < 1 {
+		return false
+	}
+	info, err := os.Stat(d.partFile())
+	if err != nil {
+		return false
+	}
+	for _, seg := range state.Segments {
+		if seg.Offset < seg.Start || seg.Offset > seg.End || seg.Offset > info.Size() {
+			return false
+		}
+	}
+	d.state = state
+	return true
+}
+
+func (d *download) saveState() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	b, err := json.Marshal(d.state)
+	d.unsaved = 0
+	if err != nil {
+		return
+	}
+	tmp := d.stateFile() + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return
+	}
+	os.Rename(tmp, d.stateFile())
+}
+
+// 下载一段内容，通过If-Range保证各段来自同一个版本的文件
+func (d *download) fetch(fd *os.File, i int) error {
+	d.mu.Lock()
+	seg := d.state.Segments[i]
+	d.mu.Unlock()
+	if seg.Offset >= seg.End {
+		return nil
+	}
+	req, err := d.client.Get("file", d.remotePath)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("range", "bytes="+strconv.FormatInt(seg.Offset, 10)+"-"+strconv.FormatInt(seg.End-1, 10))
+	req.Header.Set("if-range", d.state.ETag)
+	res, err := d.client.Response(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == 200 {
+		return errRemoteChanged
+	}
+	if res.StatusCode != 206 {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("unexpected response %s: %s", res.Status, body)
+	}
+	offset := seg.Offset
+	buf := make([]byte, 256*1024)
+	for offset < seg.End {
+		n, err := res.Body.Read(buf)
+		if int64(n) > seg.End-offset {
+			n = int(seg.End - offset)
+		}
+		if n > 0 {
+			if _, err := fd.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			offset += int64(n)
+			d.advance(i, offset, int64(n))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if offset < seg.End {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+// 更新一段的下载位置，每下载saveStateInterval字节保存一次状态
+func (d *download) advance(i int, offset int64, n int64) {
+	d.mu.Lock()
+	d.state.Segments[i].Offset = offset
+	d.done += n
+	d.unsaved += n
+	save := d.unsaved >= saveStateInterval
+	d.mu.Unlock()
+	if save {
+		d.saveState()
+	}
+}
+
+func (d *download) printProgress(stop chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		d.mu.Lock()
+		done := d.done
+		d.mu.Unlock()
+		if d.state.Size > 0 {
+			fmt.Printf("\r  - Downloaded %d/%d bytes (%d%%)", done, d.state.Size, done*100/d.state.Size)
+		}
+	}
+}
@@ -37,11 +37,15 @@ func main() {
 
 	switch cmdType {
 	case "put":
-		cmdPut(args, cmd, options)
+		cmdPut(args, cmd, &options)
 	case "delete":
-		cmdDelete(args, cmd, options)
+		cmdDelete(args, cmd, &options)
 	case "get":
-		cmdGet(args, cmd, options)
+		cmdGet(args, cmd, &options)
+	case "exec":
+		cmdExec(args, cmd, &options)
+	case "attach":
+		cmdAttach(args, cmd, &options)
 	case "help":
 		printUsage(cmd)
 	default:
@@ -54,9 +58,12 @@ func printUsage(cmd *flag.FlagSet) {
 	fmt.Fprintf(os.Stderr, "%s/%s for %s\n\n", CmdName, server.Version, runtime.GOOS)
 	fmt.Fprintf(os.Stderr, "Usage: \n")
 	fmt.Fprintf(os.Stderr, "    %s [-s server] [-t token]\n", CmdName)
-	fmt.Fprintf(os.Stderr, "        put <remotePath> <localPath>      Put file or directory to remote server\n")
+	fmt.Fprintf(os.Stderr, "        put <remotePath> <localPath>      Put file or directory to remote server, use -extract to upload directory as one archive\n")
 	fmt.Fprintf(os.Stderr, "        delete <remotePath>               Delete file or directory from remote server\n")
-	fmt.Fprintf(os.Stderr, "        get <remotePath> [localPath]      Get file from remote server\n")
+	fmt.Fprintf(os.Stderr, "        get <remotePath> [localPath]      Get file from remote server, use -p to set parallel segments, run again to resume\n")
+	fmt.Fprintf(os.Stderr, "        get -archive tar.gz <remotePath> <localPath>  Get directory as archive, save to localPath.tar.gz or extract to localPath\n")
+	fmt.Fprintf(os.Stderr, "        exec <execInfoFile>               Execute commands on remote server, use - to read from stdin\n")
+	fmt.Fprintf(os.Stderr, "        attach <command> [args]           Run command in a pseudo-terminal on remote server, use -cwd to set working directory\n")
 	if cmd != nil {
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		cmd.PrintDefaults()
@@ -0,0 +1,27 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// 本地终端大小改变时通知远程终端
+func watchTerminalResize(fd int, onResize func(cols int, rows int)) {
+	if !terminal.IsTerminal(fd) {
+		return
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGWINCH)
+	go func() {
+		for range c {
+			if cols, rows, err := terminal.GetSize(fd); err == nil {
+				onResize(cols, rows)
+			}
+		}
+	}()
+}
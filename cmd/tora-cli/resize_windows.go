@@ -0,0 +1,5 @@
+package main
+
+// Windows不支持SIGWINCH信号，仅在连接时传递终端大小
+func watchTerminalResize(fd int, onResize func(cols int, rows int)) {
+}
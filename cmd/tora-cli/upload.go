@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/json-iterator/go"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 超过此大小的文件使用分段上传
+const chunkedUploadThreshold = 64 * 1024 * 1024
+
+// 分段上传时每段的字节数
+const uploadChunkSize = 8 * 1024 * 1024
+
+// 上传一段失败后的重试次数
+const uploadRetries = 5
+
+// 分段上传的状态，保存在临时目录中，再次上传同一个文件时继续使用之前的会话
+type uploadState struct {
+	Id string `json:"id"`
+}
+
+// 分段上传文件，中断后重试或再次执行时只上传服务器未接收的部分
+func uploadFileChunked(client *Client, remotePath string, localPath string, info os.FileInfo, sums map[string]string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	size := info.Size()
+	stateFile := uploadStateFile(client, remotePath, localPath, info)
+
+	var received [][2]int64
+	var id string
+	if b, err := ioutil.ReadFile(stateFile); err == nil {
+		var state uploadState
+		if json.Unmarshal(b, &state) == nil && len(state.Id) > 0 {
+			if r, err := queryUpload(client, remotePath, state.Id); err == nil {
+				id, received = state.Id, r
+				fmt.Printf("  - Resume upload [%s]: %d/%d bytes\n", id, receivedBytes(received), size)
+			}
+		}
+	}
+	if len(id) < 1 {
+		if id, err = createUpload(client, remotePath, size); err != nil {
+			return err
+		}
+		received = nil
+		b, _ := json.Marshal(uploadState{Id: id})
+		ioutil.WriteFile(stateFile, b, 0600)
+	}
+
+	for retry := 0; ; retry++ {
+		err = nil
+		for _, r := range missingRanges(received, size) {
+			for offset := r[0]; offset < r[1]; offset += uploadChunkSize {
+				n := r[1] - offset
+				if n > uploadChunkSize {
+					n = uploadChunkSize
+				}
+				var r [][2]int64
+				if r, err = uploadChunk(client, remotePath, id, file, offset, n); err != nil {
+					break
+				}
+				received = r
+				fmt.Printf("\r  - Uploaded %d/%d bytes (%d%%)", receivedBytes(received), size, receivedBytes(received)*100/size)
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			break
+		}
+		if retry >= uploadRetries {
+			return fmt.Errorf("upload interrupted, run again to resume: %s", err)
+		}
+		fmt.Printf("\n  - Upload failed: %s, retry after %d seconds\n", err, retry+1)
+		time.Sleep(time.Duration(retry+1) * time.Second)
+		if r, e := queryUpload(client, remotePath, id); e == nil {
+			received = r
+		}
+	}
+	fmt.Println()
+
+	req, err := client.Post("file", remotePath+"?upload="+id, nil)
+	if err != nil {
+		return err
+	}
+	setChecksumHeaders(req, sums)
+	_, data, err := client.ResponseJson(req)
+	if err != nil {
+		return err
+	}
+	if !data.Get("ok").ToBool() {
+		return fmt.Errorf("upload failed: %s", data.Get("error"))
+	}
+	os.Remove(stateFile)
+	printUploadSuccess(sums, data)
+	return nil
+}
+
+// 状态文件的名称由服务器地址、远程路径和本地文件的信息决定，本地文件改变后重新上传
+func uploadStateFile(client *Client, remotePath string, localPath string, info os.FileInfo) string {
+	key := fmt.Sprintf("%s\n%s\n%s\n%d\n%d", client.addr, remotePath, localPath, info.Size(), info.ModTime().UnixNano())
+	hash := md5.Sum([]byte(key))
+	return filepath.Join(os.TempDir(), "tora-upload-"+hex.EncodeToString(hash[:])+".json")
+}
+
+func createUpload(client *Client, remotePath string, size int64) (string, error) {
+	req, err := client.Post("file", remotePath+"?upload", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("x-file-size", strconv.FormatInt(size, 10))
+	_, data, err := client.ResponseJson(req)
+	if err != nil {
+		return "", err
+	}
+	if !data.Get("ok").ToBool() {
+		return "", fmt.Errorf("create upload failed: %s", data.Get("error"))
+	}
+	return data.Get("data", "id").ToString(), nil
+}
+
+func queryUpload(client *Client, remotePath string, id string) ([][2]int64, error) {
+	req, err := client.Get("file", remotePath+"?upload="+id)
+	if err != nil {
+		return nil, err
+	}
+	_, data, err := client.ResponseJson(req)
+	if err != nil {
+		return nil, err
+	}
+	if !data.Get("ok").ToBool() {
+		return nil, fmt.Errorf("query upload failed: %s", data.Get("error"))
+	}
+	return parseReceived(data.Get("data", "received")), nil
+}
+
+func uploadChunk(client *Client, remotePath string, id string, file *os.File, offset int64, n int64) ([][2]int64, error) {
+	body := ioutil.NopCloser(io.NewSectionReader(file, offset, n))
+	req, err := client.Put("file", remotePath+"?upload="+id+"&offset="+strconv.FormatInt(offset, 10), body)
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = n
+	_, data, err := client.ResponseJson(req)
+	if err != nil {
+		return nil, err
+	}
+	if !data.Get("ok").ToBool() {
+		return nil, fmt.Errorf("%s", data.Get("error"))
+	}
+	return parseReceived(data.Get("data", "received")), nil
+}
+
+func parseReceived(v jsoniter.Any) [][2]int64 {
+	list := make([][2]int64, v.Size())
+	for i := range list {
+		list[i] = [2]int64{v.Get(i, 0).ToInt64(), v.Get(i, 1).ToInt64()}
+	}
+	return list
+}
+
+// 服务器未接收的范围，received按开始位置排列且不重叠
+func missingRanges(received [][2]int64, size int64) [][2]int64 {
+	list := make([][2]int64, 0)
+	var pos int64
+	for _, r := range received {
+		if r[0] > pos {
+			list = append(list, [2]int64{pos, r[0]})
+		}
+		if r[1] > pos {
+			pos = r[1]
+		}
+	}
+	if pos < size {
+		list = append(list, [2]int64{pos, size})
+	}
+	return list
+}
+
+func receivedBytes(received [][2]int64) int64 {
+	var n int64
+	for _, r := range received {
+		n += r[1] - r[0]
+	}
+	return n
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"flag"
 	"github.com/coreos/go-systemd/daemon"
+	logmodule "github.com/leizongmin/tora/module/log"
+	"github.com/leizongmin/tora/module/shell"
 	"github.com/leizongmin/tora/server"
 	"github.com/sirupsen/logrus"
 	"net/http"
@@ -58,11 +60,52 @@ func cmdStart(args []string) {
 			AllowDelete:  c.Module.File.AllowDelete,
 			AllowPut:     c.Module.File.AllowPut,
 			AllowListDir: c.Module.File.AllowListDir,
+			UploadDir:    c.Module.File.UploadDir,
+			UploadExpire: c.Module.File.UploadExpire,
+		},
+		ShellOptions: server.ShellOptions{
+			Root:                  c.Module.Shell.Root,
+			AllowInternalCommands: c.Module.Shell.AllowInternalCommands,
+			AllowExternalCommands: c.Module.Shell.AllowExternalCommands,
+			KillGracePeriod:       c.Module.Shell.KillGracePeriod,
+			MaxFinishedJobs:       c.Module.Shell.MaxFinishedJobs,
+			MaxTimeout:            c.Module.Shell.MaxTimeout,
+			MaxStepTimeout:        c.Module.Shell.MaxStepTimeout,
+			CleanupTimeout:        c.Module.Shell.CleanupTimeout,
+			Tasks:                 mapConfigShellTaskToShellTask(c.Module.Shell.Tasks),
+			RunAsUser:             c.Module.Shell.RunAsUser,
+			RunAsGroup:            c.Module.Shell.RunAsGroup,
+			Limits:                mapConfigShellLimitsToShellLimits(c.Module.Shell.Limits),
+			MaxConcurrent:         c.Module.Shell.MaxConcurrent,
+			HistoryDir:            c.Module.Shell.HistoryDir,
+			HistoryMaxAge:         c.Module.Shell.HistoryMaxAge,
+			HistoryMaxSize:        c.Module.Shell.HistoryMaxSize,
+			HistoryOutputSize:     c.Module.Shell.HistoryOutputSize,
+			AllowPtyCommands:      c.Module.Shell.AllowPtyCommands,
+			Schedules:             mapConfigShellScheduleToShellSchedule(c.Module.Shell.Schedules),
+			CleanEnv:              c.Module.Shell.CleanEnv,
+			AllowEnv:              c.Module.Shell.AllowEnv,
+			Env:                   c.Module.Shell.Env,
+			Secrets:               c.Module.Shell.Secrets,
+		},
+		LogOptions: server.LogOptions{
+			Sources:      mapConfigLogSourceToLogSource(c.Module.Log.Sources),
+			MaxLines:     c.Module.Log.MaxLines,
+			PollInterval: c.Module.Log.PollInterval,
+			Streams:      mapConfigLogStreamToLogStream(c.Module.Log.Streams),
+			MaxBodySize:  c.Module.Log.MaxBodySize,
 		},
 		Auth: server.Auth{
 			Token: mapConfigAuthItemToServerAuthItem(c.Auth.Token),
 			IP:    mapConfigAuthItemToServerAuthItem(c.Auth.IP),
 		},
+		Audit: server.AuditOptions{
+			Path:     c.Audit.Path,
+			MaxSize:  c.Audit.MaxSize,
+			MaxFiles: c.Audit.MaxFiles,
+			Source:   c.Audit.Source,
+			Sync:     c.Audit.Sync,
+		},
 	})
 	if err != nil {
 		log.Panicf("Try to start server failed: %s\n", err)
@@ -134,3 +177,111 @@ func mapConfigAuthItemToServerAuthItem(m map[string]ConfigAuthItem) (r map[strin
 	}
 	return r
 }
+
+func mapConfigShellTaskToShellTask(m map[string]ConfigShellTask) (r map[string]shell.Task) {
+	if m == nil {
+		return r
+	}
+	r = make(map[string]shell.Task)
+	for k, v := range m {
+		params := make(map[string]shell.TaskParam)
+		for pk, pv := range v.Params {
+			params[pk] = shell.TaskParam{
+				Pattern:  pv.Pattern,
+				Default:  pv.Default,
+				Required: pv.Required,
+			}
+		}
+		r[k] = shell.Task{
+			CWD:         v.CWD,
+			Env:         v.Env,
+			Params:      params,
+			Run:         mapConfigShellStepToShellStep(v.Run),
+			OnSuccess:   mapConfigShellStepToShellStep(v.OnSuccess),
+			OnError:     mapConfigShellStepToShellStep(v.OnError),
+			OnEnd:       mapConfigShellStepToShellStep(v.OnEnd),
+			Timeout:     v.Timeout,
+			StepTimeout: v.StepTimeout,
+			RunAsUser:   v.RunAsUser,
+			RunAsGroup:  v.RunAsGroup,
+			Limits:      mapConfigShellLimitsToShellLimits(v.Limits),
+			Lock:        v.Lock,
+			Secrets:     v.Secrets,
+		}
+	}
+	return r
+}
+
+func mapConfigShellStepToShellStep(list []ConfigShellStep) (r []shell.Step) {
+	if list == nil {
+		return r
+	}
+	r = make([]shell.Step, len(list))
+	for i, v := range list {
+		r[i] = shell.Step{
+			Command:         v.Command,
+			Parallel:        v.Parallel,
+			FailFast:        v.FailFast,
+			Retries:         v.Retries,
+			Backoff:         int(v.Backoff / time.Second),
+			ContinueOnError: v.ContinueOnError,
+		}
+	}
+	return r
+}
+
+func mapConfigShellScheduleToShellSchedule(m map[string]ConfigShellSchedule) (r map[string]shell.Schedule) {
+	if m == nil {
+		return r
+	}
+	r = make(map[string]shell.Schedule)
+	for k, v := range m {
+		r[k] = shell.Schedule{
+			Task:         v.Task,
+			Cron:         v.Cron,
+			Params:       v.Params,
+			Jitter:       v.Jitter,
+			AllowOverlap: v.AllowOverlap,
+		}
+	}
+	return r
+}
+
+func mapConfigLogSourceToLogSource(m map[string]ConfigLogSource) (r map[string]logmodule.Source) {
+	if m == nil {
+		return r
+	}
+	r = make(map[string]logmodule.Source)
+	for k, v := range m {
+		r[k] = logmodule.Source{
+			Path: v.Path,
+		}
+	}
+	return r
+}
+
+func mapConfigLogStreamToLogStream(m map[string]ConfigLogStream) (r map[string]logmodule.Stream) {
+	if m == nil {
+		return r
+	}
+	r = make(map[string]logmodule.Stream)
+	for k, v := range m {
+		r[k] = logmodule.Stream{
+			Path:     v.Path,
+			MaxSize:  v.MaxSize,
+			MaxFiles: v.MaxFiles,
+			Allow:    v.Allow,
+		}
+	}
+	return r
+}
+
+func mapConfigShellLimitsToShellLimits(l ConfigShellLimits) shell.ResourceLimits {
+	return shell.ResourceLimits{
+		CPUSeconds:   l.CPUSeconds,
+		AddressSpace: l.AddressSpace,
+		OpenFiles:    l.OpenFiles,
+		MaxProcesses: l.MaxProcesses,
+		OutputSize:   l.OutputSize,
+	}
+}
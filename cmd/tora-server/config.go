@@ -2,11 +2,15 @@ package main
 
 import (
 	"bytes"
+	"fmt"
 	"github.com/leizongmin/tora/module/file"
+	"github.com/leizongmin/tora/module/log"
+	"github.com/leizongmin/tora/module/shell"
 	"github.com/leizongmin/tora/server"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"time"
 )
 
 type Config struct {
@@ -15,6 +19,15 @@ type Config struct {
 	Enable []string     `yaml:"enable"` // 开启的模块
 	Module ConfigModule `yaml:"module"` // 模块对应的配置
 	Auth   ConfigAuth   `yaml:"auth"`   // 授权规则
+	Audit  ConfigAudit  `yaml:"audit"`  // 审计日志
+}
+
+type ConfigAudit struct {
+	Path     string `yaml:"path"`     // 审计日志文件路径，为空时不记录
+	MaxSize  int64  `yaml:"maxSize"`  // 文件的最大字节数，超过后轮转
+	MaxFiles int    `yaml:"maxFiles"` // 保留的轮转后的文件数量
+	Source   string `yaml:"source"`   // 开启了log模块时作为日志源的名称，默认为audit
+	Sync     bool   `yaml:"sync"`     // 每行写入后同步到磁盘
 }
 
 type ConfigLog struct {
@@ -39,17 +52,126 @@ type ConfigModule struct {
 }
 
 type ConfigModuleFile struct {
-	Root         string      `yaml:"root"`         // 根目录
-	AllowPut     bool        `yaml:"allowPut"`     // 允许上传文件
-	AllowDelete  bool        `yaml:"allowDelete"`  // 允许删除文件
-	AllowListDir bool        `yaml:"allowListDir"` // 允许列出目录
-	DirPerm      os.FileMode `yaml:"dirPerm"`      // 创建的目录权限
-	FilePerm     os.FileMode `yaml:"filePerm"`     // 创建的文件权限
+	Root         string        `yaml:"root"`         // 根目录
+	AllowPut     bool          `yaml:"allowPut"`     // 允许上传文件
+	AllowDelete  bool          `yaml:"allowDelete"`  // 允许删除文件
+	AllowListDir bool          `yaml:"allowListDir"` // 允许列出目录
+	DirPerm      os.FileMode   `yaml:"dirPerm"`      // 创建的目录权限
+	FilePerm     os.FileMode   `yaml:"filePerm"`     // 创建的文件权限
+	UploadDir    string        `yaml:"uploadDir"`    // 分段上传的会话状态保存目录
+	UploadExpire time.Duration `yaml:"uploadExpire"` // 分段上传的会话超过此时间没有写入时删除，如：24h
+}
+
+type ConfigModuleShell struct {
+	Root                  string                         `yaml:"root"`                  // 执行命令的根目录
+	AllowInternalCommands []string                       `yaml:"allowInternalCommands"` // 允许执行的内部命令
+	AllowExternalCommands []string                       `yaml:"allowExternalCommands"` // 允许执行的外部命令
+	KillGracePeriod       time.Duration                  `yaml:"killGracePeriod"`       // 取消执行时发送SIGTERM信号后等待进程退出的时间，如：10s
+	MaxFinishedJobs       int                            `yaml:"maxFinishedJobs"`       // 保留的已结束异步任务数量
+	MaxTimeout            time.Duration                  `yaml:"maxTimeout"`            // run和onSuccess阶段的最大总超时时间，如：1h
+	MaxStepTimeout        time.Duration                  `yaml:"maxStepTimeout"`        // 单条命令的最大超时时间，如：10m
+	CleanupTimeout        time.Duration                  `yaml:"cleanupTimeout"`        // onError和onEnd阶段的总超时时间，如：10m
+	Tasks                 map[string]ConfigShellTask     `yaml:"tasks"`                 // 预先定义的任务
+	RunAsUser             string                         `yaml:"runAsUser"`             // 以指定用户身份执行外部命令，需要以root身份运行
+	RunAsGroup            string                         `yaml:"runAsGroup"`            // 以指定组身份执行外部命令
+	Limits                ConfigShellLimits              `yaml:"limits"`                // 外部命令的资源限制
+	MaxConcurrent         int                            `yaml:"maxConcurrent"`         // 最多同时执行的数量，超过后排队，0表示不限制
+	HistoryDir            string                         `yaml:"historyDir"`            // 保存执行记录的目录，为空表示不保存
+	HistoryMaxAge         time.Duration                  `yaml:"historyMaxAge"`         // 执行记录的最长保留时间，如：720h，小于0表示不限制
+	HistoryMaxSize        int64                          `yaml:"historyMaxSize"`        // 执行记录的最大总字节数，小于0表示不限制
+	HistoryOutputSize     int                            `yaml:"historyOutputSize"`     // 执行记录中每条命令保留的输出字节数
+	AllowPtyCommands      []string                       `yaml:"allowPtyCommands"`      // 允许在伪终端中执行的命令
+	Schedules             map[string]ConfigShellSchedule `yaml:"schedules"`             // 定时执行的任务
+	CleanEnv              bool                           `yaml:"cleanEnv"`              // 外部命令不继承tora-server的环境变量
+	AllowEnv              []string                       `yaml:"allowEnv"`              // cleanEnv时仍然继承的环境变量，支持*通配符
+	Env                   map[string]string              `yaml:"env"`                   // 所有外部命令的环境变量
+	Secrets               map[string]string              `yaml:"secrets"`               // 密钥名称和保存密钥的文件
 }
 
-type ConfigModuleShell struct{}
+type ConfigShellTask struct {
+	CWD         string                          `yaml:"cwd"`         // 工作目录，相对于根目录
+	Env         map[string]string               `yaml:"env"`         // 环境变量
+	Params      map[string]ConfigShellTaskParam `yaml:"params"`      // 允许客户端传递的参数
+	Run         []ConfigShellStep               `yaml:"run"`         // 依次执行的步骤
+	OnSuccess   []ConfigShellStep               `yaml:"onSuccess"`   // run全部执行成功后执行的步骤
+	OnError     []ConfigShellStep               `yaml:"onError"`     // run执行失败后执行的步骤
+	OnEnd       []ConfigShellStep               `yaml:"onEnd"`       // 最后执行的步骤
+	Timeout     time.Duration                   `yaml:"timeout"`     // run和onSuccess阶段的总超时时间
+	StepTimeout time.Duration                   `yaml:"stepTimeout"` // 单条命令的超时时间
+	RunAsUser   string                          `yaml:"runAsUser"`   // 以指定用户身份执行外部命令
+	RunAsGroup  string                          `yaml:"runAsGroup"`  // 以指定组身份执行外部命令
+	Limits      ConfigShellLimits               `yaml:"limits"`      // 外部命令的资源限制
+	Lock        string                          `yaml:"lock"`        // 锁名称，持有相同锁的执行会依次进行
+	Secrets     map[string]string               `yaml:"secrets"`     // 密钥名称和保存密钥的文件
+}
+
+type ConfigShellSchedule struct {
+	Task         string            `yaml:"task"`         // 执行的任务名称
+	Cron         string            `yaml:"cron"`         // cron表达式，如：0 3 * * *
+	Params       map[string]string `yaml:"params"`       // 传递给任务的参数
+	Jitter       time.Duration     `yaml:"jitter"`       // 每次执行前随机延迟的最长时间，如：5m
+	AllowOverlap bool              `yaml:"allowOverlap"` // 是否允许上一次执行未结束时开始新的执行
+}
 
-type ConfigModuleLog struct{}
+// 执行步骤，仅有一条命令时可以直接写为字符串
+type ConfigShellStep struct {
+	Command         string        `yaml:"command"`         // 单条命令
+	Parallel        []string      `yaml:"parallel"`        // 并行执行的一组命令
+	FailFast        bool          `yaml:"failFast"`        // 并行执行时有命令失败则结束其他命令
+	Retries         int           `yaml:"retries"`         // 失败后的重试次数
+	Backoff         time.Duration `yaml:"backoff"`         // 第一次重试前等待的时间，之后每次加倍，如：5s
+	ContinueOnError bool          `yaml:"continueOnError"` // 失败后是否继续执行后续步骤
+}
+
+func (s *ConfigShellStep) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var command string
+	if err := unmarshal(&command); err == nil {
+		*s = ConfigShellStep{Command: command}
+		return nil
+	}
+	type step ConfigShellStep
+	if err := unmarshal((*step)(s)); err != nil {
+		return err
+	}
+	// 执行步骤的等待时间以秒为单位
+	if s.Backoff < 0 || s.Backoff%time.Second != 0 {
+		return fmt.Errorf("invalid backoff [%s]: must be whole seconds", s.Backoff)
+	}
+	return nil
+}
+
+type ConfigShellTaskParam struct {
+	Pattern  string `yaml:"pattern"`  // 参数值需要完整匹配的正则表达式
+	Default  string `yaml:"default"`  // 默认值
+	Required bool   `yaml:"required"` // 是否必须由客户端传递
+}
+
+type ConfigShellLimits struct {
+	CPUSeconds   uint64 `yaml:"cpuSeconds"`   // 最大CPU时间（秒）
+	AddressSpace uint64 `yaml:"addressSpace"` // 最大虚拟内存（字节）
+	OpenFiles    uint64 `yaml:"openFiles"`    // 最多打开的文件数量
+	MaxProcesses uint64 `yaml:"maxProcesses"` // 运行身份对应的用户最多的进程数量
+	OutputSize   int64  `yaml:"outputSize"`   // 单条命令输出的最大字节数
+}
+
+type ConfigModuleLog struct {
+	Sources      map[string]ConfigLogSource `yaml:"sources"`      // 日志源
+	MaxLines     int                        `yaml:"maxLines"`     // 最多返回的行数
+	PollInterval time.Duration              `yaml:"pollInterval"` // 跟踪日志时检查文件变化的间隔，如：500ms
+	Streams      map[string]ConfigLogStream `yaml:"streams"`      // 写入流
+	MaxBodySize  int64                      `yaml:"maxBodySize"`  // 每次写入的最大字节数
+}
+
+type ConfigLogSource struct {
+	Path string `yaml:"path"` // 日志文件路径，支持glob通配符
+}
+
+type ConfigLogStream struct {
+	Path     string   `yaml:"path"`     // 日志文件路径
+	MaxSize  int64    `yaml:"maxSize"`  // 文件的最大字节数，超过后轮转
+	MaxFiles int      `yaml:"maxFiles"` // 保留的轮转后的文件数量
+	Allow    []string `yaml:"allow"`    // 允许写入的token或IP
+}
 
 func GetDefaultConfig() Config {
 	c := Config{
@@ -61,12 +183,26 @@ func GetDefaultConfig() Config {
 		Enable: []string{},
 		Module: ConfigModule{
 			File: ConfigModuleFile{
-				AllowPut: true,
-				DirPerm:  file.DefaultDirPerm,
-				FilePerm: file.DefaultFilePerm,
+				AllowPut:     true,
+				DirPerm:      file.DefaultDirPerm,
+				FilePerm:     file.DefaultFilePerm,
+				UploadExpire: file.DefaultUploadExpire,
+			},
+			Shell: ConfigModuleShell{
+				AllowInternalCommands: shell.DefaultAllowInternalCommands,
+				AllowExternalCommands: shell.DefaultAllowExternalCommands,
+				KillGracePeriod:       shell.DefaultKillGracePeriod,
+				CleanupTimeout:        shell.DefaultCleanupTimeout,
+				MaxFinishedJobs:       shell.DefaultMaxFinishedJobs,
+				HistoryMaxAge:         shell.DefaultHistoryMaxAge,
+				HistoryMaxSize:        shell.DefaultHistoryMaxSize,
+				HistoryOutputSize:     shell.DefaultHistoryOutputSize,
+			},
+			Log: ConfigModuleLog{
+				MaxLines:     log.DefaultMaxLines,
+				PollInterval: log.DefaultPollInterval,
+				MaxBodySize:  log.DefaultMaxBodySize,
 			},
-			Shell: ConfigModuleShell{},
-			Log:   ConfigModuleLog{},
 		},
 		Auth: ConfigAuth{
 			IP:    make(map[string]ConfigAuthItem),
@@ -3,6 +3,7 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/leizongmin/tora/module/shell"
 	"github.com/leizongmin/tora/server"
 	"os"
 	"runtime"
@@ -14,6 +15,9 @@ const SystemdServiceFilePath = "/lib/systemd/system/tora.service"
 const CmdName = "tora-server"
 
 func main() {
+	// 为设置外部命令的资源限制而重新执行时，不会返回
+	shell.RunResourceLimitHelper()
+
 	// 获取子命令
 	var cmdType string
 	var args []string
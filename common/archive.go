@@ -0,0 +1,439 @@
+package common
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// 支持的目录打包格式
+var ArchiveFormats = []string{"tar.gz", "tar", "zip"}
+
+// 返回打包格式的标准名称，tgz为tar.gz的别名
+func ParseArchiveFormat(format string) (string, error) {
+	switch format {
+	case "tar.gz", "tgz":
+		return "tar.gz", nil
+	case "tar", "zip":
+		return format, nil
+	}
+	return "", fmt.Errorf("unsupported archive format [%s]", format)
+}
+
+// 打包时写入一个文件或目录
+type archiveWriter interface {
+	add(name string, info os.FileInfo, link string, r io.Reader) error
+	close() error
+}
+
+type tarArchive struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchive) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	h, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.IsDir() {
+		h.Name += "/"
+	}
+	if err := a.tw.WriteHeader(h); err != nil {
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(a.tw, r)
+	}
+	return err
+}
+
+func (a *tarArchive) close() error {
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+	if a.gz != nil {
+		return a.gz.Close()
+	}
+	return nil
+}
+
+type zipArchive struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchive) add(name string, info os.FileInfo, link string, r io.Reader) error {
+	h, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	h.Name = name
+	if info.IsDir() {
+		h.Name += "/"
+	} else if info.Mode().IsRegular() {
+		h.Method = zip.Deflate
+	}
+	w, err := a.zw.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	// 符号链接的内容为链接的目标
+	if len(link) > 0 {
+		_, err = io.WriteString(w, link)
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(w, r)
+	}
+	return err
+}
+
+func (a *zipArchive) close() error {
+	return a.zw.Close()
+}
+
+// 将目录打包写入w，文件名为相对于目录的路径，保留权限和修改时间，skip返回true的路径不打包，
+// 符号链接按链接本身打包，不读取链接指向的文件，设备文件、管道等会被忽略。
+// 出错时不结束打包的内容，使读取方能够发现内容不完整
+func WriteArchive(w io.Writer, format string, dir string, skip func(p string) bool) error {
+	format, err := ParseArchiveFormat(format)
+	if err != nil {
+		return err
+	}
+	var a archiveWriter
+	switch format {
+	case "tar.gz":
+		gz := gzip.NewWriter(w)
+		a = &tarArchive{gz: gz, tw: tar.NewWriter(gz)}
+	case "tar":
+		a = &tarArchive{tw: tar.NewWriter(w)}
+	case "zip":
+		a = &zipArchive{zw: zip.NewWriter(w)}
+	}
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir {
+			return nil
+		}
+		if skip != nil && skip(p) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		mode := info.Mode()
+		switch {
+		case mode.IsDir():
+			return a.add(rel, info, "", nil)
+		case mode&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return a.add(rel, info, link, nil)
+		case mode.IsRegular():
+			fd, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			return a.add(rel, info, "", fd)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return a.close()
+}
+
+// 解压时需要在最后处理的符号链接和目录的权限、修改时间
+type archiveExtractor struct {
+	dir     string
+	confine bool
+	links   map[string]string
+	dirs    map[string]os.FileInfo
+	files   int
+}
+
+// 将打包的内容解压到dir，保留权限和修改时间，返回解压的文件数量。
+// 不允许包含绝对路径和 .. 的文件名，符号链接在其他文件之后创建，避免通过链接写入到dir之外；
+// confine为true时，符号链接必须指向dir之内已存在的文件或目录
+func ExtractArchive(r io.Reader, format string, dir string, confine bool) (int, error) {
+	a, err := ExtractArchiveFiles(r, format, dir, confine)
+	if err != nil {
+		return 0, err
+	}
+	return a.Files, a.ApplyDirModes()
+}
+
+// 已解压的内容，目录的权限和修改时间在调用 ApplyDirModes 后才设置
+type ExtractedArchive struct {
+	Files int // 解压的文件数量
+	dirs  map[string]os.FileInfo
+}
+
+// 与 ExtractArchive 相同，但目录保持可写，以便校验失败时可以删除，
+// 校验通过后再调用 ApplyDirModes 设置包中目录的权限和修改时间
+func ExtractArchiveFiles(r io.Reader, format string, dir string, confine bool) (*ExtractedArchive, error) {
+	format, err := ParseArchiveFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	e := &archiveExtractor{dir: dir, confine: confine, links: make(map[string]string), dirs: make(map[string]os.FileInfo)}
+	switch format {
+	case "tar.gz":
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(r); err == nil {
+			err = e.extractTar(gz)
+		}
+	case "tar":
+		err = e.extractTar(r)
+	case "zip":
+		err = e.extractZip(r)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := e.createLinks(); err != nil {
+		return nil, err
+	}
+	return &ExtractedArchive{Files: e.files, dirs: e.dirs}, nil
+}
+
+// 设置包中目录的权限和修改时间，先设置子目录，避免上级目录没有执行权限时无法访问子目录
+func (a *ExtractedArchive) ApplyDirModes() error {
+	list := make([]string, 0, len(a.dirs))
+	for p := range a.dirs {
+		list = append(list, p)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(list)))
+	for _, p := range list {
+		info := a.dirs[p]
+		if err := os.Chmod(p, info.Mode().Perm()); err != nil {
+			return err
+		}
+		os.Chtimes(p, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// 打包的文件名对应的本地路径
+func (e *archiveExtractor) path(name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(strings.TrimSuffix(name, "/")))
+	if filepath.IsAbs(clean) || clean == "." || clean == ".." || strings.HasPrefix(clean, ".."+string(os.PathSeparator)) || len(filepath.VolumeName(clean)) > 0 {
+		return "", fmt.Errorf("invalid path [%s] in archive", name)
+	}
+	return filepath.Join(e.dir, clean), nil
+}
+
+func (e *archiveExtractor) extractTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		p, err := e.path(h.Name)
+		if err != nil {
+			return err
+		}
+		info := h.FileInfo()
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = e.mkdir(p, info)
+		case tar.TypeSymlink:
+			err = e.addLink(p, h.Name, h.Linkname)
+		case tar.TypeLink:
+			err = e.hardLink(p, h.Linkname)
+		case tar.TypeReg, tar.TypeRegA:
+			err = e.writeFile(p, info, tr)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// zip需要随机读取，先保存到dir所在目录的临时文件
+func (e *archiveExtractor) extractZip(r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(e.dir), ".tora-archive-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(tmp, size)
+	if err != nil {
+		return err
+	}
+	for _, f := range zr.File {
+		p, err := e.path(f.Name)
+		if err != nil {
+			return err
+		}
+		info := f.FileInfo()
+		if info.IsDir() {
+			if err := e.mkdir(p, info); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			b, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return err
+			}
+			if err := e.addLink(p, f.Name, string(b)); err != nil {
+				return err
+			}
+			continue
+		}
+		if info.Mode().IsRegular() {
+			err = e.writeFile(p, info, rc)
+		}
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *archiveExtractor) mkdir(p string, info os.FileInfo) error {
+	// 目录的权限在全部文件写入后再设置，避免只读目录无法写入
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return err
+	}
+	e.dirs[p] = info
+	return nil
+}
+
+func (e *archiveExtractor) addLink(p string, name string, link string) error {
+	if e.confine && filepath.IsAbs(link) {
+		return fmt.Errorf("symlink [%s] points outside of archive", name)
+	}
+	e.links[p] = link
+	return nil
+}
+
+// 硬链接只能指向包中已解压的文件
+func (e *archiveExtractor) hardLink(p string, link string) error {
+	target, err := e.path(link)
+	if err != nil {
+		return err
+	}
+	if s, err := os.Lstat(target); err != nil || !s.Mode().IsRegular() {
+		return fmt.Errorf("invalid hard link [%s] in archive", link)
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	os.Remove(p)
+	if err := os.Link(target, p); err != nil {
+		return err
+	}
+	e.files++
+	return nil
+}
+
+func (e *archiveExtractor) writeFile(p string, info os.FileInfo, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// 先删除已存在的文件，避免写入到符号链接指向的文件
+	os.Remove(p)
+	fd, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, r); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(p, info.Mode().Perm()); err != nil {
+		return err
+	}
+	e.files++
+	return os.Chtimes(p, info.ModTime(), info.ModTime())
+}
+
+// 创建符号链接，confine为true时检查链接解析后的路径是否在dir之内
+func (e *archiveExtractor) createLinks() error {
+	root, err := filepath.EvalSymlinks(e.dir)
+	if err != nil {
+		return err
+	}
+	inside := func(p string) bool {
+		return p == root || strings.HasPrefix(p, root+string(os.PathSeparator))
+	}
+	// 按路径顺序创建，上级的符号链接先于下级的创建，使下级的检查能够发现经过上级链接的路径
+	list := make([]string, 0, len(e.links))
+	for p := range e.links {
+		list = append(list, p)
+	}
+	sort.Strings(list)
+	for _, p := range list {
+		link := e.links[p]
+		rel, _ := filepath.Rel(e.dir, p)
+		name := filepath.ToSlash(rel)
+		// 在删除或创建之前检查所在的目录，避免经过包中的其他符号链接修改dir之外的文件
+		parent, err := filepath.EvalSymlinks(filepath.Dir(p))
+		if err != nil || !inside(parent) {
+			return fmt.Errorf("invalid path [%s] in archive", name)
+		}
+		if e.confine && !inside(filepath.Join(parent, filepath.FromSlash(link))) {
+			return fmt.Errorf("symlink [%s] points outside of archive", name)
+		}
+		p = filepath.Join(parent, filepath.Base(p))
+		os.Remove(p)
+		if err := os.Symlink(link, p); err != nil {
+			return err
+		}
+	}
+	if !e.confine {
+		return nil
+	}
+	// 链接的目标可能经过其他链接，全部创建后再检查解析后的位置
+	for _, p := range list {
+		real, err := filepath.EvalSymlinks(p)
+		if err != nil || !inside(real) {
+			rel, _ := filepath.Rel(e.dir, p)
+			return fmt.Errorf("symlink [%s] points outside of archive", filepath.ToSlash(rel))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/cespare/xxhash/v2"
+	"hash"
+	"io"
+	"lukechampine.com/blake3"
+	"os"
+	"strings"
+)
+
+// 支持的摘要算法，对应的请求头和响应头为 x-content-<算法>
+var ChecksumAlgorithms = []string{"md5", "sha256", "blake3", "xxhash"}
+
+// 创建摘要算法的hash，xxhash为XXH64
+func NewChecksumHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "blake3":
+		return blake3.New(32, nil), nil
+	case "xxhash":
+		return xxhash.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum [%s]", algorithm)
+}
+
+// 解析逗号分隔的摘要算法列表，如：sha256,md5
+func ParseChecksumAlgorithms(s string) ([]string, error) {
+	list := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.ToLower(strings.TrimSpace(v))
+		if len(v) < 1 {
+			continue
+		}
+		if _, err := NewChecksumHash(v); err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+	}
+	return list, nil
+}
+
+// 同时计算多个摘要的Writer
+type ChecksumWriter struct {
+	hashes map[string]hash.Hash
+	writer io.Writer
+}
+
+func NewChecksumWriter(algorithms []string) (*ChecksumWriter, error) {
+	w := &ChecksumWriter{hashes: make(map[string]hash.Hash)}
+	writers := make([]io.Writer, 0)
+	for _, a := range algorithms {
+		if _, ok := w.hashes[a]; ok {
+			continue
+		}
+		h, err := NewChecksumHash(a)
+		if err != nil {
+			return nil, err
+		}
+		w.hashes[a] = h
+		writers = append(writers, h)
+	}
+	w.writer = io.MultiWriter(writers...)
+	return w, nil
+}
+
+func (w *ChecksumWriter) Write(p []byte) (int, error) {
+	return w.writer.Write(p)
+}
+
+// 返回各个算法的摘要，十六进制小写
+func (w *ChecksumWriter) Sums() map[string]string {
+	sums := make(map[string]string)
+	for a, h := range w.hashes {
+		sums[a] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums
+}
+
+// 读取一次文件计算多个摘要
+func FileChecksums(file string, algorithms []string) (map[string]string, error) {
+	w, err := NewChecksumWriter(algorithms)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(w, f); err != nil {
+		return nil, err
+	}
+	return w.Sums(), nil
+}
+
+func FileChecksum(file string, algorithm string) (string, error) {
+	sums, err := FileChecksums(file, []string{algorithm})
+	if err != nil {
+		return "", err
+	}
+	return sums[algorithm], nil
+}
@@ -0,0 +1,13 @@
+package common
+
+// 隐藏token的大部分内容，仅用于日志和显示，首尾保留的字符总数不超过token长度的一半
+func MaskToken(token string) string {
+	if len(token) < 1 {
+		return ""
+	}
+	n := len(token) / 4
+	if n > 2 {
+		n = 2
+	}
+	return token[0:n] + "****" + token[len(token)-n:]
+}
@@ -0,0 +1,53 @@
+package file
+
+import (
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// 打包格式对应的content-type
+var archiveContentTypes = map[string]string{
+	"tar.gz": "application/gzip",
+	"tar":    "application/x-tar",
+	"zip":    "application/zip",
+}
+
+// 分段上传的临时文件 .<文件名>.<会话ID>.upload 和解压目录时的临时目录 .<目录名>.<时间>-<随机数>.extract、.old
+var tempFilePattern = regexp.MustCompile(`^\..+\.([0-9a-f]{32}\.upload|[0-9]+-[0-9]+\.(extract|old))$`)
+
+// 打包时跳过上传会话的状态目录，以及上传和解压过程中的临时文件，这些文件内容不完整
+func (m *ModuleFile) skipArchive(p string) bool {
+	return m.isUploadDir(p) || tempFilePattern.MatchString(filepath.Base(p))
+}
+
+// 将目录打包后输出，文件名为相对于目录的路径，保留权限和修改时间，
+// 符号链接按链接本身打包，不读取链接指向的文件，因此不会访问根目录之外的文件
+func (m *ModuleFile) responseDirArchive(ctx *web.Context, f string, s os.FileInfo, format string) {
+	if !m.AllowListDir {
+		common.ResponseApiError(ctx, "not allowed [archive] dir", nil)
+		return
+	}
+	format, err := common.ParseArchiveFormat(format)
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, err.Error(), nil)
+		return
+	}
+	name := s.Name()
+	if f == m.Root {
+		name = "root"
+	}
+	ctx.Res.Header().Set("x-file-type", "archive")
+	ctx.Res.Header().Set("content-type", archiveContentTypes[format])
+	ctx.Res.Header().Set("content-disposition", fmt.Sprintf(`attachment; filename="%s.%s"`, name, format))
+	ctx.Res.WriteHeader(200)
+
+	if err := common.WriteArchive(ctx.Res, format, f, m.skipArchive); err != nil {
+		// 响应头已经发送，不结束打包的文件，使客户端能够发现内容不完整
+		ctx.Log.Errorf("archive [%s] failed: %s", strings.TrimPrefix(f, m.Root), err)
+	}
+}
@@ -0,0 +1,99 @@
+package file
+
+import (
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// 摘要缓存的最大数量，超过后清空
+const maxChecksumCacheSize = 10000
+
+// 文件摘要的缓存，文件大小或修改时间改变后重新计算
+type checksumCache struct {
+	mu    sync.Mutex
+	items map[string]string
+}
+
+func checksumCacheKey(f string, s os.FileInfo, algorithm string) string {
+	return fmt.Sprintf("%s\x00%d\x00%d\x00%s", f, s.Size(), s.ModTime().UnixNano(), algorithm)
+}
+
+// 获取文件的摘要，优先使用缓存
+func (m *ModuleFile) fileChecksums(f string, s os.FileInfo, algorithms []string) (map[string]string, error) {
+	sums := make(map[string]string)
+	missing := make([]string, 0)
+	m.checksums.mu.Lock()
+	for _, a := range algorithms {
+		if v, ok := m.checksums.items[checksumCacheKey(f, s, a)]; ok {
+			sums[a] = v
+		} else {
+			missing = append(missing, a)
+		}
+	}
+	m.checksums.mu.Unlock()
+	if len(missing) < 1 {
+		return sums, nil
+	}
+	computed, err := common.FileChecksums(f, missing)
+	if err != nil {
+		return nil, err
+	}
+	m.checksums.mu.Lock()
+	defer m.checksums.mu.Unlock()
+	if len(m.checksums.items)+len(computed) > maxChecksumCacheSize {
+		m.checksums.items = make(map[string]string)
+	}
+	for a, v := range computed {
+		m.checksums.items[checksumCacheKey(f, s, a)] = v
+		sums[a] = v
+	}
+	return sums, nil
+}
+
+// 请求头 x-checksum 指定的需要返回的摘要算法，如：sha256,blake3
+func requestChecksumAlgorithms(ctx *web.Context) ([]string, error) {
+	return common.ParseChecksumAlgorithms(ctx.Req.Header.Get("x-checksum"))
+}
+
+// 请求头 x-content-<算法> 指定的期望的摘要
+func expectedChecksums(ctx *web.Context) map[string]string {
+	expected := make(map[string]string)
+	for _, a := range common.ChecksumAlgorithms {
+		if v := ctx.Req.Header.Get("x-content-" + a); len(v) > 0 {
+			expected[a] = v
+		}
+	}
+	return expected
+}
+
+func checksumAlgorithms(expected map[string]string) []string {
+	list := make([]string, 0, len(expected))
+	for a := range expected {
+		list = append(list, a)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// 检查摘要是否与期望的一致，不一致时返回错误信息
+func verifyChecksums(ctx *web.Context, expected map[string]string, actual map[string]string) bool {
+	for _, a := range checksumAlgorithms(expected) {
+		if strings.ToLower(expected[a]) != actual[a] {
+			common.ResponseApiError(ctx, fmt.Sprintf("%s check failed: expected %s but got %s", a, expected[a], actual[a]), common.JSON{"expected": expected[a], "actual": actual[a]})
+			return false
+		}
+	}
+	return true
+}
+
+// 将摘要设置到响应头 x-content-<算法>
+func setChecksumHeaders(ctx *web.Context, sums map[string]string) {
+	for a, v := range sums {
+		ctx.Res.Header().Set("x-content-"+a, v)
+	}
+}
@@ -0,0 +1,157 @@
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 根据内容开头的字节判断打包格式
+func detectArchiveFormat(r *bufio.Reader) string {
+	head, _ := r.Peek(4)
+	switch {
+	case bytes.HasPrefix(head, []byte{0x1f, 0x8b}):
+		return "tar.gz"
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")), bytes.HasPrefix(head, []byte("PK\x05\x06")):
+		return "zip"
+	}
+	return "tar"
+}
+
+// 上传打包的目录并解压，通过 extract 参数指定格式，为 1 时根据内容自动判断：
+// 先解压到目标目录所在目录的临时目录，成功后替换目标目录
+func (m *ModuleFile) handleExtract(ctx *web.Context, f string, format string) {
+	if f == m.Root || strings.HasPrefix(m.UploadDir, f+string(os.PathSeparator)) {
+		common.ResponseApiError(ctx, fmt.Sprintf("cannot extract to %s", ctx.Req.URL.Path), nil)
+		return
+	}
+	s, err := os.Lstat(f)
+	if err == nil {
+		if !s.IsDir() {
+			common.ResponseApiError(ctx, fmt.Sprintf("%s is not a dir", ctx.Req.URL.Path), nil)
+			return
+		}
+		// 替换已存在的目录会删除其中的文件
+		if !m.AllowDelete {
+			common.ResponseApiError(ctx, "not allowed [DELETE] file", nil)
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+
+	expected := expectedChecksums(ctx)
+	checked := checksumAlgorithms(expected)
+	sum, err := common.NewChecksumWriter(checked)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	body := bufio.NewReader(io.TeeReader(ctx.Req.Body, sum))
+	if format == "1" {
+		format = detectArchiveFormat(body)
+	}
+	format, err = common.ParseArchiveFormat(format)
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, err.Error(), nil)
+		return
+	}
+
+	dir := filepath.Dir(f)
+	if err := os.MkdirAll(dir, m.DirPerm); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	tmpDir := filepath.Join(dir, fmt.Sprintf(".%s.%d-%d.extract", filepath.Base(f), time.Now().Unix(), rand.Uint32()))
+	defer removeDir(tmpDir)
+	extracted, err := common.ExtractArchiveFiles(body, format, tmpDir, true)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	// 读取剩余的内容，使摘要包含完整的请求内容
+	if _, err := io.Copy(ioutil.Discard, body); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	sums := sum.Sums()
+	if !verifyChecksums(ctx, expected, sums) {
+		return
+	}
+	// 校验通过后再设置包中目录的权限，其中可能有不可写的目录
+	if err := extracted.ApplyDirModes(); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if err := os.Chmod(tmpDir, m.DirPerm); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+
+	if err := m.swapDir(tmpDir, f); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	_, checkedMd5 := expected["md5"]
+	common.ResponseApiOk(ctx, common.JSON{"format": format, "files": extracted.Files, "checkedMd5": checkedMd5, "checked": checked, "checksums": sums})
+}
+
+// 用新目录替换目标目录，替换后删除旧目录。
+// 目标目录已存在时通过 exchangeDir 原子地交换两个目录，客户端不会看到目标目录不存在或者不完整的状态；
+// 系统不支持时（非Linux系统，或者内核、文件系统不支持 RENAME_EXCHANGE）退回为先将旧目录重命名，
+// 再将新目录重命名为目标目录，此时目标目录会短暂地不存在，替换失败时恢复旧目录
+func (m *ModuleFile) swapDir(newDir string, f string) error {
+	if _, err := os.Lstat(f); os.IsNotExist(err) {
+		return os.Rename(newDir, f)
+	}
+	err := exchangeDir(newDir, f)
+	if err == nil {
+		// 交换后newDir为旧目录
+		if err := removeDir(newDir); err != nil {
+			m.Log.Warnf("remove old dir [%s] failed: %s", newDir, err)
+		}
+		return nil
+	}
+	if err != errExchangeNotSupported {
+		return err
+	}
+	oldDir := filepath.Join(filepath.Dir(f), fmt.Sprintf(".%s.%d-%d.old", filepath.Base(f), time.Now().Unix(), rand.Uint32()))
+	if err := os.Rename(f, oldDir); err != nil {
+		return err
+	}
+	if err := os.Rename(newDir, f); err != nil {
+		os.Rename(oldDir, f)
+		return err
+	}
+	if err := removeDir(oldDir); err != nil {
+		m.Log.Warnf("remove old dir [%s] failed: %s", oldDir, err)
+	}
+	return nil
+}
+
+// 删除目录，先将其中的目录设置为可写，使包含不可写目录的内容也可以被删除
+func removeDir(dir string) error {
+	makeDirWritable(dir)
+	return os.RemoveAll(dir)
+}
+
+// 不跟随符号链接，因此不会修改目录之外的文件
+func makeDirWritable(dir string) {
+	os.Chmod(dir, 0700)
+	list, _ := ioutil.ReadDir(dir)
+	for _, v := range list {
+		if v.IsDir() {
+			makeDirWritable(filepath.Join(dir, v.Name()))
+		}
+	}
+}
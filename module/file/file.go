@@ -8,9 +8,10 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/http"
 	"os"
 	"path/filepath"
-	"strings"
+	"strconv"
 	"time"
 )
 
@@ -28,6 +29,10 @@ type ModuleFile struct {
 	AllowListDir bool           // 允许列出目录
 	DirPerm      os.FileMode    // 创建的目录权限
 	FilePerm     os.FileMode    // 创建的文件权限
+	UploadDir    string         // 分段上传的会话状态保存目录，默认为根目录下的 .tora-uploads
+	UploadExpire time.Duration  // 分段上传的会话超过此时间没有写入时删除，默认为24小时
+	uploads      *uploadLocks
+	checksums    *checksumCache
 }
 
 func (m *ModuleFile) Handle(ctx *web.Context) {
@@ -36,6 +41,14 @@ func (m *ModuleFile) Handle(ctx *web.Context) {
 		common.ResponseApiError(ctx, err.Error(), nil)
 		return
 	}
+	if m.isUploadDir(f) {
+		common.ResponseApiError(ctx, fmt.Sprintf("cannot access to %s", ctx.Req.URL.Path), nil)
+		return
+	}
+	if _, ok := ctx.Req.URL.Query()["upload"]; ok {
+		m.handleUpload(ctx, f)
+		return
+	}
 	switch ctx.Req.Method {
 	case "HEAD":
 		m.handleHead(ctx, f)
@@ -58,13 +71,29 @@ func (m *ModuleFile) handleHead(ctx *web.Context, f string) {
 		ctx.Res.WriteHeader(500)
 		return
 	}
-	ctx.Res.Header().Set("x-ok", "true")
+	algorithms, err := requestChecksumAlgorithms(ctx)
+	if err != nil {
+		ctx.Res.Header().Set("x-ok", "false")
+		ctx.Res.Header().Set("x-error", err.Error())
+		ctx.Res.WriteHeader(400)
+		return
+	}
 	if s.IsDir() {
+		ctx.Res.Header().Set("x-ok", "true")
 		ctx.Res.Header().Set("x-file-type", "dir")
 	} else {
-		ctx.Res.Header().Set("x-file-type", "file")
-		ctx.Res.Header().Set("x-file-size", string(s.Size()))
-		ctx.Res.Header().Set("x-last-modified", s.ModTime().UTC().String())
+		sums, err := m.fileChecksums(f, s, algorithms)
+		if err != nil {
+			ctx.Res.Header().Set("x-ok", "false")
+			ctx.Res.Header().Set("x-error", err.Error())
+			ctx.Res.WriteHeader(500)
+			return
+		}
+		ctx.Res.Header().Set("x-ok", "true")
+		setChecksumHeaders(ctx, sums)
+		setFileHeaders(ctx, s)
+		ctx.Res.Header().Set("content-length", strconv.FormatInt(s.Size(), 10))
+		ctx.Res.Header().Set("last-modified", s.ModTime().UTC().Format(http.TimeFormat))
 	}
 }
 
@@ -75,6 +104,10 @@ func (m *ModuleFile) handleGet(ctx *web.Context, f string) {
 		return
 	}
 	if s.IsDir() {
+		if format := ctx.Req.URL.Query().Get("archive"); len(format) > 0 {
+			m.responseDirArchive(ctx, f, s, format)
+			return
+		}
 		if m.AllowListDir {
 			m.responseDirList(ctx, f, s)
 		} else {
@@ -90,8 +123,12 @@ func (m *ModuleFile) handlePut(ctx *web.Context, f string) {
 		common.ResponseApiError(ctx, "not allowed [PUT] file", nil)
 		return
 	}
+	if format := ctx.Req.URL.Query().Get("extract"); len(format) > 0 {
+		m.handleExtract(ctx, f, format)
+		return
+	}
 
-	md5 := ctx.Req.Header.Get("x-content-md5")
+	expected := expectedChecksums(ctx)
 	dir := filepath.Dir(f)
 	tmpFile := filepath.Join(dir, fmt.Sprintf(".%s.%d-%d", filepath.Base(f), time.Now().Unix(), rand.Uint32()))
 
@@ -108,26 +145,25 @@ func (m *ModuleFile) handlePut(ctx *web.Context, f string) {
 		return
 	}
 	defer tmpFd.Close()
-	_, err = io.Copy(tmpFd, ctx.Req.Body)
+	// 写入时同时计算请求头中指定的摘要
+	checked := checksumAlgorithms(expected)
+	sum, err := common.NewChecksumWriter(checked)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	_, err = io.Copy(io.MultiWriter(tmpFd, sum), ctx.Req.Body)
 	if err != nil {
 		common.ResponseApiError(ctx, err.Error(), nil)
 		return
 	}
 
-	// 校验md5值
-	checkedMd5 := false
-	if len(md5) > 0 {
-		tmpMd5, err := getFileMd5(tmpFile)
-		if err != nil {
-			common.ResponseApiError(ctx, err.Error(), nil)
-			return
-		}
-		if strings.ToLower(tmpMd5) != strings.ToLower(md5) {
-			common.ResponseApiError(ctx, fmt.Sprintf("md5 check failed: expected %s but got %s", md5, tmpMd5), common.JSON{"expected": md5, "actual": tmpMd5})
-			return
-		}
-		checkedMd5 = true
+	// 校验摘要
+	sums := sum.Sums()
+	if !verifyChecksums(ctx, expected, sums) {
+		return
 	}
+	_, checkedMd5 := expected["md5"]
 
 	// 删除旧文件，覆盖新文件
 	err = os.Remove(f)
@@ -148,7 +184,7 @@ func (m *ModuleFile) handlePut(ctx *web.Context, f string) {
 		return
 	}
 
-	common.ResponseApiOk(ctx, common.JSON{"checkedMd5": checkedMd5})
+	common.ResponseApiOk(ctx, common.JSON{"checkedMd5": checkedMd5, "checked": checked, "checksums": sums})
 }
 
 func (m *ModuleFile) handleDelete(ctx *web.Context, f string) {
@@ -175,6 +211,11 @@ func (m *ModuleFile) responseDirList(ctx *web.Context, f string, s os.FileInfo)
 		common.ResponseApiError(ctx, err.Error(), nil)
 		return
 	}
+	algorithms, err := requestChecksumAlgorithms(ctx)
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, err.Error(), nil)
+		return
+	}
 	list2 := make([]common.JSON, len(list))
 	for i, v := range list {
 		list2[i] = common.JSON{
@@ -183,6 +224,15 @@ func (m *ModuleFile) responseDirList(ctx *web.Context, f string, s os.FileInfo)
 			"size":         v.Size(),
 			"modifiedTime": v.ModTime().String(),
 		}
+		// 指定了 x-checksum 时返回每个文件的摘要
+		if len(algorithms) > 0 && v.Mode().IsRegular() {
+			sums, err := m.fileChecksums(filepath.Join(f, v.Name()), v, algorithms)
+			if err != nil {
+				common.ResponseApiError(ctx, err.Error(), nil)
+				return
+			}
+			list2[i]["checksums"] = sums
+		}
 	}
 	ctx.Res.Header().Set("x-file-type", "dir")
 	common.ResponseApiOk(ctx, common.JSON{
@@ -208,14 +258,30 @@ func (m *ModuleFile) responseFileContent(ctx *web.Context, f string, s os.FileIn
 		return
 	}
 	defer r.Close()
-	ctx.Res.Header().Set("x-file-type", "file")
-	ctx.Res.Header().Set("content-type", "application/octet-stream")
-	ctx.Res.Header().Set("x-file-size", string(s.Size()))
-	ctx.Res.Header().Set("x-last-modified", s.ModTime().UTC().String())
-	_, err = io.Copy(ctx.Res, r)
+	algorithms, err := requestChecksumAlgorithms(ctx)
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, err.Error(), nil)
+		return
+	}
+	sums, err := m.fileChecksums(f, s, algorithms)
 	if err != nil {
 		common.ResponseApiError(ctx, err.Error(), nil)
+		return
 	}
+	setChecksumHeaders(ctx, sums)
+	setFileHeaders(ctx, s)
+	ctx.Res.Header().Set("content-type", "application/octet-stream")
+	// 由ServeContent处理Range、If-Range、If-Modified-Since等请求头，支持断点续传和分段下载
+	http.ServeContent(ctx.Res, ctx.Req, s.Name(), s.ModTime(), r)
+}
+
+// 文件的响应头，ETag由文件大小和修改时间组成，文件改变后分段下载时通过If-Range返回完整的文件
+func setFileHeaders(ctx *web.Context, s os.FileInfo) {
+	ctx.Res.Header().Set("x-file-type", "file")
+	ctx.Res.Header().Set("x-file-size", strconv.FormatInt(s.Size(), 10))
+	ctx.Res.Header().Set("x-last-modified", s.ModTime().UTC().String())
+	ctx.Res.Header().Set("accept-ranges", "bytes")
+	ctx.Res.Header().Set("etag", fileETag(s))
 }
 
 func (m *ModuleFile) responseDeleteDir(ctx *web.Context, f string, s os.FileInfo) {
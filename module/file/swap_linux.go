@@ -0,0 +1,18 @@
+package file
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+)
+
+var errExchangeNotSupported = errors.New("exchange dir not supported")
+
+// 通过 renameat2(RENAME_EXCHANGE) 原子地交换两个目录，
+// 内核低于3.15或者文件系统不支持时返回 errExchangeNotSupported
+func exchangeDir(a string, b string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, a, unix.AT_FDCWD, b, unix.RENAME_EXCHANGE)
+	if err == unix.ENOSYS || err == unix.EINVAL {
+		return errExchangeNotSupported
+	}
+	return err
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package file
+
+import "errors"
+
+var errExchangeNotSupported = errors.New("exchange dir not supported")
+
+// 非Linux系统不支持原子地交换两个目录
+func exchangeDir(a string, b string) error {
+	return errExchangeNotSupported
+}
@@ -0,0 +1,432 @@
+package file
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 上传会话默认的过期时间，超过此时间没有写入的会话会被删除
+const DefaultUploadExpire = 24 * time.Hour
+
+// 上传会话的状态保存目录默认的名称，位于根目录下
+const DefaultUploadDirName = ".tora-uploads"
+
+// 分段上传的会话，状态保存在UploadDir中，已接收的内容保存在目标文件所在目录的临时文件中，
+// 提交时重命名为目标文件
+type uploadSession struct {
+	Id          string     `json:"id"`
+	File        string     `json:"file"`        // 目标文件
+	DataFile    string     `json:"dataFile"`    // 保存已接收内容的临时文件
+	Size        int64      `json:"size"`        // 文件大小
+	Received    [][2]int64 `json:"received"`    // 已接收的范围，按开始位置排列，不重叠
+	CreatedTime time.Time  `json:"createdTime"` // 创建时间
+	UpdatedTime time.Time  `json:"updatedTime"` // 最后写入时间
+}
+
+// 上传会话的锁，同一个会话的状态文件同时只能由一个请求更新，
+// 没有请求使用时删除，避免为不存在的会话保留锁
+type uploadLocks struct {
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+type uploadLock struct {
+	sync.Mutex
+	refs    int // 正在使用此锁的请求数量，由uploadLocks.mu保护
+	writers int // 正在写入内容的请求数量，由锁自身保护
+}
+
+func (l *uploadLocks) acquire(id string) *uploadLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock := l.locks[id]
+	if lock == nil {
+		lock = &uploadLock{}
+		l.locks[id] = lock
+	}
+	lock.refs++
+	return lock
+}
+
+func (l *uploadLocks) release(id string, lock *uploadLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lock.refs--
+	if lock.refs < 1 {
+		delete(l.locks, id)
+	}
+}
+
+func (m *ModuleFile) Init() error {
+	if len(m.UploadDir) < 1 {
+		m.UploadDir = filepath.Join(m.Root, DefaultUploadDirName)
+	}
+	dir, err := filepath.Abs(m.UploadDir)
+	if err != nil {
+		return err
+	}
+	m.UploadDir = dir
+	if !(m.UploadExpire > 0) {
+		m.UploadExpire = DefaultUploadExpire
+	}
+	m.uploads = &uploadLocks{locks: make(map[string]*uploadLock)}
+	m.checksums = &checksumCache{items: make(map[string]string)}
+	m.cleanUploads()
+	return nil
+}
+
+// 是否为上传会话的状态目录中的文件，不允许直接访问
+func (m *ModuleFile) isUploadDir(f string) bool {
+	return f == m.UploadDir || strings.HasPrefix(f, m.UploadDir+string(os.PathSeparator))
+}
+
+// 分段上传，通过 upload 参数指定会话：
+// POST ?upload 创建会话，PUT ?upload=<id>&offset=<n> 写入一段内容，GET ?upload=<id> 查询已接收的范围，
+// POST ?upload=<id> 提交，DELETE ?upload=<id> 取消
+func (m *ModuleFile) handleUpload(ctx *web.Context, f string) {
+	if !m.AllowPut {
+		common.ResponseApiError(ctx, "not allowed [PUT] file", nil)
+		return
+	}
+	id := ctx.Req.URL.Query().Get("upload")
+	if len(id) < 1 {
+		if ctx.Req.Method != "POST" {
+			common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+			return
+		}
+		m.handleUploadCreate(ctx, f)
+		return
+	}
+	if !isUploadId(id) {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("upload [%s] not found", id), nil)
+		return
+	}
+	lock := m.uploads.acquire(id)
+	defer m.uploads.release(id, lock)
+	if ctx.Req.Method == "PUT" {
+		m.handleUploadChunk(ctx, f, id, lock)
+		return
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	s, err := m.loadUpload(id)
+	if err != nil || s.File != f {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("upload [%s] not found", id), nil)
+		return
+	}
+	switch ctx.Req.Method {
+	case "GET":
+		m.responseUpload(ctx, s)
+	case "POST":
+		if lock.writers > 0 {
+			common.ResponseApiErrorWithStatusCode(ctx, 409, fmt.Sprintf("upload [%s] has chunks being written", id), uploadInfo(s))
+			return
+		}
+		m.handleUploadCommit(ctx, s)
+	case "DELETE":
+		m.removeUpload(s)
+		common.ResponseApiOk(ctx, common.JSON{"success": true})
+	default:
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+	}
+}
+
+func (m *ModuleFile) handleUploadCreate(ctx *web.Context, f string) {
+	size, err := strconv.ParseInt(ctx.Req.Header.Get("x-file-size"), 10, 64)
+	if err != nil || size < 0 {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, "missing or invalid [x-file-size] header", nil)
+		return
+	}
+	m.cleanUploads()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	id := hex.EncodeToString(b)
+	dir := filepath.Dir(f)
+	if err := os.MkdirAll(dir, m.DirPerm); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if err := os.MkdirAll(m.UploadDir, 0700); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	now := time.Now()
+	s := &uploadSession{
+		Id:          id,
+		File:        f,
+		DataFile:    filepath.Join(dir, fmt.Sprintf(".%s.%s.upload", filepath.Base(f), id)),
+		Size:        size,
+		Received:    make([][2]int64, 0),
+		CreatedTime: now,
+		UpdatedTime: now,
+	}
+	fd, err := os.Create(s.DataFile)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	fd.Close()
+	if err := m.saveUpload(s); err != nil {
+		os.Remove(s.DataFile)
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	ctx.Log.Infof("create upload [%s] size=%d", id, size)
+	m.responseUpload(ctx, s)
+}
+
+// 从offset开始写入请求体，连接中断时记录已经写入的部分，
+// 写入内容时不持有锁，同一个会话的不同部分可以同时上传
+func (m *ModuleFile) handleUploadChunk(ctx *web.Context, f string, id string, lock *uploadLock) {
+	lock.Lock()
+	s, err := m.loadUpload(id)
+	if err != nil || s.File != f {
+		lock.Unlock()
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("upload [%s] not found", id), nil)
+		return
+	}
+	offset, err := strconv.ParseInt(ctx.Req.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 || offset > s.Size {
+		lock.Unlock()
+		common.ResponseApiErrorWithStatusCode(ctx, 400, fmt.Sprintf("invalid offset [%s]", ctx.Req.URL.Query().Get("offset")), nil)
+		return
+	}
+	// 写入期间不允许提交，避免提交后继续写入已经重命名为目标文件的临时文件
+	lock.writers++
+	lock.Unlock()
+	fd, err := os.OpenFile(s.DataFile, os.O_WRONLY, 0)
+	if err != nil {
+		lock.Lock()
+		lock.writers--
+		lock.Unlock()
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	n, copyErr := copyAt(fd, io.LimitReader(ctx.Req.Body, s.Size-offset), offset)
+	if copyErr == nil {
+		if k, _ := io.ReadFull(ctx.Req.Body, make([]byte, 1)); k > 0 {
+			copyErr = fmt.Errorf("chunk exceeds file size %d", s.Size)
+		}
+	}
+	if copyErr == nil {
+		copyErr = fd.Sync()
+	}
+	fd.Close()
+
+	lock.Lock()
+	defer lock.Unlock()
+	lock.writers--
+	// 会话可能已经被其他请求提交或者取消
+	s, err = m.loadUpload(id)
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("upload [%s] not found", id), nil)
+		return
+	}
+	if n > 0 {
+		s.Received = addRange(s.Received, offset, offset+n)
+		s.UpdatedTime = time.Now()
+		if err := m.saveUpload(s); err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+	}
+	if copyErr != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, copyErr.Error(), uploadInfo(s))
+		return
+	}
+	m.responseUpload(ctx, s)
+}
+
+// 所有内容接收完成后校验摘要并重命名为目标文件
+func (m *ModuleFile) handleUploadCommit(ctx *web.Context, s *uploadSession) {
+	received := receivedSize(s.Received)
+	if received != s.Size {
+		common.ResponseApiErrorWithStatusCode(ctx, 400, fmt.Sprintf("upload incomplete: received %d of %d bytes", received, s.Size), uploadInfo(s))
+		return
+	}
+	expected := expectedChecksums(ctx)
+	checked := checksumAlgorithms(expected)
+	sums, err := common.FileChecksums(s.DataFile, checked)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if !verifyChecksums(ctx, expected, sums) {
+		return
+	}
+	_, checkedMd5 := expected["md5"]
+
+	// 删除旧文件，覆盖新文件
+	err = os.Remove(s.File)
+	if err != nil && !os.IsNotExist(err) {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if err := os.Rename(s.DataFile, s.File); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if err := os.Chmod(s.File, m.FilePerm); err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	m.removeUpload(s)
+	ctx.Log.Infof("commit upload [%s] file=%s size=%d", s.Id, s.File, s.Size)
+	common.ResponseApiOk(ctx, common.JSON{"checkedMd5": checkedMd5, "checked": checked, "checksums": sums, "size": s.Size})
+}
+
+func (m *ModuleFile) responseUpload(ctx *web.Context, s *uploadSession) {
+	common.ResponseApiOk(ctx, uploadInfo(s))
+}
+
+func uploadInfo(s *uploadSession) common.JSON {
+	return common.JSON{
+		"id":          s.Id,
+		"size":        s.Size,
+		"received":    s.Received,
+		"complete":    receivedSize(s.Received) == s.Size,
+		"updatedTime": s.UpdatedTime.String(),
+	}
+}
+
+func (m *ModuleFile) uploadStateFile(id string) string {
+	return filepath.Join(m.UploadDir, id+".json")
+}
+
+func (m *ModuleFile) loadUpload(id string) (*uploadSession, error) {
+	if !isUploadId(id) {
+		return nil, fmt.Errorf("invalid upload id [%s]", id)
+	}
+	b, err := ioutil.ReadFile(m.uploadStateFile(id))
+	if err != nil {
+		return nil, err
+	}
+	var s uploadSession
+	if err := json.Unmarshal(b, &s); err != nil {
+		return nil, err
+	}
+	if time.Since(s.UpdatedTime) > m.UploadExpire {
+		m.removeUpload(&s)
+		return nil, fmt.Errorf("upload [%s] expired", id)
+	}
+	return &s, nil
+}
+
+// 先写入临时文件再重命名，避免中断时状态文件不完整
+func (m *ModuleFile) saveUpload(s *uploadSession) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	file := m.uploadStateFile(s.Id)
+	if err := ioutil.WriteFile(file+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+func (m *ModuleFile) removeUpload(s *uploadSession) {
+	os.Remove(s.DataFile)
+	os.Remove(m.uploadStateFile(s.Id))
+}
+
+// 会话id为创建时生成的32位小写十六进制字符串
+func isUploadId(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// 删除过期的上传会话
+func (m *ModuleFile) cleanUploads() {
+	list, err := ioutil.ReadDir(m.UploadDir)
+	if err != nil {
+		return
+	}
+	for _, v := range list {
+		if !strings.HasSuffix(v.Name(), ".json") || time.Since(v.ModTime()) <= m.UploadExpire {
+			continue
+		}
+		id := strings.TrimSuffix(v.Name(), ".json")
+		lock := m.uploads.acquire(id)
+		lock.Lock()
+		_, err := m.loadUpload(id)
+		lock.Unlock()
+		m.uploads.release(id, lock)
+		if err == nil {
+			// 状态文件的修改时间不准确时以会话中的时间为准
+			continue
+		}
+		m.Log.Infof("remove expired upload [%s]", id)
+	}
+}
+
+// 从offset位置开始写入r的全部内容，返回写入的字节数
+func copyAt(w io.WriterAt, r io.Reader, offset int64) (int64, error) {
+	buf := make([]byte, 256*1024)
+	var written int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if _, err := w.WriteAt(buf[:n], offset+written); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// 添加一个范围并合并重叠或相邻的范围
+func addRange(list [][2]int64, start int64, end int64) [][2]int64 {
+	list = append(list, [2]int64{start, end})
+	sort.Slice(list, func(i, j int) bool {
+		return list[i][0] < list[j][0]
+	})
+	merged := make([][2]int64, 0, len(list))
+	for _, r := range list {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1] {
+			if r[1] > merged[n-1][1] {
+				merged[n-1][1] = r[1]
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+func receivedSize(list [][2]int64) int64 {
+	var n int64
+	for _, r := range list {
+		n += r[1] - r[0]
+	}
+	return n
+}
@@ -1,10 +1,7 @@
 package file
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,18 +21,6 @@ func resolveFilePath(root string, url string) (string, error) {
 	return p, fmt.Errorf("cannot access to %s", url)
 }
 
-func getFileMd5(filePath string) (string, error) {
-	var returnMD5String string
-	file, err := os.Open(filePath)
-	if err != nil {
-		return returnMD5String, err
-	}
-	defer file.Close()
-	hash := md5.New()
-	if _, err := io.Copy(hash, file); err != nil {
-		return returnMD5String, err
-	}
-	hashInBytes := hash.Sum(nil)[:16]
-	returnMD5String = hex.EncodeToString(hashInBytes)
-	return returnMD5String, nil
+func fileETag(s os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, s.Size(), s.ModTime().UnixNano())
 }
@@ -0,0 +1,213 @@
+package log
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// 计算文件指纹时使用的文件开头的字节数
+const fingerprintSize = 1024
+
+// 游标，表示日志中一行结束的位置，由文件的inode、文件开头内容的指纹和位置组成，
+// 文件被重命名、压缩或者复制后仍然可以通过指纹找到对应的文件
+type cursor struct {
+	Ino    uint64 `json:"i,omitempty"` // 文件的inode
+	Size   int    `json:"n"`           // 计算指纹的字节数
+	Hash   uint64 `json:"h"`           // 指纹
+	Offset int64  `json:"o"`           // 位置，压缩的文件为解压后的位置
+}
+
+func (c cursor) String() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func parseCursor(s string) (cursor, error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Size < 0 || c.Size > fingerprintSize || c.Offset < int64(c.Size) {
+		return c, fmt.Errorf("invalid cursor [%s]", s)
+	}
+	return c, nil
+}
+
+// 文件的标识，用于生成和查找游标
+type identity struct {
+	ino    uint64
+	prefix []byte // 文件开头最多fingerprintSize字节的内容，压缩的文件为解压后的内容
+}
+
+func newIdentity(r io.Reader, info os.FileInfo) (*identity, error) {
+	buf := make([]byte, fingerprintSize)
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return &identity{ino: fileInode(info), prefix: buf[:n]}, nil
+}
+
+func fingerprint(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return h.Sum64()
+}
+
+// 生成end位置的游标，指纹使用end之前的内容，因此文件继续写入后不变
+func (id *identity) cursor(end int64) string {
+	n := int64(len(id.prefix))
+	if end < n {
+		n = end
+	}
+	return cursor{Ino: id.ino, Size: int(n), Hash: fingerprint(id.prefix[:n]), Offset: end}.String()
+}
+
+// 文件开头的内容是否与游标的指纹相同
+func (id *identity) match(c cursor) bool {
+	return len(id.prefix) >= c.Size && fingerprint(id.prefix[:c.Size]) == c.Hash
+}
+
+// 文件继续写入后重新读取开头的内容
+func (id *identity) grow(f io.ReaderAt, end int64) {
+	if len(id.prefix) >= fingerprintSize || int64(len(id.prefix)) >= end {
+		return
+	}
+	buf := make([]byte, fingerprintSize)
+	n, _ := f.ReadAt(buf, 0)
+	id.prefix = buf[:n]
+}
+
+func (g segment) identity() (*identity, error) {
+	r, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return newIdentity(r, g.info)
+}
+
+// 查找游标所在的文件，优先使用inode和指纹都相同的文件，其次使用指纹相同的较早的文件，找不到时返回-1
+func findCursor(segs []segment, c cursor) int {
+	ids := make([]*identity, len(segs))
+	for i, g := range segs {
+		// 读取失败的文件可能已经被删除，忽略
+		ids[i], _ = g.identity()
+	}
+	if c.Ino != 0 {
+		for i := len(segs) - 1; i >= 0; i-- {
+			if ids[i] != nil && ids[i].ino == c.Ino && ids[i].match(c) {
+				return i
+			}
+		}
+	}
+	if c.Size > 0 {
+		for i, id := range ids {
+			if id != nil && id.match(c) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// 游标在日志源中的位置
+type position struct {
+	index  int   // 所在文件在segs中的序号
+	offset int64 // 在文件中的位置
+	reset  bool  // 游标所在的文件已经不存在，从最早的文件开始读取
+}
+
+func locateCursor(segs []segment, c cursor) position {
+	i := findCursor(segs, c)
+	if i < 0 {
+		return position{reset: true}
+	}
+	return position{index: i, offset: c.Offset}
+}
+
+// 从pos开始向后逐行读取，依次读取之后的文件，fn返回错误时停止，
+// current为false时不读取当前文件（segs的最后一个），否则读取到当前文件最后一个完整的行
+func readLinesAfter(segs []segment, pos position, current bool, fn func(Line) error) error {
+	last := len(segs) - 1
+	for i := pos.index; i <= last; i++ {
+		if i == last && !current {
+			break
+		}
+		start := int64(0)
+		if i == pos.index {
+			start = pos.offset
+		}
+		if err := readSegmentFrom(segs[i], start, i == last, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 当前文件最后一个完整的行之后的游标
+func endCursor(g segment) (string, error) {
+	fd, err := os.Open(g.file)
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return "", err
+	}
+	end, err := lastLineEnd(fd, info.Size())
+	if err != nil {
+		return "", err
+	}
+	id, err := newIdentity(io.NewSectionReader(fd, 0, end), info)
+	if err != nil {
+		return "", err
+	}
+	return id.cursor(end), nil
+}
+
+// 从start位置开始读取文件，current为true时不读取未写完的最后一行
+func readSegmentFrom(g segment, start int64, current bool, emit func(Line) error) error {
+	id, err := g.identity()
+	if err != nil {
+		return err
+	}
+	w := &follower{file: g.file, offset: start, start: start, id: id}
+	if len(g.compress) > 0 {
+		r, err := g.open()
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := io.CopyN(ioutil.Discard, r, start); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		return scanForward(r, w, emit)
+	}
+	fd, err := os.Open(g.file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if current {
+		if size, err = lastLineEnd(fd, size); err != nil {
+			return err
+		}
+	}
+	if start >= size {
+		return nil
+	}
+	return scanForward(io.NewSectionReader(fd, start, size-start), w, emit)
+}
@@ -0,0 +1,317 @@
+package log
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JSON格式的日志中表示时间的字段，按顺序查找
+var timeFieldNames = []string{"time", "ts", "timestamp", "@timestamp"}
+
+// 文本格式的日志行首的时间，如：2020-10-18 09:47:57.123、2020/10/18 09:47:57、[2020-10-18T09:47:57+08:00]，
+// 以及 logrus 文本格式的 time="2020-10-18T09:47:57Z"
+var lineTimePattern = regexp.MustCompile(`^(?:\[|time=")?(\d{4}[-/]\d{2}[-/]\d{2}[T ]\d{2}:\d{2}:\d{2}(?:[.,]\d+)?(?:Z|[+-]\d{2}:?\d{2})?)`)
+
+// 过滤日志的条件
+type filter struct {
+	grep   *regexp.Regexp // 匹配的正则表达式
+	invert bool           // 是否输出不匹配grep的行
+	since  time.Time      // 开始时间
+	until  time.Time      // 结束时间
+	fields []fieldFilter  // JSON格式日志的字段，所有字段都需要匹配
+}
+
+// 字段需要等于其中一个值
+type fieldFilter struct {
+	path   []string
+	values []string
+}
+
+// 解析后的一行日志
+type entry struct {
+	fields  map[string]interface{}
+	time    time.Time
+	hasTime bool
+}
+
+// 从请求参数中解析过滤条件，没有指定任何条件时返回nil
+func parseFilter(query url.Values, now time.Time) (*filter, error) {
+	f := &filter{}
+	empty := true
+	if v := query.Get("grep"); len(v) > 0 {
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid grep [%s]: %s", v, err)
+		}
+		f.grep = re
+		f.invert = query.Get("invert") == "1"
+		empty = false
+	}
+	if v := query.Get("since"); len(v) > 0 {
+		t, err := parseTimeParam(v, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid since [%s]", v)
+		}
+		f.since = t
+		empty = false
+	}
+	if v := query.Get("until"); len(v) > 0 {
+		t, err := parseTimeParam(v, now)
+		if err != nil {
+			return nil, fmt.Errorf("invalid until [%s]", v)
+		}
+		f.until = t
+		empty = false
+	}
+	// 同一字段指定多次时匹配其中任意一个值
+	index := make(map[string]int)
+	for _, v := range query["field"] {
+		i := strings.Index(v, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("invalid field [%s]", v)
+		}
+		name := v[:i]
+		if j, ok := index[name]; ok {
+			f.fields[j].values = append(f.fields[j].values, v[i+1:])
+			continue
+		}
+		index[name] = len(f.fields)
+		f.fields = append(f.fields, fieldFilter{path: strings.Split(name, "."), values: []string{v[i+1:]}})
+		empty = false
+	}
+	if empty {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// 解析时间参数，可以是时间或者相对于当前的时长，如：10m 表示10分钟前
+func parseTimeParam(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", v, time.Local); err == nil {
+		return t, nil
+	}
+	return parseTime(v)
+}
+
+// 解析常见格式的时间，没有时区时使用本地时区
+func parseTime(v string) (time.Time, error) {
+	b := []byte(v)
+	for i, c := range b {
+		switch {
+		case c == '/' && i < 10:
+			b[i] = '-'
+		case c == ' ' && i == 10:
+			b[i] = 'T'
+		case c == ',':
+			b[i] = '.'
+		}
+	}
+	v = string(b)
+	if t, err := time.Parse("2006-01-02T15:04:05Z07:00", v); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02T15:04:05Z0700", v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02T15:04:05", v, time.Local)
+}
+
+func (f *filter) hasTime() bool {
+	return !f.since.IsZero() || !f.until.IsZero()
+}
+
+// 解析日志行，仅在需要时解析JSON和时间
+func (f *filter) parse(text string) entry {
+	var e entry
+	if len(f.fields) < 1 && !f.hasTime() {
+		return e
+	}
+	if s := strings.TrimSpace(text); strings.HasPrefix(s, "{") {
+		d := json.NewDecoder(strings.NewReader(s))
+		d.UseNumber()
+		var v map[string]interface{}
+		if d.Decode(&v) == nil {
+			e.fields = v
+		}
+	}
+	if f.hasTime() {
+		e.time, e.hasTime = lineTime(text, e.fields)
+	}
+	return e
+}
+
+// 获取日志行的时间
+func lineTime(text string, fields map[string]interface{}) (time.Time, bool) {
+	if fields != nil {
+		for _, name := range timeFieldNames {
+			switch v := fields[name].(type) {
+			case string:
+				if t, err := parseTime(v); err == nil {
+					return t, true
+				}
+			case json.Number:
+				// 数值为Unix时间戳，超过1e12时单位为毫秒
+				if n, err := v.Float64(); err == nil {
+					if n > 1e12 {
+						n /= 1000
+					}
+					sec := int64(n)
+					return time.Unix(sec, int64((n-float64(sec))*1e9)), true
+				}
+			}
+		}
+		return time.Time{}, false
+	}
+	m := lineTimePattern.FindStringSubmatch(text)
+	if m == nil {
+		return time.Time{}, false
+	}
+	t, err := parseTime(m[1])
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// 检查是否匹配grep和字段条件
+func (f *filter) matchText(text string, e entry) bool {
+	if f.grep != nil && f.grep.MatchString(text) == f.invert {
+		return false
+	}
+	for _, ff := range f.fields {
+		v, ok := lookupField(e.fields, ff.path)
+		if !ok {
+			return false
+		}
+		s := fieldString(v)
+		matched := false
+		for _, value := range ff.values {
+			if strings.EqualFold(s, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *filter) inTime(t time.Time) bool {
+	return (f.since.IsZero() || !t.Before(f.since)) && (f.until.IsZero() || !t.After(f.until))
+}
+
+// 按路径获取字段，如：user.id
+func lookupField(fields map[string]interface{}, path []string) (interface{}, bool) {
+	var v interface{} = fields
+	for _, name := range path {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func fieldString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	case nil:
+		return "null"
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+// 从前向后逐行匹配，没有时间的行（如多行的异常堆栈）使用前面最近的有时间的行的时间
+type lineMatcher struct {
+	f     *filter
+	last  time.Time
+	known bool
+}
+
+// 返回是否匹配，以及日志时间是否已经晚于until
+func (m *lineMatcher) match(text string) (bool, bool) {
+	if m.f == nil {
+		return true, false
+	}
+	e := m.f.parse(text)
+	if !m.f.hasTime() {
+		return m.f.matchText(text, e), false
+	}
+	if e.hasTime {
+		m.last, m.known = e.time, true
+	}
+	if !m.known {
+		return false, false
+	}
+	if !m.f.until.IsZero() && m.last.After(m.f.until) {
+		return false, true
+	}
+	return m.f.inTime(m.last) && m.f.matchText(text, e), false
+}
+
+// 从后向前逐行匹配，没有时间的行需要暂存，直到遇到前面有时间的行时才能确定是否匹配
+type reverseMatcher struct {
+	f       *filter
+	max     int // 最多需要的行数，超出的暂存行不再保留
+	pending []Line
+	stop    bool // 已经早于since，不需要继续向前读取
+}
+
+// 匹配一行，将匹配的行按从后向前的顺序加入out
+func (m *reverseMatcher) add(line Line, out []Line) []Line {
+	if m.f == nil {
+		return append(out, line)
+	}
+	e := m.f.parse(line.Text)
+	if !m.f.hasTime() {
+		if m.f.matchText(line.Text, e) {
+			out = append(out, line)
+		}
+		return out
+	}
+	if !e.hasTime {
+		if len(m.pending) < m.max && m.f.matchText(line.Text, e) {
+			m.pending = append(m.pending, line)
+		}
+		return out
+	}
+	out = m.resolve(e.time, true, out)
+	if m.f.inTime(e.time) && m.f.matchText(line.Text, e) {
+		out = append(out, line)
+	}
+	if !m.f.since.IsZero() && e.time.Before(m.f.since) {
+		m.stop = true
+	}
+	return out
+}
+
+// 使用前面有时间的行的时间确定暂存的行是否匹配，known为false表示前面没有有时间的行
+func (m *reverseMatcher) resolve(t time.Time, known bool, out []Line) []Line {
+	if m.f == nil {
+		return out
+	}
+	if known && m.f.inTime(t) {
+		out = append(out, m.pending...)
+	}
+	m.pending = m.pending[:0]
+	return out
+}
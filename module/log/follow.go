@@ -0,0 +1,271 @@
+package log
+
+import (
+	"bytes"
+	"errors"
+	"github.com/leizongmin/tora/web"
+	"io"
+	"os"
+	"time"
+)
+
+// 跟踪日志时的事件类型
+const (
+	EventLine     = "line"     // 新的一行
+	EventRotate   = "rotate"   // 日志文件被轮转，开始读取新的文件
+	EventTruncate = "truncate" // 日志文件被截断，从头开始读取
+	EventReset    = "reset"    // 游标所在的文件已经不存在，从最早的文件开始读取
+)
+
+// 日志时间已经晚于until，结束跟踪
+var errUntil = errors.New("until reached")
+
+// 已经读取了足够的行
+var errLimit = errors.New("limit reached")
+
+// 文件变化的事件
+type FileEvent struct {
+	File string `json:"file"` // 当前读取的文件
+}
+
+// 跟踪日志文件，通过轮询检查新写入的内容，文件被重命名或重新创建（logrotate）时读取完旧文件后切换到新文件，
+// 文件被截断（copytruncate）时从头开始读取
+type follower struct {
+	s       *source
+	file    string
+	f       *os.File
+	info    os.FileInfo
+	offset  int64  // 下次读取的位置
+	partial []byte // 未写完的行
+	start   int64  // 未写完的行在文件中的位置
+	id      *identity
+}
+
+func (w *follower) open(file string, offset int64) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	w.close()
+	w.file, w.f, w.info = file, f, info
+	w.offset, w.start, w.partial = offset, offset, nil
+	w.id = &identity{ino: fileInode(info)}
+	return nil
+}
+
+func (w *follower) close() {
+	if w.f != nil {
+		w.f.Close()
+		w.f = nil
+	}
+}
+
+// 读取到文件末尾，每个完整的行调用一次emit
+func (w *follower) read(emit func(Line) error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := w.f.ReadAt(buf, w.offset)
+		if n > 0 {
+			if e := w.split(buf[:n], emit); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (w *follower) split(data []byte, emit func(Line) error) error {
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			w.partial = append(w.partial, data...)
+			w.offset += int64(len(data))
+			// 超长的行拆分为多行
+			if len(w.partial) >= MaxLineSize {
+				return w.flush(emit)
+			}
+			return nil
+		}
+		w.partial = append(w.partial, data[:i]...)
+		w.offset += int64(i + 1)
+		data = data[i+1:]
+		if err := w.emit(emit); err != nil {
+			return err
+		}
+		w.start = w.offset
+	}
+	return nil
+}
+
+func (w *follower) emit(emit func(Line) error) error {
+	line := Line{File: w.file, Offset: w.start, Text: string(bytes.TrimSuffix(w.partial, []byte{'\r'}))}
+	w.partial = w.partial[:0]
+	if w.id != nil {
+		if w.f != nil {
+			w.id.grow(w.f, w.offset)
+		}
+		line.Cursor = w.id.cursor(w.offset)
+	}
+	return emit(line)
+}
+
+// 输出未写完的行
+func (w *follower) flush(emit func(Line) error) error {
+	if len(w.partial) < 1 {
+		return nil
+	}
+	err := w.emit(emit)
+	w.start = w.offset
+	return err
+}
+
+// 检查文件是否被截断或轮转，返回对应的事件类型，没有变化时返回空字符串
+func (w *follower) check(emit func(Line) error) (string, error) {
+	info, err := w.f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() < w.offset {
+		w.offset, w.start, w.partial = 0, 0, nil
+		w.id = &identity{ino: w.id.ino}
+		return EventTruncate, nil
+	}
+	file, current, err := w.s.current()
+	if err != nil {
+		// 轮转过程中新文件可能还未创建
+		return "", nil
+	}
+	if file == w.file && os.SameFile(current, w.info) {
+		return "", nil
+	}
+	// 读取完旧文件剩余的内容后切换到新文件
+	if err := w.read(emit); err != nil {
+		return "", err
+	}
+	if err := w.flush(emit); err != nil {
+		return "", err
+	}
+	if err := w.open(file, 0); err != nil {
+		return "", err
+	}
+	return EventRotate, nil
+}
+
+// 跟踪日志，先输出末尾的lines行或者游标之后的行，客户端断开连接或者日志时间晚于until时结束
+func (m *ModuleLog) handleFollow(ctx *web.Context, s *source, segs []segment, lines int, f *filter, pos *position) {
+	var initial []Line
+	var start int64
+	var err error
+	if pos == nil {
+		initial, start, err = readLastLines(segs, lines, false, f)
+		if err != nil {
+			m.responseError(ctx, err)
+			return
+		}
+	} else if pos.index == len(segs)-1 {
+		start = pos.offset
+	}
+	w := &follower{s: s}
+	if err := w.open(segs[len(segs)-1].file, start); err != nil {
+		m.responseError(ctx, err)
+		return
+	}
+	defer w.close()
+
+	sse := ctx.Util.AcceptEventStream()
+	if sse {
+		ctx.Util.ResponseEventStreamHeader()
+	} else {
+		ctx.Res.Header().Set("content-type", "text/plain; charset=utf-8")
+		ctx.Res.Header().Set("x-content-type-options", "nosniff")
+		ctx.Res.WriteHeader(200)
+		ctx.Util.Flush()
+	}
+	write := func(line Line) error {
+		if sse {
+			return ctx.Util.ResponseEventWithId(EventLine, line.Cursor, line)
+		}
+		_, err := ctx.Res.Write([]byte(line.Text + "\n"))
+		return err
+	}
+	matcher := &lineMatcher{f: f}
+	emit := func(line Line) error {
+		ok, done := matcher.match(line.Text)
+		if done {
+			return errUntil
+		}
+		if !ok {
+			return nil
+		}
+		return write(line)
+	}
+	notify := func(event string, file string) error {
+		if sse {
+			return ctx.Util.ResponseEvent(event, FileEvent{File: file})
+		}
+		return nil
+	}
+
+	for _, line := range initial {
+		// 开始的行已经过滤，仅用于更新日志时间
+		matcher.match(line.Text)
+		if err := write(line); err != nil {
+			return
+		}
+	}
+	if pos != nil {
+		if pos.reset {
+			if err := notify(EventReset, segs[0].file); err != nil {
+				return
+			}
+		}
+		// 先读取游标之后轮转的文件中的行
+		if err := readLinesAfter(segs, *pos, false, emit); err != nil {
+			if err != errUntil {
+				ctx.Log.Debugf("follow [%s] stopped: %s", s.name, err)
+			}
+			ctx.Util.Flush()
+			return
+		}
+	}
+	ctx.Util.Flush()
+	ticker := time.NewTicker(m.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Req.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		err := w.read(emit)
+		event := ""
+		if err == nil {
+			event, err = w.check(emit)
+		}
+		if err == errUntil {
+			ctx.Util.Flush()
+			return
+		}
+		if err != nil {
+			ctx.Log.Debugf("follow [%s] stopped: %s", s.name, err)
+			return
+		}
+		if len(event) > 0 {
+			ctx.Log.Infof("follow [%s]: %s %s", s.name, event, w.file)
+			if err := notify(event, w.file); err != nil {
+				return
+			}
+		}
+		ctx.Util.Flush()
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package log
+
+import (
+	"os"
+	"syscall"
+)
+
+// 获取文件的inode
+func fileInode(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino)
+	}
+	return 0
+}
@@ -0,0 +1,8 @@
+package log
+
+import "os"
+
+// Windows不支持inode，仅通过文件开头内容的指纹识别文件
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
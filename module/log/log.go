@@ -0,0 +1,271 @@
+package log
+
+import (
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 默认返回的行数
+const DefaultLines = 100
+
+// 默认最多返回的行数
+const DefaultMaxLines = 10000
+
+// 默认检查文件变化的间隔
+const DefaultPollInterval = 500 * time.Millisecond
+
+// 单行最大长度，超过此长度时拆分为多行
+const MaxLineSize = 64 * 1024
+
+type ModuleLog struct {
+	Log          *logrus.Logger    // 日志模块
+	Sources      map[string]Source // 日志源，名称只能包含字母、数字、下划线、点和横线
+	MaxLines     int               // 最多返回的行数
+	PollInterval time.Duration     // 跟踪日志时检查文件变化的间隔
+	Streams      map[string]Stream // 写入流，名称规则与日志源相同，不能与日志源重名
+	MaxBodySize  int64             // 每次写入的最大字节数
+	sources      map[string]*source
+	streams      map[string]*stream
+}
+
+// 日志源
+type Source struct {
+	Path string // 日志文件路径，支持glob通配符，匹配的文件和轮转后的文件作为一个连续的日志，最后修改的文件为当前文件
+}
+
+type source struct {
+	Source
+	name string
+}
+
+var sourceNamePattern = regexp.MustCompile("^[a-zA-Z0-9_.-]+$")
+
+// 检查配置并设置默认值
+func (m *ModuleLog) Init() error {
+	if !(m.MaxLines > 0) {
+		m.MaxLines = DefaultMaxLines
+	}
+	if !(m.PollInterval > 0) {
+		m.PollInterval = DefaultPollInterval
+	}
+	if !(m.MaxBodySize > 0) {
+		m.MaxBodySize = DefaultMaxBodySize
+	}
+	m.sources = make(map[string]*source)
+	for name, s := range m.Sources {
+		if !sourceNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid source name [%s]", name)
+		}
+		if len(s.Path) < 1 {
+			return fmt.Errorf("source [%s]: missing path", name)
+		}
+		if _, err := filepath.Match(s.Path, ""); err != nil {
+			return fmt.Errorf("source [%s]: invalid path [%s]: %s", name, s.Path, err)
+		}
+		m.sources[name] = &source{Source: s, name: name}
+	}
+	return m.initStreams()
+}
+
+func (m *ModuleLog) Handle(ctx *web.Context, caller Caller) {
+	name := strings.Trim(ctx.Req.URL.Path, "/")
+	if ctx.Req.Method == "POST" {
+		s, ok := m.streams[name]
+		if !ok {
+			common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("stream [%s] not found", name), nil)
+			return
+		}
+		if !s.allowWrite(caller) {
+			common.ResponseApiErrorWithStatusCode(ctx, 403, fmt.Sprintf("permission denied for stream [%s]", name), nil)
+			return
+		}
+		m.handleWrite(ctx, s)
+		return
+	}
+	if ctx.Req.Method != "GET" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	if len(name) < 1 {
+		m.handleSourceList(ctx)
+		return
+	}
+	s, ok := m.sources[name]
+	if !ok {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("source [%s] not found", name), nil)
+		return
+	}
+	m.handleSource(ctx, s)
+}
+
+func (m *ModuleLog) handleSourceList(ctx *web.Context) {
+	names := make([]string, 0, len(m.sources))
+	for name := range m.sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]common.JSON, 0, len(names))
+	for _, name := range names {
+		s := m.sources[name]
+		_, isStream := m.streams[name]
+		item := common.JSON{"name": name, "path": s.Path, "stream": isStream, "file": "", "size": 0, "rotated": []common.JSON{}}
+		if segs, err := s.segments(); err == nil {
+			current := segs[len(segs)-1]
+			item["file"] = current.file
+			item["size"] = current.info.Size()
+			rotated := make([]common.JSON, 0, len(segs)-1)
+			for _, g := range segs[:len(segs)-1] {
+				rotated = append(rotated, common.JSON{
+					"file":         g.file,
+					"size":         g.info.Size(),
+					"modifiedTime": g.info.ModTime(),
+				})
+			}
+			item["rotated"] = rotated
+		}
+		list = append(list, item)
+	}
+	common.ResponseApiOk(ctx, common.JSON{"sources": list})
+}
+
+// 获取日志源当前的文件，匹配多个文件时使用最后修改的未压缩的文件
+func (s *source) current() (string, os.FileInfo, error) {
+	files, err := filepath.Glob(s.Path)
+	if err != nil {
+		return "", nil, err
+	}
+	var file string
+	var info os.FileInfo
+	for _, f := range files {
+		v, err := os.Stat(f)
+		if err != nil || !v.Mode().IsRegular() || len(compressOf(f)) > 0 {
+			continue
+		}
+		if info == nil || v.ModTime().After(info.ModTime()) {
+			file, info = f, v
+		}
+	}
+	if info == nil {
+		return "", nil, fmt.Errorf("no such file [%s]", s.Path)
+	}
+	return file, info, nil
+}
+
+// 读取末尾的行，如果指定了after则读取游标之后的行，如果指定了follow=1则继续跟踪新写入的行，
+// 可以通过grep、since、until、field等参数过滤
+func (m *ModuleLog) handleSource(ctx *web.Context, s *source) {
+	query := ctx.Req.URL.Query()
+	follow := query.Get("follow") == "1"
+	lines := DefaultLines
+	if follow {
+		lines = 0
+	}
+	if v := query.Get("lines"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			common.ResponseApiError(ctx, fmt.Sprintf("invalid lines [%s]", v), nil)
+			return
+		}
+		lines = n
+	}
+	if lines > m.MaxLines {
+		lines = m.MaxLines
+	}
+	f, err := parseFilter(query, time.Now())
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	segs, err := s.segments()
+	if err != nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, err.Error(), nil)
+		return
+	}
+	// 断开连接后重新连接时，EventSource 通过 Last-Event-ID 请求头发送最后收到的游标
+	after := query.Get("after")
+	if len(after) < 1 && follow {
+		after = ctx.Req.Header.Get("Last-Event-ID")
+	}
+	var pos *position
+	if len(after) > 0 {
+		c, err := parseCursor(after)
+		if err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+		v := locateCursor(segs, c)
+		if v.reset {
+			ctx.Log.Warnf("source [%s]: file of cursor [%s] not found, read from the oldest file", s.name, after)
+		}
+		pos = &v
+	}
+	if follow {
+		m.handleFollow(ctx, s, segs, lines, f, pos)
+		return
+	}
+
+	var list []Line
+	if pos == nil {
+		list, _, err = readLastLines(segs, lines, true, f)
+	} else if lines > 0 {
+		// 从游标之后向后读取最多lines行
+		matcher := &lineMatcher{f: f}
+		list = make([]Line, 0)
+		err = readLinesAfter(segs, *pos, true, func(line Line) error {
+			ok, done := matcher.match(line.Text)
+			if done {
+				return errUntil
+			}
+			if ok {
+				list = append(list, line)
+				if len(list) >= lines {
+					return errLimit
+				}
+			}
+			return nil
+		})
+		if err == errUntil || err == errLimit {
+			err = nil
+		}
+	}
+	if err != nil {
+		m.responseError(ctx, err)
+		return
+	}
+	texts := make([]string, len(list))
+	cursors := make([]string, len(list))
+	for i, v := range list {
+		texts[i] = v.Text
+		cursors[i] = v.Cursor
+	}
+	// 下次读取时使用的游标，没有读取到足够的行时表示已经读取到当前文件末尾
+	var next string
+	if pos != nil && lines > 0 && len(list) >= lines {
+		next = list[len(list)-1].Cursor
+	} else if next, err = endCursor(segs[len(segs)-1]); err != nil {
+		m.responseError(ctx, err)
+		return
+	}
+	data := common.JSON{"file": segs[len(segs)-1].file, "lines": texts, "cursors": cursors, "cursor": next}
+	if pos != nil && pos.reset {
+		data["reset"] = true
+	}
+	common.ResponseApiOk(ctx, data)
+}
+
+func (m *ModuleLog) responseError(ctx *web.Context, err error) {
+	if os.IsNotExist(err) {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, err.Error(), nil)
+		return
+	}
+	common.ResponseApiError(ctx, err.Error(), nil)
+}
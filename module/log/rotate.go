@@ -0,0 +1,178 @@
+package log
+
+import (
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 轮转后的日志文件名后缀，如：app.log.1、app.log.2.gz、app.log-20201018.zst、app.log.2020-10-18
+var rotatedSuffixPattern = regexp.MustCompile(`^(?:[.-]\d+|[.-]\d{4}-\d{2}-\d{2}(?:[-_.]\d+)?)?(?:\.gz|\.zst)?$`)
+
+// 日志源的一个文件，包括当前文件和轮转后的文件
+type segment struct {
+	file     string
+	info     os.FileInfo
+	compress string // 压缩格式：gz、zst，未压缩时为空字符串
+}
+
+func compressOf(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".gz"):
+		return "gz"
+	case strings.HasSuffix(name, ".zst"):
+		return "zst"
+	}
+	return ""
+}
+
+// 获取日志源的所有文件，按最后修改时间从旧到新排列，最后一个为当前文件
+func (s *source) segments() ([]segment, error) {
+	file, info, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	file = filepath.Clean(file)
+	matches, err := filepath.Glob(s.Path)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]segment, 0)
+	seen := make(map[string]bool)
+	dirs := make(map[string][]os.FileInfo)
+	for _, m := range matches {
+		dir, base := filepath.Dir(m), filepath.Base(m)
+		entries, ok := dirs[dir]
+		if !ok {
+			entries, _ = ioutil.ReadDir(dir)
+			dirs[dir] = entries
+		}
+		for _, v := range entries {
+			name := v.Name()
+			if !strings.HasPrefix(name, base) || !rotatedSuffixPattern.MatchString(name[len(base):]) || !v.Mode().IsRegular() {
+				continue
+			}
+			f := filepath.Join(dir, name)
+			if f == file || seen[f] {
+				continue
+			}
+			seen[f] = true
+			list = append(list, segment{file: f, info: v, compress: compressOf(name)})
+		}
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].info.ModTime().Before(list[j].info.ModTime())
+	})
+	return append(list, segment{file: file, info: info}), nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r *readCloser) Close() error {
+	return r.close()
+}
+
+// 打开文件，压缩的文件读取解压后的内容
+func (g segment) open() (io.ReadCloser, error) {
+	f, err := os.Open(g.file)
+	if err != nil {
+		return nil, err
+	}
+	switch g.compress {
+	case "gz":
+		r, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: r, close: func() error {
+			r.Close()
+			return f.Close()
+		}}, nil
+	case "zst":
+		r, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: r, close: func() error {
+			r.Close()
+			return f.Close()
+		}}, nil
+	}
+	return f, nil
+}
+
+// 从w的位置开始从前向后逐行读取，超过MaxLineSize的行拆分为多行，fn返回错误时停止
+func scanForward(r io.Reader, w *follower, fn func(Line) error) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if e := w.split(buf[:n], fn); e != nil {
+				return e
+			}
+		}
+		if err == io.EOF {
+			return w.flush(fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 读取压缩的文件中匹配的最后need行，压缩的文件不能从后向前读取，因此需要从头读取，
+// 读取的行按从后向前的顺序加入out
+func readCompressedLines(g segment, need int, m *reverseMatcher, out []Line) ([]Line, error) {
+	id, err := g.identity()
+	if err != nil {
+		return nil, err
+	}
+	r, err := g.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	lm := &lineMatcher{f: m.f}
+	found := make([]Line, 0)
+	var first time.Time
+	err = scanForward(r, &follower{file: g.file, id: id}, func(line Line) error {
+		ok, done := lm.match(line.Text)
+		if lm.known && first.IsZero() {
+			first = lm.last
+		}
+		if done {
+			return errUntil
+		}
+		if ok {
+			found = append(found, line)
+			if len(found) > 2*need {
+				found = append(found[:0], found[len(found)-need:]...)
+			}
+		}
+		return nil
+	})
+	if err != nil && err != errUntil {
+		return nil, err
+	}
+	// 后一个文件开头没有时间的行使用此文件最后的时间
+	out = m.resolve(lm.last, lm.known, out)
+	for i := len(found) - 1; i >= 0; i-- {
+		out = append(out, found[i])
+	}
+	if m.f != nil && !m.f.since.IsZero() && !first.IsZero() && first.Before(m.f.since) {
+		m.stop = true
+	}
+	return out, nil
+}
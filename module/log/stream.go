@@ -0,0 +1,236 @@
+package log
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// 写入流的文件默认的最大字节数，超过后轮转
+const DefaultStreamMaxSize = 100 * 1024 * 1024
+
+// 写入流默认保留的轮转后的文件数量
+const DefaultStreamMaxFiles = 5
+
+// 默认每次写入的最大字节数
+const DefaultMaxBodySize = 10 * 1024 * 1024
+
+// 写入流，客户端通过 POST /<name> 写入日志，同时也作为日志源读取
+type Stream struct {
+	Path     string   // 日志文件路径
+	MaxSize  int64    // 文件的最大字节数，写入后超过此大小时先轮转为 Path.1、Path.2 等文件
+	MaxFiles int      // 保留的轮转后的文件数量
+	Allow    []string // 允许写入的token，通过IP白名单授权的客户端为IP，为空时不允许任何客户端写入
+	NoSync   bool     // 写入后不立即同步到磁盘，由操作系统决定写入磁盘的时机，用于写入频繁的审计日志
+}
+
+// 请求的客户端
+type Caller struct {
+	Token string // 请求使用的token，未通过token授权时为空
+	IP    string // 客户端IP
+}
+
+// 检查客户端是否允许写入此写入流，使用token授权时检查token，否则检查IP
+func (s Stream) allowWrite(c Caller) bool {
+	id := c.Token
+	if len(id) < 1 {
+		id = c.IP
+	}
+	for _, v := range s.Allow {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+type stream struct {
+	*Writer
+	name string
+}
+
+// 按大小轮转的日志文件写入器，用于写入流和审计日志，文件在写入之间保持打开
+type Writer struct {
+	Stream
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// 创建写入器，文件不存在时创建空的文件，以便在写入前也可以作为日志源读取
+func NewWriter(s Stream) (*Writer, error) {
+	if len(s.Path) < 1 {
+		return nil, fmt.Errorf("missing path")
+	}
+	if !(s.MaxSize > 0) {
+		s.MaxSize = DefaultStreamMaxSize
+	}
+	if !(s.MaxFiles > 0) {
+		s.MaxFiles = DefaultStreamMaxFiles
+	}
+	if err := os.MkdirAll(filepath.Dir(s.Path), 0755); err != nil {
+		return nil, err
+	}
+	w := &Writer{Stream: s}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (m *ModuleLog) initStreams() error {
+	m.streams = make(map[string]*stream)
+	for name, s := range m.Streams {
+		if !sourceNamePattern.MatchString(name) {
+			return fmt.Errorf("invalid stream name [%s]", name)
+		}
+		if _, ok := m.sources[name]; ok {
+			return fmt.Errorf("stream [%s]: conflicts with source", name)
+		}
+		w, err := NewWriter(s)
+		if err != nil {
+			return fmt.Errorf("stream [%s]: %s", name, err)
+		}
+		m.streams[name] = &stream{Writer: w, name: name}
+		m.sources[name] = &source{Source: Source{Path: s.Path}, name: name}
+	}
+	return nil
+}
+
+// 关闭写入流的文件
+func (m *ModuleLog) Close() {
+	for _, s := range m.streams {
+		s.Close()
+	}
+}
+
+// 写入日志，Content-Type 包含 json 时每行需要是一个JSON，否则按文本写入，忽略空行
+func (m *ModuleLog) handleWrite(ctx *web.Context, s *stream) {
+	body, err := ioutil.ReadAll(io.LimitReader(ctx.Req.Body, m.MaxBodySize+1))
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	if int64(len(body)) > m.MaxBodySize {
+		common.ResponseApiErrorWithStatusCode(ctx, 413, fmt.Sprintf("request body too large, max size is %d", m.MaxBodySize), nil)
+		return
+	}
+	isJson := strings.Contains(ctx.Req.Header.Get("Content-Type"), "json")
+	var buf bytes.Buffer
+	n := 0
+	for i, line := range bytes.Split(body, []byte{'\n'}) {
+		line = bytes.TrimSuffix(line, []byte{'\r'})
+		if len(bytes.TrimSpace(line)) < 1 {
+			continue
+		}
+		if isJson && !json.Valid(line) {
+			common.ResponseApiErrorWithStatusCode(ctx, 400, fmt.Sprintf("invalid json at line %d", i+1), nil)
+			return
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		n++
+	}
+	if err := s.Write(buf.Bytes()); err != nil {
+		ctx.Log.Errorf("write stream [%s] failed: %s", s.name, err)
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	common.ResponseApiOk(ctx, common.JSON{"file": s.Path, "lines": n, "bytes": buf.Len()})
+}
+
+// 追加写入，未设置NoSync时同步到磁盘，写入后超过MaxSize时先轮转
+func (s *Writer) Write(data []byte) error {
+	if len(data) < 1 {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.open(); err != nil {
+		return err
+	}
+	if s.size > 0 && s.size+int64(len(data)) > s.MaxSize {
+		s.closeFile()
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(data)
+	s.size += int64(n)
+	if err == nil && !s.NoSync {
+		err = s.f.Sync()
+	}
+	if err != nil {
+		// 出错后关闭文件，下次写入时重新打开
+		s.closeFile()
+	}
+	return err
+}
+
+// 关闭文件，之后的写入会重新打开文件
+func (s *Writer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closeFile()
+}
+
+func (s *Writer) open() error {
+	if s.f != nil {
+		return nil
+	}
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f = f
+	s.size = info.Size()
+	return nil
+}
+
+func (s *Writer) closeFile() error {
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// 将 Path.N 重命名为 Path.N+1，Path 重命名为 Path.1，删除超过MaxFiles的文件
+func (s *Writer) rotate() error {
+	name := func(i int) string {
+		return s.Path + "." + strconv.Itoa(i)
+	}
+	// 删除超出数量的文件，包括之前配置了更大的MaxFiles时留下的文件
+	for i := s.MaxFiles; ; i++ {
+		if err := os.Remove(name(i)); err != nil {
+			if os.IsNotExist(err) {
+				break
+			}
+			return err
+		}
+	}
+	for i := s.MaxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(name(i), name(i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(s.Path, name(1))
+}
@@ -0,0 +1,180 @@
+package log
+
+import (
+	"bytes"
+	"io"
+	"os"
+)
+
+// 从末尾向前读取时每次读取的字节数
+const tailChunkSize = 64 * 1024
+
+// 日志文件中的一行
+type Line struct {
+	File   string `json:"file"`   // 所在的文件
+	Offset int64  `json:"offset"` // 行首在文件中的位置
+	Text   string `json:"text"`   // 内容，不包含行尾的换行符
+	Cursor string `json:"cursor"` // 游标，通过after参数从此行之后继续读取
+}
+
+// 读取日志源末尾匹配过滤条件的n行，当前文件（segs的最后一个）中的行不够时继续读取轮转后的文件，
+// partial为false时不包括未写完（没有换行符）的最后一行，
+// 返回这些行以及当前文件最后一个完整行之后的位置，跟踪文件时从该位置开始读取
+func readLastLines(segs []segment, n int, partial bool, f *filter) ([]Line, int64, error) {
+	current := segs[len(segs)-1]
+	fd, err := os.Open(current.file)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer fd.Close()
+	info, err := fd.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	end, err := lastLineEnd(fd, info.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+	lines := make([]Line, 0)
+	if n < 1 {
+		return lines, end, nil
+	}
+	size := end
+	if partial {
+		size = info.Size()
+	}
+	m := &reverseMatcher{f: f, max: n}
+	add := func(line Line) bool {
+		lines = m.add(line, lines)
+		return len(lines) < n && !m.stop
+	}
+	if err := scanBackward(fd, info, current.file, size, add); err != nil {
+		return nil, 0, err
+	}
+	for i := len(segs) - 2; i >= 0 && len(lines) < n && !m.stop; i-- {
+		g := segs[i]
+		if f != nil && !f.since.IsZero() && g.info.ModTime().Before(f.since) {
+			// 文件最后修改的时间早于since，更早的文件也不需要读取
+			break
+		}
+		if f != nil && !f.until.IsZero() && i > 0 && segs[i-1].info.ModTime().After(f.until) {
+			// 前一个文件最后修改的时间晚于until，此文件中的行都晚于until
+			m.pending = m.pending[:0]
+			continue
+		}
+		if len(g.compress) > 0 {
+			if lines, err = readCompressedLines(g, n-len(lines), m, lines); err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		err := func() error {
+			fd, err := os.Open(g.file)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			info, err := fd.Stat()
+			if err != nil {
+				return err
+			}
+			return scanBackward(fd, info, g.file, info.Size(), add)
+		}()
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if len(lines) > n {
+		lines = lines[:n]
+	}
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines, end, nil
+}
+
+// 最后一个换行符之后的位置
+func lastLineEnd(fd *os.File, size int64) (int64, error) {
+	pos := size
+	for pos > 0 {
+		chunk := int64(tailChunkSize)
+		if chunk > pos {
+			chunk = pos
+		}
+		buf := make([]byte, chunk)
+		if _, err := fd.ReadAt(buf, pos-chunk); err != nil && err != io.EOF {
+			return 0, err
+		}
+		pos -= chunk
+		if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+			return pos + int64(i) + 1, nil
+		}
+	}
+	return 0, nil
+}
+
+// 从end位置向前逐行读取，fn返回false时停止，超过MaxLineSize的行拆分为多行
+func scanBackward(fd *os.File, info os.FileInfo, file string, end int64, fn func(Line) bool) error {
+	if end < 1 {
+		return nil
+	}
+	id, err := newIdentity(io.NewSectionReader(fd, 0, end), info)
+	if err != nil {
+		return err
+	}
+	pos := end
+	var data []byte
+	read := func() error {
+		chunk := int64(tailChunkSize)
+		if chunk > pos {
+			chunk = pos
+		}
+		buf := make([]byte, chunk)
+		if _, err := fd.ReadAt(buf, pos-chunk); err != nil && err != io.EOF {
+			return err
+		}
+		pos -= chunk
+		data = append(buf, data...)
+		return nil
+	}
+	if err := read(); err != nil {
+		return err
+	}
+	// 未写完的最后一行的游标为行首的位置，从此游标继续读取时会重新读取这一行
+	next, partial := end, !bytes.HasSuffix(data, []byte{'\n'})
+	data = bytes.TrimSuffix(data, []byte{'\n'})
+	for {
+		var text []byte
+		var offset int64
+		i := bytes.LastIndexByte(data, '\n')
+		switch {
+		case i >= 0:
+			text, offset = data[i+1:], pos+int64(i)+1
+		case pos == 0:
+			text, offset = data, 0
+		case len(data) >= MaxLineSize:
+			text, offset = data[len(data)-MaxLineSize:], pos+int64(len(data)-MaxLineSize)
+		default:
+			if err := read(); err != nil {
+				return err
+			}
+			continue
+		}
+		if partial {
+			next, partial = offset, false
+		}
+		line := Line{File: file, Offset: offset, Text: string(bytes.TrimSuffix(text, []byte{'\r'})), Cursor: id.cursor(next)}
+		if !fn(line) {
+			return nil
+		}
+		next = offset
+		switch {
+		case i >= 0:
+			data = data[:i]
+		case pos == 0:
+			return nil
+		default:
+			data = data[:len(data)-MaxLineSize]
+		}
+	}
+}
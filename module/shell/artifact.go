@@ -0,0 +1,183 @@
+package shell
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// 默认保存产物时创建目录和文件的权限
+const (
+	DefaultArtifactsDirPerm  = 0777
+	DefaultArtifactsFilePerm = 0666
+)
+
+// 已保存的产物文件
+type ArtifactResult struct {
+	Path string `json:"path"` // 相对于artifactsTo的路径
+	Size int64  `json:"size"` // 文件大小
+}
+
+// 产物文件，name为相对于Root的路径
+type artifactFile struct {
+	name string
+	real string
+	info os.FileInfo
+}
+
+// 检查产物的路径和保存位置，在执行前调用
+func (m *ModuleShell) checkArtifacts(info ExecInfo) error {
+	for _, p := range info.Artifacts {
+		if _, _, err := resolveRealPath(m.Root, path.Join("/", info.CWD), p); err != nil {
+			return err
+		}
+	}
+	if len(info.ArtifactsTo) > 0 {
+		if len(m.ArtifactsRoot) < 1 {
+			return fmt.Errorf("artifactsTo is not supported when module [file] is not enabled")
+		}
+		if !containsString(info.caller.Modules, "file") {
+			return fmt.Errorf("permission denied for module [file]")
+		}
+		if _, _, err := resolveRealPath(m.ArtifactsRoot, "/", info.ArtifactsTo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 收集产物文件，目录会递归包含其中的文件，目录中的符号链接会被忽略
+func (m *ModuleShell) collectArtifacts(info ExecInfo) ([]artifactFile, error) {
+	files := make([]artifactFile, 0)
+	for _, p := range info.Artifacts {
+		virtual, real, err := resolveRealPath(m.Root, path.Join("/", info.CWD), p)
+		if err != nil {
+			return nil, err
+		}
+		s, err := os.Stat(real)
+		if err != nil {
+			return nil, fmt.Errorf("artifact [%s]: %s", p, cleanPathError(err))
+		}
+		if !s.IsDir() {
+			files = append(files, artifactFile{name: strings.TrimPrefix(virtual, "/"), real: real, info: s})
+			continue
+		}
+		err = filepath.Walk(real, func(f string, s os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !s.Mode().IsRegular() && !s.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(real, f)
+			if err != nil {
+				return err
+			}
+			name := strings.TrimPrefix(path.Join(virtual, filepath.ToSlash(rel)), "/")
+			files = append(files, artifactFile{name: name, real: f, info: s})
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("artifact [%s]: %s", p, cleanPathError(err))
+		}
+	}
+	return files, nil
+}
+
+// 去掉出错信息中的实际路径
+func cleanPathError(err error) error {
+	if e, ok := err.(*os.PathError); ok {
+		return e.Err
+	}
+	return err
+}
+
+// 将产物以tar格式写入w
+func writeArtifactsTar(w io.Writer, files []artifactFile) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		h, err := tar.FileInfoHeader(f.info, "")
+		if err != nil {
+			return err
+		}
+		h.Name = f.name
+		if f.info.IsDir() {
+			h.Name += "/"
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			return err
+		}
+		if f.info.IsDir() {
+			continue
+		}
+		if err := copyFileTo(tw, f.real); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func copyFileTo(w io.Writer, f string) error {
+	r, err := os.Open(f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// 将产物保存到ArtifactsRoot下的artifactsTo目录中，已存在的文件会被替换，
+// 经过符号链接后位于ArtifactsRoot之外的位置会被拒绝，已存在的符号链接会被删除而不是写入其指向的文件
+func (m *ModuleShell) saveArtifacts(info ExecInfo) ([]ArtifactResult, error) {
+	files, err := m.collectArtifacts(info)
+	if err != nil {
+		return nil, err
+	}
+	dest, _, err := resolveRealPath(m.ArtifactsRoot, "/", info.ArtifactsTo)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]ArtifactResult, 0, len(files))
+	for _, f := range files {
+		if f.info.IsDir() {
+			_, target, err := resolveRealPath(m.ArtifactsRoot, dest, f.name)
+			if err != nil {
+				return results, err
+			}
+			if err := os.MkdirAll(target, m.ArtifactsDirPerm); err != nil {
+				return results, err
+			}
+			continue
+		}
+		// 文件本身可能是需要被替换的符号链接，因此仅检查所在的目录
+		_, dir, err := resolveRealPath(m.ArtifactsRoot, dest, path.Dir(f.name))
+		if err != nil {
+			return results, err
+		}
+		if err := os.MkdirAll(dir, m.ArtifactsDirPerm); err != nil {
+			return results, err
+		}
+		target := filepath.Join(dir, path.Base(f.name))
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return results, err
+		}
+		w, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, m.ArtifactsFilePerm)
+		if err != nil {
+			return results, err
+		}
+		err = copyFileTo(w, f.real)
+		if e := w.Close(); err == nil {
+			err = e
+		}
+		if err != nil {
+			return results, err
+		}
+		results = append(results, ArtifactResult{Path: f.name, Size: f.info.Size()})
+	}
+	return results, nil
+}
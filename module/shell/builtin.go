@@ -0,0 +1,140 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+)
+
+// 内部命令，在当前进程内执行，所有路径均限制在Root目录内
+type builtinFunc = func(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error)
+
+var builtinCommands = map[string]builtinFunc{
+	"list": builtinList,
+	"cd":   builtinCd,
+	"cat":  builtinCat,
+	"exit": builtinExit,
+	"run":  builtinRun,
+}
+
+// 在tora-server进程内读取文件的内部命令，不受runAsUser、runAsGroup限制，因此指定了运行身份时不允许执行
+var builtinReadsFiles = map[string]bool{
+	"list": true,
+	"cat":  true,
+}
+
+// list [path] 列出目录下的文件，目录名以/结尾
+func builtinList(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) > 2 {
+		return 2, fmt.Errorf("usage: list [path]")
+	}
+	p := "."
+	if len(args) > 1 {
+		p = args[1]
+	}
+	_, f, err := s.resolvePath(p)
+	if err != nil {
+		return 1, err
+	}
+	info, err := os.Stat(f)
+	if err != nil {
+		return 1, err
+	}
+	if !info.IsDir() {
+		fmt.Fprintln(stdout, info.Name())
+		return 0, nil
+	}
+	list, err := ioutil.ReadDir(f)
+	if err != nil {
+		return 1, err
+	}
+	for _, v := range list {
+		if v.IsDir() {
+			fmt.Fprintln(stdout, v.Name()+"/")
+		} else {
+			fmt.Fprintln(stdout, v.Name())
+		}
+	}
+	return 0, nil
+}
+
+// cd [path] 切换工作目录，不指定path时切换到Root目录
+func builtinCd(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) > 2 {
+		return 2, fmt.Errorf("usage: cd [path]")
+	}
+	p := "/"
+	if len(args) > 1 {
+		p = args[1]
+	}
+	cwd, f, err := s.resolvePath(p)
+	if err != nil {
+		return 1, err
+	}
+	info, err := os.Stat(f)
+	if err != nil {
+		return 1, err
+	}
+	if !info.IsDir() {
+		return 1, fmt.Errorf("not a directory: %s", p)
+	}
+	s.cwd = cwd
+	return 0, nil
+}
+
+// cat <path>... 输出文件内容
+func builtinCat(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) < 2 {
+		return 2, fmt.Errorf("usage: cat <path>...")
+	}
+	for _, p := range args[1:] {
+		_, f, err := s.resolvePath(p)
+		if err != nil {
+			return 1, err
+		}
+		r, err := os.Open(f)
+		if err != nil {
+			return 1, err
+		}
+		_, err = io.Copy(stdout, r)
+		r.Close()
+		if err != nil {
+			return 1, err
+		}
+	}
+	return 0, nil
+}
+
+// exit [code] 停止执行当前阶段的后续命令，并设置退出码
+func builtinExit(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) > 2 {
+		return 2, fmt.Errorf("usage: exit [code]")
+	}
+	code := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return 2, fmt.Errorf("invalid exit code: %s", args[1])
+		}
+		code = n
+	}
+	s.exited = true
+	return code, nil
+}
+
+// run <command> [args]... 执行外部命令
+func builtinRun(ctx context.Context, s *session, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if len(args) < 2 {
+		return 2, fmt.Errorf("usage: run <command> [args]...")
+	}
+	return s.runExternal(ctx, args[1:], stdout, stderr)
+}
+
+// 将相对于当前工作目录的路径解析为相对于Root的路径及实际的文件路径，
+// 通过符号链接访问Root以外的文件也会被拒绝
+func (s *session) resolvePath(p string) (string, string, error) {
+	return resolveRealPath(s.m.Root, s.cwd, p)
+}
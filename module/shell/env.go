@@ -0,0 +1,106 @@
+package shell
+
+import (
+	"fmt"
+	"github.com/ryanuber/go-glob"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// 替换输出中密钥的字符串
+const SecretMask = "****"
+
+// 子进程继承的tora-server环境变量，CleanEnv时仅保留AllowEnv中的变量
+func (m *ModuleShell) inheritedEnv() []string {
+	env := os.Environ()
+	if !m.CleanEnv {
+		return env
+	}
+	list := make([]string, 0)
+	for _, v := range env {
+		name := v
+		if i := strings.Index(v, "="); i >= 0 {
+			name = v[:i]
+		}
+		for _, p := range m.AllowEnv {
+			if glob.Glob(p, name) {
+				list = append(list, v)
+				break
+			}
+		}
+	}
+	return list
+}
+
+// 检查密钥文件是否可以读取
+func checkSecrets(files map[string]string) error {
+	_, err := readSecrets(files)
+	return err
+}
+
+// 读取密钥文件，每次执行时重新读取以便更新密钥后无需重启，去掉末尾的换行符
+func readSecrets(files map[string]string) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for name, f := range files {
+		b, err := ioutil.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("read secret [%s] failed: %s", name, cleanPathError(err))
+		}
+		secrets[name] = strings.TrimRight(string(b), "\r\n")
+	}
+	return secrets, nil
+}
+
+// 合并模块和任务的密钥文件，任务中的同名密钥优先
+func mergeSecrets(base map[string]string, override map[string]string) map[string]string {
+	files := make(map[string]string)
+	for k, v := range base {
+		files[k] = v
+	}
+	for k, v := range override {
+		files[k] = v
+	}
+	return files
+}
+
+// 将输出中的密钥替换为****，较长的密钥优先替换。
+// 实时输出的事件按行产生，多行的密钥无法整体匹配，因此同时替换其中的每一个非空行
+func newSecretMasker(secrets map[string]string) *strings.Replacer {
+	values := make([]string, 0, len(secrets))
+	for _, v := range secrets {
+		if len(v) < 1 {
+			continue
+		}
+		values = append(values, v)
+		if !strings.Contains(v, "\n") {
+			continue
+		}
+		for _, line := range strings.Split(v, "\n") {
+			line = strings.TrimSuffix(line, "\r")
+			if len(strings.TrimSpace(line)) > 0 {
+				values = append(values, line)
+			}
+		}
+	}
+	if len(values) < 1 {
+		return nil
+	}
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	pairs := make([]string, 0, len(values)*2)
+	for _, v := range values {
+		pairs = append(pairs, v, SecretMask)
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// 隐藏输出中的密钥
+func (s *session) mask(str string) string {
+	if s.masker == nil {
+		return str
+	}
+	return s.masker.Replace(str)
+}
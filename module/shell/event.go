@@ -0,0 +1,74 @@
+package shell
+
+import (
+	"bytes"
+	"sync"
+)
+
+// 事件类型
+const (
+	EventQueued    = "queued"    // 不能立即执行，进入队列等待
+	EventStepStart = "stepStart" // 开始执行命令
+	EventStdout    = "stdout"    // 标准输出，每行一个事件
+	EventStderr    = "stderr"    // 标准错误输出，每行一个事件
+	EventStepEnd   = "stepEnd"   // 命令执行结束
+	EventEnd       = "end"       // 全部执行结束
+)
+
+// 执行过程中产生的事件
+type Event struct {
+	Type     string `json:"type"`               // 事件类型
+	Step     int    `json:"step"`               // 命令序号，从0开始
+	Stage    string `json:"stage,omitempty"`    // 所属阶段
+	Command  string `json:"command,omitempty"`  // 原始命令
+	Data     string `json:"data,omitempty"`     // 输出内容，包含行尾的换行符
+	ExitCode int    `json:"exitCode,omitempty"` // 退出码
+	Error    string `json:"error,omitempty"`    // 出错信息
+	Success  bool   `json:"success,omitempty"`  // 是否成功，仅end事件有效
+	Position int    `json:"position,omitempty"` // 在队列中的位置，从1开始，仅queued事件有效
+	Attempt  int    `json:"attempt,omitempty"`  // 第几次执行，仅设置了重试时有效
+	Group    int    `json:"group,omitempty"`    // 并行执行的组序号
+}
+
+type EventHandler = func(e Event)
+
+// 单行输出最大长度，超过此长度时不等待换行符直接产生事件
+const maxEventLineSize = 4096
+
+// 将输出按行拆分为事件
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	emit func(line string)
+}
+
+func newLineWriter(emit func(line string)) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			if w.buf.Len() >= maxEventLineSize {
+				w.emit(w.buf.String())
+				w.buf.Reset()
+			}
+			return len(p), nil
+		}
+		w.emit(string(w.buf.Next(i + 1)))
+	}
+}
+
+// 输出剩余的不完整行
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() > 0 {
+		w.emit(w.buf.String())
+		w.buf.Reset()
+	}
+}
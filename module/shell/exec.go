@@ -0,0 +1,409 @@
+package shell
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 执行阶段
+const (
+	StageRun       = "run"
+	StageOnSuccess = "onSuccess"
+	StageOnError   = "onError"
+	StageOnEnd     = "onEnd"
+)
+
+// 单条命令的执行结果
+type StepResult struct {
+	Stage    string `json:"stage"`             // 所属阶段，可选：run, onSuccess, onError, onEnd
+	Command  string `json:"command"`           // 原始命令
+	Stdout   string `json:"stdout"`            // 标准输出
+	Stderr   string `json:"stderr"`            // 标准错误输出
+	ExitCode int    `json:"exitCode"`          // 退出码，命令未能执行时为-1
+	Error    string `json:"error"`             // 出错信息
+	Attempt  int    `json:"attempt,omitempty"` // 第几次执行，仅设置了重试时有效
+	Group    int    `json:"group,omitempty"`   // 并行执行的组序号，从1开始，同一组的命令序号相同
+	Ignored  bool   `json:"ignored,omitempty"` // 执行失败但设置了continueOnError
+
+	StartTime *time.Time `json:"startTime"` // 开始执行的时间
+	EndTime   *time.Time `json:"endTime"`   // 结束时间，未结束时为null
+}
+
+// 整个ExecInfo的执行结果
+type ExecResult struct {
+	Success   bool             `json:"success"`             // 是否成功
+	ExitCode  int              `json:"exitCode"`            // 最终退出码
+	Steps     []StepResult     `json:"steps"`               // 每条命令的执行结果
+	Artifacts []ArtifactResult `json:"artifacts,omitempty"` // 已保存的产物
+	Error     string           `json:"error,omitempty"`     // 命令以外的出错信息，如保存产物失败
+}
+
+type session struct {
+	m           *ModuleShell
+	ctx         context.Context
+	log         logrus.FieldLogger
+	cwd         string            // 当前工作目录，相对于Root并以/开头
+	define      map[string]string // 变量
+	timeout     time.Duration     // run和onSuccess阶段的总超时时间，0表示不限制
+	stepTimeout time.Duration     // 单条命令的超时时间，0表示不限制
+	exitCode    int               // 当前退出码
+	exited      bool              // 是否执行了exit命令
+	trusted     bool              // 是否不受允许执行的命令列表限制
+	credential  *credential       // 外部命令的运行身份，为nil时与tora-server相同
+	limits      ResourceLimits    // 外部命令的资源限制
+	steps       []StepResult
+	onEvent     EventHandler
+	eventMu     sync.Mutex
+	stdin       io.Reader         // 第一条命令的标准输入
+	groups      int               // 已执行的并行组数量
+	secrets     map[string]string // 以环境变量传递给外部命令的密钥
+	masker      *strings.Replacer // 隐藏输出中的密钥，没有密钥时为nil
+}
+
+// 执行命令，仅当参数不合法时返回error，命令执行失败的信息在ExecResult中体现，
+// 如果onEvent不为nil，执行过程中产生的事件会依次传递给onEvent
+func (m *ModuleShell) Exec(ctx context.Context, info ExecInfo, onEvent EventHandler) (ExecResult, error) {
+	s, err := m.newSession(ctx, info, onEvent)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	t, err := m.queue.enqueue(info.Lock, !info.noWait)
+	if err != nil {
+		return ExecResult{}, err
+	}
+	state := newJobState(newJobId(), info)
+	if position := t.position(); position > 0 {
+		s.emit(Event{Type: EventQueued, Position: position})
+	}
+	if err := t.wait(ctx); err != nil {
+		state.Status = JobStatusCanceled
+		state.ExitCode = -1
+		m.saveHistory(state, info.caller)
+		return ExecResult{}, fmt.Errorf("canceled while waiting in queue")
+	}
+	now := time.Now()
+	state.StartTime = &now
+	r := s.exec(info)
+	t.release()
+	state.Status = resultStatus(r, ctx.Err() != nil)
+	state.ExitCode = r.ExitCode
+	state.Steps = r.Steps
+	m.saveHistory(state, info.caller)
+	return r, nil
+}
+
+func (m *ModuleShell) newSession(ctx context.Context, info ExecInfo, onEvent EventHandler) (*session, error) {
+	s := &session{m: m, ctx: ctx, steps: make([]StepResult, 0), onEvent: onEvent}
+	s.log = m.logger()
+	cwd, err := cleanWorkDir(info.CWD)
+	if err != nil {
+		return nil, err
+	}
+	s.cwd = cwd
+	if _, _, err := resolveRealPath(m.Root, "/", s.cwd); err != nil {
+		return nil, err
+	}
+	if err := m.checkArtifacts(info); err != nil {
+		return nil, err
+	}
+	s.stdin = info.stdin
+	s.credential = m.credential
+	s.limits = m.Limits
+	secretFiles := m.Secrets
+	if info.task != nil {
+		s.trusted = true
+		s.credential = info.task.credential
+		s.limits = info.task.limits
+		secretFiles = info.task.secrets
+	}
+	secrets, err := readSecrets(secretFiles)
+	if err != nil {
+		return nil, err
+	}
+	s.secrets = secrets
+	s.masker = newSecretMasker(secrets)
+	if err := checkExecSteps(info.Run, info.OnSuccess, info.OnError, info.OnEnd); err != nil {
+		return nil, err
+	}
+	s.define = make(map[string]string)
+	for k, v := range info.Define {
+		s.define[k] = v
+	}
+	if info.Timeout < 0 || info.StepTimeout < 0 {
+		return nil, fmt.Errorf("invalid timeout")
+	}
+	s.timeout = limitTimeout(time.Duration(info.Timeout)*time.Second, m.MaxTimeout)
+	s.stepTimeout = limitTimeout(time.Duration(info.StepTimeout)*time.Second, m.MaxStepTimeout)
+	return s, nil
+}
+
+// 超时后仍会执行onError和onEnd阶段的命令，这两个阶段共同受CleanupTimeout限制，避免卡住的命令一直占用执行数量
+func (s *session) exec(info ExecInfo) ExecResult {
+	ctx, cancel := withTimeout(s.ctx, s.timeout)
+	ok := s.runStage(ctx, StageRun, info.Run)
+	if ok {
+		s.runStage(ctx, StageOnSuccess, info.OnSuccess)
+	}
+	cancel()
+	ctx, cancel = withTimeout(s.ctx, s.m.CleanupTimeout)
+	if !ok {
+		s.runStage(ctx, StageOnError, info.OnError)
+	}
+	s.runStage(ctx, StageOnEnd, info.OnEnd)
+	cancel()
+	r := ExecResult{Success: s.exitCode == 0, ExitCode: s.exitCode, Steps: s.steps}
+	s.m.finishArtifacts(info, &r)
+	s.emit(Event{Type: EventEnd, Step: len(s.steps), Success: r.Success, ExitCode: r.ExitCode, Error: r.Error})
+	return r
+}
+
+// 产生事件，stdout和stderr可能在不同的goroutine中产生事件，因此需要加锁
+func (s *session) emit(e Event) {
+	if s.onEvent == nil {
+		return
+	}
+	s.eventMu.Lock()
+	defer s.eventMu.Unlock()
+	s.onEvent(e)
+}
+
+// 依次执行步骤，遇到执行失败的步骤或已取消执行则停止并返回false，执行exit命令时以其退出码为准，
+// 设置了continueOnError的步骤失败后继续执行
+func (s *session) runStage(ctx context.Context, stage string, steps []Step) bool {
+	for _, step := range steps {
+		// 已取消执行或已超时
+		if ctx.Err() != nil {
+			if s.exitCode == 0 {
+				s.exitCode = -1
+			}
+			return false
+		}
+		exitCode := s.runStepWithRetries(ctx, stage, step)
+		if s.exited {
+			s.exited = false
+			s.exitCode = exitCode
+			return exitCode == 0
+		}
+		if exitCode != 0 && !step.ContinueOnError {
+			s.exitCode = exitCode
+			return false
+		}
+	}
+	return true
+}
+
+// 添加一条命令的执行结果并产生stepStart事件，返回命令序号
+func (s *session) startStep(stage string, line string, attempt int, group int) int {
+	index := len(s.steps)
+	now := time.Now()
+	s.steps = append(s.steps, StepResult{Stage: stage, Command: line, Attempt: attempt, Group: group, StartTime: &now})
+	s.log.Debugf("exec [%s] %s", stage, line)
+	s.emit(Event{Type: EventStepStart, Step: index, Stage: stage, Command: line, Attempt: attempt, Group: group})
+	return index
+}
+
+// 执行startStep添加的命令，并行执行时每个goroutine仅修改自己的执行结果
+func (s *session) runStep(ctx context.Context, index int) {
+	r := s.steps[index]
+	ctx, cancel := withTimeout(ctx, s.stepTimeout)
+	result := s.runCommand(ctx, index, r)
+	cancel()
+	now := time.Now()
+	result.EndTime = &now
+	s.steps[index] = result
+	s.emit(Event{Type: EventStepEnd, Step: index, Stage: r.Stage, Command: r.Command, ExitCode: result.ExitCode, Error: result.Error, Attempt: r.Attempt, Group: r.Group})
+}
+
+func (s *session) runCommand(ctx context.Context, index int, r StepResult) StepResult {
+	args, err := parseCommandLine(r.Command, s.define)
+	if err != nil {
+		r.ExitCode = -1
+		r.Error = err.Error()
+		return r
+	}
+	if len(args) < 1 {
+		return r
+	}
+	// 会修改执行状态的内部命令不能并行执行
+	if r.Group > 0 && (args[0] == "cd" || args[0] == "exit") {
+		r.ExitCode = -1
+		r.Error = fmt.Sprintf("command [%s] is not supported in parallel", args[0])
+		return r
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	limiter := newOutputLimiter(s.limits.OutputSize, cancel)
+	var stdout, stderr bytes.Buffer
+	stdoutEvents := newLineWriter(func(line string) {
+		s.emit(Event{Type: EventStdout, Step: index, Data: s.mask(line)})
+	})
+	stderrEvents := newLineWriter(func(line string) {
+		s.emit(Event{Type: EventStderr, Step: index, Data: s.mask(line)})
+	})
+	stdoutWriter := limiter.Writer(io.MultiWriter(&stdout, stdoutEvents))
+	stderrWriter := limiter.Writer(io.MultiWriter(&stderr, stderrEvents))
+	if fn, ok := builtinCommands[args[0]]; ok && (s.trusted || containsString(s.m.AllowInternalCommands, args[0])) {
+		if s.credential != nil && builtinReadsFiles[args[0]] {
+			r.ExitCode, err = -1, fmt.Errorf("internal command [%s] not allowed when running as another user", args[0])
+		} else {
+			r.ExitCode, err = fn(ctx, s, args, stdoutWriter, stderrWriter)
+		}
+	} else {
+		r.ExitCode, err = s.runExternal(ctx, args, stdoutWriter, stderrWriter)
+	}
+	// 标准输入仅传递给第一条命令
+	if r.Group == 0 {
+		s.stdin = nil
+	}
+	stdoutEvents.Flush()
+	stderrEvents.Flush()
+	if limiter.Exceeded() {
+		r.ExitCode = -1
+		err = fmt.Errorf("output exceeds limit of %d bytes", s.limits.OutputSize)
+	}
+	r.Stdout = s.mask(stdout.String())
+	r.Stderr = s.mask(stderr.String())
+	if err != nil {
+		r.Error = s.mask(err.Error())
+	}
+	return r
+}
+
+// 执行外部命令，返回退出码，超时或取消时结束其所在的整个进程组
+func (s *session) runExternal(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) (int, error) {
+	if !s.trusted && !containsString(s.m.AllowExternalCommands, args[0]) {
+		return -1, fmt.Errorf("command [%s] not allowed", args[0])
+	}
+	// 工作目录经过符号链接后也不能超出根目录
+	_, dir, err := resolveRealPath(s.m.Root, "/", s.cwd)
+	if err != nil {
+		return -1, err
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Env = s.env()
+	for k, v := range s.secrets {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+	if s.credential != nil {
+		setCredential(cmd, s.credential)
+	}
+	if s.limits.hasRlimit() {
+		if err := setResourceLimits(cmd, s.limits); err != nil {
+			return -1, err
+		}
+	}
+	var stdin io.WriteCloser
+	if s.stdin != nil {
+		if stdin, err = cmd.StdinPipe(); err != nil {
+			return -1, err
+		}
+	}
+	if err := cmd.Start(); err != nil {
+		return -1, err
+	}
+	if stdin != nil {
+		// 进程退出时管道会被关闭，不需要等待复制结束
+		go func(r io.Reader) {
+			io.Copy(stdin, r)
+			stdin.Close()
+		}(s.stdin)
+		s.stdin = nil
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.terminate(cmd.Process, done)
+		case <-done:
+		}
+	}()
+	err = cmd.Wait()
+	close(done)
+	if ctx.Err() == context.DeadlineExceeded {
+		return -1, fmt.Errorf("killed after timeout")
+	}
+	if err != nil {
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() >= 0 {
+			return e.ExitCode(), nil
+		}
+		return -1, err
+	}
+	return 0, nil
+}
+
+// 结束进程组，先发送SIGTERM信号，如果超时后仍未退出则发送SIGKILL信号
+func (s *session) terminate(p *os.Process, done chan struct{}) {
+	s.log.Debugf("terminate process group %d", p.Pid)
+	if err := terminateProcessGroup(p); err != nil {
+		killProcessGroup(p)
+		return
+	}
+	select {
+	case <-done:
+	case <-time.After(s.m.KillGracePeriod):
+		s.log.Debugf("kill process group %d", p.Pid)
+		killProcessGroup(p)
+	}
+}
+
+// 子进程的环境变量，依次为继承的环境变量、模块配置的Env、运行身份和define中定义的变量，不包括密钥。
+// 仅预先定义的任务的define（任务的env和参数）作为环境变量传递，直接执行时的define由客户端指定，
+// 只用于替换命令中的变量，避免覆盖CleanEnv、AllowEnv和Env控制的变量，如 PATH、LD_PRELOAD
+func (s *session) env() []string {
+	env := s.m.inheritedEnv()
+	for k, v := range s.m.Env {
+		env = append(env, k+"="+v)
+	}
+	if s.credential != nil {
+		env = append(env, "USER="+s.credential.name, "LOGNAME="+s.credential.name, "HOME="+s.credential.home)
+	}
+	if !s.trusted {
+		return env
+	}
+	for k, v := range s.define {
+		env = append(env, k+"="+v)
+	}
+	return env
+}
+
+// 如果max大于0，则超时时间不能超过max，未指定超时时间时使用max
+func limitTimeout(t time.Duration, max time.Duration) time.Duration {
+	if max > 0 && (t <= 0 || t > max) {
+		return max
+	}
+	return t
+}
+
+// 如果t大于0则创建带超时的context，否则仅创建可取消的context
+func withTimeout(ctx context.Context, t time.Duration) (context.Context, context.CancelFunc) {
+	if t > 0 {
+		return context.WithTimeout(ctx, t)
+	}
+	return context.WithCancel(ctx)
+}
+
+// 执行成功后保存产物，保存失败时视为执行失败
+func (m *ModuleShell) finishArtifacts(info ExecInfo, r *ExecResult) {
+	if !r.Success || len(info.ArtifactsTo) < 1 {
+		return
+	}
+	artifacts, err := m.saveArtifacts(info)
+	r.Artifacts = artifacts
+	if err != nil {
+		r.Success = false
+		r.ExitCode = -1
+		r.Error = err.Error()
+	}
+}
@@ -0,0 +1,265 @@
+package shell
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 默认每条命令在历史记录中保留的输出字节数
+const DefaultHistoryOutputSize = 64 * 1024
+
+// 默认执行记录的最长保留时间
+const DefaultHistoryMaxAge = 30 * 24 * time.Hour
+
+// 默认执行记录的最大总字节数
+const DefaultHistoryMaxSize = 100 * 1024 * 1024
+
+// 发起执行的客户端
+type Caller struct {
+	Token    string   // 请求使用的token，未通过token授权时为空
+	IP       string   // 客户端IP
+	Modules  []string // 允许访问的模块
+	Schedule string   // 由定时任务发起时为定时任务名称
+}
+
+// 未使用token（通过IP白名单授权）的客户端可以查看所有客户端发起的任务，否则仅能查看自己发起的任务
+func (c Caller) privileged() bool {
+	return len(c.Token) < 1
+}
+
+// 是否可以查看或取消使用token发起的任务，规则与任务列表相同：未使用token的客户端、相同token或者定时任务发起的任务
+func (c Caller) canAccess(token string, schedule string) bool {
+	return c.privileged() || c.Token == token || len(schedule) > 0
+}
+
+// 与 canAccess 相同，用于只保存了token摘要的执行记录
+func (c Caller) canAccessRecord(r *historyRecord) bool {
+	return c.privileged() || hashToken(c.Token) == r.TokenHash || len(r.Schedule) > 0
+}
+
+// 保存在磁盘上的执行记录
+type historyRecord struct {
+	JobState
+	TokenHash string `json:"tokenHash"` // token的sha256，用于按token查询
+}
+
+// 执行记录，每次执行保存为一个JSON文件，文件名为 <提交时间的纳秒数>-<ID>.json
+type historyStore struct {
+	mu         sync.Mutex
+	dir        string
+	summaries  map[string]historyRecord // 已读取过的记录文件对应的不包含输出的记录，避免每次查询都重新解析
+	maxAge     time.Duration            // 最长保留时间，小于等于0表示不限制
+	maxSize    int64                    // 所有记录的最大总字节数，小于等于0表示不限制
+	outputSize int                      // 每条命令保留的输出字节数
+}
+
+func newHistoryStore(dir string, maxAge time.Duration, maxSize int64, outputSize int) (*historyStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &historyStore{dir: dir, summaries: make(map[string]historyRecord), maxAge: maxAge, maxSize: maxSize, outputSize: outputSize}, nil
+}
+
+func hashToken(token string) string {
+	if len(token) < 1 {
+		return ""
+	}
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// 仅保留输出末尾的内容，出错信息通常在最后
+func truncateOutput(s string, size int) string {
+	if size <= 0 || len(s) <= size {
+		return s
+	}
+	return fmt.Sprintf("...(truncated %d bytes)\n", len(s)-size) + s[len(s)-size:]
+}
+
+func (h *historyStore) add(state JobState, caller Caller) error {
+	steps := make([]StepResult, len(state.Steps))
+	for i, v := range state.Steps {
+		v.Stdout = truncateOutput(v.Stdout, h.outputSize)
+		v.Stderr = truncateOutput(v.Stderr, h.outputSize)
+		steps[i] = v
+	}
+	state.Steps = steps
+	b, err := json.Marshal(historyRecord{JobState: state, TokenHash: hashToken(caller.Token)})
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	name := fmt.Sprintf("%d-%s.json", state.CreateTime.UnixNano(), state.ID)
+	tmp := filepath.Join(h.dir, "."+name)
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, filepath.Join(h.dir, name)); err != nil {
+		return err
+	}
+	return h.removeExpired()
+}
+
+type historyFile struct {
+	name    string
+	id      string
+	created time.Time
+	size    int64
+}
+
+// 按提交时间排序的记录文件
+func (h *historyStore) files() ([]historyFile, error) {
+	list, err := ioutil.ReadDir(h.dir)
+	if err != nil {
+		return nil, err
+	}
+	files := make([]historyFile, 0, len(list))
+	for _, v := range list {
+		name := v.Name()
+		if v.IsDir() || !strings.HasSuffix(name, ".json") || strings.HasPrefix(name, ".") {
+			continue
+		}
+		i := strings.Index(name, "-")
+		if i < 0 {
+			continue
+		}
+		n, err := strconv.ParseInt(name[:i], 10, 64)
+		if err != nil {
+			continue
+		}
+		files = append(files, historyFile{
+			name:    name,
+			id:      strings.TrimSuffix(name[i+1:], ".json"),
+			created: time.Unix(0, n),
+			size:    v.Size(),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].created.Before(files[j].created)
+	})
+	return files, nil
+}
+
+// 删除超过保留时间的记录，以及超出总大小限制时最早的记录
+func (h *historyStore) removeExpired() error {
+	files, err := h.files()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	for _, f := range files {
+		expired := h.maxAge > 0 && time.Since(f.created) > h.maxAge
+		oversize := h.maxSize > 0 && total > h.maxSize
+		if !expired && !oversize {
+			break
+		}
+		if err := os.Remove(filepath.Join(h.dir, f.name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(h.summaries, f.name)
+		total -= f.size
+	}
+	return nil
+}
+
+func (h *historyStore) read(name string) (historyRecord, error) {
+	r := historyRecord{}
+	b, err := ioutil.ReadFile(filepath.Join(h.dir, name))
+	if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(b, &r)
+	return r, err
+}
+
+// 查询提交时间不早于since的记录，不包含命令的输出，token不为空时仅返回使用该token发起的记录，
+// withSchedules为true时同时返回定时任务发起的记录。
+// 记录文件写入后不再改变，因此仅在第一次读取时解析，且解析时不持有锁
+func (h *historyStore) list(since time.Time, token string, withSchedules bool) ([]JobState, error) {
+	h.mu.Lock()
+	files, err := h.files()
+	if err == nil {
+		h.pruneSummaries(files)
+	}
+	h.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	tokenHash := hashToken(token)
+	list := make([]JobState, 0)
+	for _, f := range files {
+		if f.created.Before(since) {
+			continue
+		}
+		h.mu.Lock()
+		r, ok := h.summaries[f.name]
+		h.mu.Unlock()
+		if !ok {
+			r, err = h.read(f.name)
+			// 读取前已被删除
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			r.Steps = nil
+			r.Artifacts = nil
+			h.mu.Lock()
+			h.summaries[f.name] = r
+			h.mu.Unlock()
+		}
+		if len(tokenHash) > 0 && r.TokenHash != tokenHash && !(withSchedules && len(r.Schedule) > 0) {
+			continue
+		}
+		list = append(list, r.JobState)
+	}
+	return list, nil
+}
+
+// 删除已不存在的记录文件对应的缓存，如在读取过程中被删除的记录
+func (h *historyStore) pruneSummaries(files []historyFile) {
+	exists := make(map[string]bool, len(files))
+	for _, f := range files {
+		exists[f.name] = true
+	}
+	for name := range h.summaries {
+		if !exists[name] {
+			delete(h.summaries, name)
+		}
+	}
+}
+
+// 获取指定ID的记录，不存在时返回nil
+func (h *historyStore) get(id string) (*historyRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	files, err := h.files()
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.id == id {
+			r, err := h.read(f.name)
+			if err != nil {
+				return nil, err
+			}
+			return &r, nil
+		}
+	}
+	return nil, nil
+}
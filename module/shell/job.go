@@ -0,0 +1,304 @@
+package shell
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/leizongmin/tora/common"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 任务状态
+const (
+	JobStatusQueued   = "queued"
+	JobStatusRunning  = "running"
+	JobStatusSuccess  = "success"
+	JobStatusFailed   = "failed"
+	JobStatusCanceled = "canceled"
+)
+
+// 默认保留的已结束任务数量
+const DefaultMaxFinishedJobs = 100
+
+// 异步执行的任务
+type Job struct {
+	ID        string
+	mu        sync.Mutex
+	state     JobState
+	cancel    context.CancelFunc
+	canceled  bool
+	completed bool // 已执行完毕，此后不能再取消
+	created   time.Time
+	ticket    *ticket
+}
+
+// 任务的当前状态
+type JobState struct {
+	ID            string           `json:"id"`                      // 任务ID
+	Status        string           `json:"status"`                  // 状态，可选：queued, running, success, failed, canceled
+	QueuePosition int              `json:"queuePosition,omitempty"` // 在队列中的位置，从1开始，仅queued状态有效
+	Info          ExecInfo         `json:"info"`                    // 执行参数
+	Token         string           `json:"token,omitempty"`         // 发起执行时使用的token，仅显示首尾部分
+	IP            string           `json:"ip,omitempty"`            // 发起执行的客户端IP
+	Schedule      string           `json:"schedule,omitempty"`      // 由定时任务发起时为定时任务名称
+	CreateTime    time.Time        `json:"createTime"`              // 提交时间
+	StartTime     *time.Time       `json:"startTime"`               // 开始执行的时间，排队中为null
+	EndTime       *time.Time       `json:"endTime"`                 // 结束时间，未结束时为null
+	ExitCode      int              `json:"exitCode"`                // 退出码
+	Steps         []StepResult     `json:"steps"`                   // 已执行命令的结果，执行中的命令包含当前已产生的输出
+	Artifacts     []ArtifactResult `json:"artifacts,omitempty"`     // 已保存的产物
+	Error         string           `json:"error,omitempty"`         // 命令以外的出错信息
+}
+
+type jobManager struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	max  int
+}
+
+func newJobManager(max int) *jobManager {
+	return &jobManager{jobs: make(map[string]*Job), max: max}
+}
+
+// 异步执行命令，任务不受发起请求的客户端断开连接影响，仅当参数不合法时返回error
+func (m *ModuleShell) StartJob(info ExecInfo) (*Job, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &Job{ID: newJobId(), cancel: cancel}
+	job.state = newJobState(job.ID, info)
+	job.created = job.state.CreateTime
+	s, err := m.newSession(ctx, info, job.handleEvent)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	t, err := m.queue.enqueue(info.Lock, !info.noWait)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	job.ticket = t
+	if t.position() > 0 {
+		job.state.Status = JobStatusQueued
+	} else {
+		job.start()
+	}
+	m.jobs.add(job)
+	go func() {
+		defer cancel()
+		// 排队时被取消
+		if err := t.wait(ctx); err != nil {
+			job.finish(ExecResult{ExitCode: -1, Steps: make([]StepResult, 0)})
+		} else {
+			job.start()
+			r := s.exec(info)
+			job.complete()
+			t.release()
+			job.finish(r)
+		}
+		m.saveHistory(job.State(), info.caller)
+		m.jobs.removeExpired()
+	}()
+	return job, nil
+}
+
+// 获取指定任务，不存在时返回nil
+func (m *ModuleShell) GetJob(id string) *Job {
+	return m.jobs.get(id)
+}
+
+// 获取所有任务，按开始时间排序
+func (m *ModuleShell) ListJobs() []*Job {
+	return m.jobs.list()
+}
+
+// 获取提交时间不早于since的任务状态，包括内存中的任务和已保存的执行记录，按提交时间排序，
+// token不为空时仅返回使用该token发起的任务，withSchedules为true时同时返回定时任务发起的任务，
+// 已保存的执行记录不包含命令的输出
+func (m *ModuleShell) ListJobStates(since time.Time, token string, withSchedules bool) ([]JobState, error) {
+	states := make(map[string]JobState)
+	if m.history != nil {
+		list, err := m.history.list(since, token, withSchedules)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list {
+			states[v.ID] = v
+		}
+	}
+	for _, job := range m.jobs.list() {
+		if job.created.Before(since) {
+			continue
+		}
+		if len(token) > 0 && job.state.Info.caller.Token != token && !(withSchedules && len(job.state.Schedule) > 0) {
+			continue
+		}
+		states[job.ID] = job.State()
+	}
+	list := make([]JobState, 0, len(states))
+	for _, v := range states {
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime.Before(list[j].CreateTime)
+	})
+	return list, nil
+}
+
+// 保存执行记录，失败时仅输出日志
+func (m *ModuleShell) saveHistory(state JobState, caller Caller) {
+	if m.history == nil {
+		return
+	}
+	if err := m.history.add(state, caller); err != nil {
+		m.logger().Errorf("save shell history [%s] failed: %s", state.ID, err)
+	}
+}
+
+func newJobState(id string, info ExecInfo) JobState {
+	return JobState{
+		ID:         id,
+		Status:     JobStatusQueued,
+		Info:       info,
+		Token:      common.MaskToken(info.caller.Token),
+		IP:         info.caller.IP,
+		Schedule:   info.caller.Schedule,
+		CreateTime: time.Now(),
+		Steps:      make([]StepResult, 0),
+	}
+}
+
+// 取消时已执行成功的任务不受影响，仍为success
+func resultStatus(r ExecResult, canceled bool) string {
+	switch {
+	case canceled && !r.Success:
+		return JobStatusCanceled
+	case r.Success:
+		return JobStatusSuccess
+	default:
+		return JobStatusFailed
+	}
+}
+
+func (j *Job) start() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state.StartTime == nil {
+		now := time.Now()
+		j.state.StartTime = &now
+		j.state.Status = JobStatusRunning
+	}
+}
+
+// 执行过程中更新任务的输出
+func (j *Job) handleEvent(e Event) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	switch e.Type {
+	case EventStepStart:
+		j.state.Steps = append(j.state.Steps, StepResult{Stage: e.Stage, Command: e.Command, Attempt: e.Attempt, Group: e.Group, StartTime: &now})
+	case EventStdout:
+		j.state.Steps[e.Step].Stdout += e.Data
+	case EventStderr:
+		j.state.Steps[e.Step].Stderr += e.Data
+	case EventStepEnd:
+		j.state.Steps[e.Step].ExitCode = e.ExitCode
+		j.state.Steps[e.Step].Error = e.Error
+		j.state.Steps[e.Step].EndTime = &now
+	}
+}
+
+// 标记已执行完毕，避免在执行结束后、更新状态前取消任务导致成功的任务被标记为已取消
+func (j *Job) complete() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.completed = true
+}
+
+func (j *Job) finish(r ExecResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.state.EndTime = &now
+	j.state.ExitCode = r.ExitCode
+	j.state.Steps = r.Steps
+	j.state.Artifacts = r.Artifacts
+	j.state.Error = r.Error
+	j.state.Status = resultStatus(r, j.canceled)
+}
+
+// 取消任务，排队中的任务直接离开队列，正在执行的命令会先收到SIGTERM信号，超时后再发送SIGKILL信号，
+// 如果任务已经结束则返回false
+func (j *Job) Cancel() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.completed || (j.state.Status != JobStatusRunning && j.state.Status != JobStatusQueued) {
+		return false
+	}
+	j.canceled = true
+	j.cancel()
+	return true
+}
+
+// 获取任务当前状态的副本
+func (j *Job) State() JobState {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state := j.state
+	if state.Status == JobStatusQueued {
+		state.QueuePosition = j.ticket.position()
+	}
+	state.Steps = make([]StepResult, len(j.state.Steps))
+	copy(state.Steps, j.state.Steps)
+	return state
+}
+
+func (jm *jobManager) add(job *Job) {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	jm.jobs[job.ID] = job
+}
+
+func (jm *jobManager) get(id string) *Job {
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	return jm.jobs[id]
+}
+
+func (jm *jobManager) list() []*Job {
+	jm.mu.Lock()
+	list := make([]*Job, 0, len(jm.jobs))
+	for _, v := range jm.jobs {
+		list = append(list, v)
+	}
+	jm.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].created.Before(list[j].created)
+	})
+	return list
+}
+
+// 删除超出保留数量的已结束任务，优先删除最早的任务
+func (jm *jobManager) removeExpired() {
+	finished := make([]string, 0)
+	for _, v := range jm.list() {
+		if v.State().EndTime != nil {
+			finished = append(finished, v.ID)
+		}
+	}
+	jm.mu.Lock()
+	defer jm.mu.Unlock()
+	for i := 0; i < len(finished)-jm.max; i++ {
+		delete(jm.jobs, finished[i])
+	}
+}
+
+func newJobId() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,155 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"os/user"
+	"strconv"
+	"sync"
+)
+
+// 最大虚拟内存限制的最小值，过小时动态链接的命令（如sh）无法加载共享库
+const MinAddressSpace = 16 * 1024 * 1024
+
+// 子进程的资源限制，0表示不限制
+type ResourceLimits struct {
+	CPUSeconds   uint64 // 最大CPU时间（秒），RLIMIT_CPU
+	AddressSpace uint64 // 最大虚拟内存（字节），RLIMIT_AS，不能小于MinAddressSpace
+	OpenFiles    uint64 // 最多打开的文件数量，RLIMIT_NOFILE
+	MaxProcesses uint64 // 运行身份对应的用户最多的进程数量，RLIMIT_NPROC
+	OutputSize   int64  // 单条命令标准输出和标准错误输出的总字节数，超过后结束该命令
+}
+
+// 合并资源限制，l中不为0的项优先
+func (l ResourceLimits) merge(base ResourceLimits) ResourceLimits {
+	if l.CPUSeconds == 0 {
+		l.CPUSeconds = base.CPUSeconds
+	}
+	if l.AddressSpace == 0 {
+		l.AddressSpace = base.AddressSpace
+	}
+	if l.OpenFiles == 0 {
+		l.OpenFiles = base.OpenFiles
+	}
+	if l.MaxProcesses == 0 {
+		l.MaxProcesses = base.MaxProcesses
+	}
+	if l.OutputSize == 0 {
+		l.OutputSize = base.OutputSize
+	}
+	return l
+}
+
+// 是否需要通过setrlimit设置的限制项
+func (l ResourceLimits) hasRlimit() bool {
+	return l.CPUSeconds > 0 || l.AddressSpace > 0 || l.OpenFiles > 0 || l.MaxProcesses > 0
+}
+
+// 子进程的运行身份
+type credential struct {
+	uid    uint32
+	gid    uint32
+	groups []uint32
+	name   string
+	home   string
+}
+
+// 根据用户名和组名获取运行身份，如果未指定组名则使用该用户的主组
+func lookupCredential(username string, groupname string) (*credential, error) {
+	if len(username) < 1 {
+		if len(groupname) > 0 {
+			return nil, fmt.Errorf("runAsGroup requires runAsUser")
+		}
+		return nil, nil
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, err
+	}
+	c := &credential{name: u.Username, home: u.HomeDir}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported uid [%s] of user [%s]", u.Uid, username)
+	}
+	c.uid = uint32(uid)
+	gidStr := u.Gid
+	if len(groupname) > 0 {
+		g, err := user.LookupGroup(groupname)
+		if err != nil {
+			return nil, err
+		}
+		gidStr = g.Gid
+	}
+	gid, err := strconv.ParseUint(gidStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported gid [%s] of group [%s]", gidStr, groupname)
+	}
+	c.gid = uint32(gid)
+	if len(groupname) < 1 {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range ids {
+			if n, err := strconv.ParseUint(v, 10, 32); err == nil {
+				c.groups = append(c.groups, uint32(n))
+			}
+		}
+	}
+	return c, nil
+}
+
+// 限制输出的总字节数，超过后丢弃后续的输出并调用onExceed
+type outputLimiter struct {
+	mu       sync.Mutex
+	limit    int64
+	size     int64
+	exceeded bool
+	onExceed func()
+}
+
+func newOutputLimiter(limit int64, onExceed func()) *outputLimiter {
+	return &outputLimiter{limit: limit, onExceed: onExceed}
+}
+
+func (l *outputLimiter) Writer(w io.Writer) io.Writer {
+	if l.limit <= 0 {
+		return w
+	}
+	return &limitedWriter{l: l, w: w}
+}
+
+func (l *outputLimiter) Exceeded() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.exceeded
+}
+
+type limitedWriter struct {
+	l *outputLimiter
+	w io.Writer
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.l.mu.Lock()
+	n := int64(len(p))
+	if w.l.size+n > w.l.limit {
+		n = w.l.limit - w.l.size
+	}
+	w.l.size += n
+	exceeded := !w.l.exceeded && n < int64(len(p))
+	if exceeded {
+		w.l.exceeded = true
+	}
+	w.l.mu.Unlock()
+	if n > 0 {
+		if _, err := w.w.Write(p[:n]); err != nil {
+			return 0, err
+		}
+	}
+	if exceeded {
+		w.l.onExceed()
+	}
+	// 超出部分直接丢弃，以免子进程因为输出阻塞而无法结束
+	return len(p), nil
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package shell
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// 在新的进程组中启动子进程，以便结束时能够同时结束其产生的所有子进程
+func setProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+func checkCredentialSupported() error {
+	return nil
+}
+
+// 以指定的用户和组身份启动子进程，需要tora-server以root身份运行
+func setCredential(cmd *exec.Cmd, c *credential) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: c.uid, Gid: c.gid, Groups: c.groups}
+}
+
+func terminateProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGTERM)
+}
+
+func killProcessGroup(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,26 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// Windows不支持进程组，仅结束子进程本身
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+func checkCredentialSupported() error {
+	return fmt.Errorf("runAsUser is not supported on windows")
+}
+
+func setCredential(cmd *exec.Cmd, c *credential) {
+}
+
+func terminateProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
+
+func killProcessGroup(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,251 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/creack/pty"
+	"github.com/gorilla/websocket"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"github.com/sirupsen/logrus"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 伪终端控制消息类型
+const (
+	PtyMessageResize = "resize" // 客户端调整终端大小
+	PtyMessageExit   = "exit"   // 服务器通知进程已退出
+)
+
+// 伪终端的控制消息，以WebSocket文本消息传递，终端的输入输出以二进制消息传递
+type PtyMessage struct {
+	Type     string `json:"type"`            // 消息类型
+	Cols     uint16 `json:"cols,omitempty"`  // 终端列数，仅resize消息有效
+	Rows     uint16 `json:"rows,omitempty"`  // 终端行数，仅resize消息有效
+	ExitCode int    `json:"exitCode"`        // 退出码，仅exit消息有效
+	Error    string `json:"error,omitempty"` // 出错信息，仅exit消息有效
+}
+
+// 伪终端的进程被结束的原因
+const (
+	ptyStopTimeout = "timeout" // 超过最大超时时间
+	ptyStopClosed  = "closed"  // 客户端断开连接或无法写入终端
+)
+
+var ptyUpgrader = websocket.Upgrader{ReadBufferSize: 4096, WriteBufferSize: 4096}
+
+// 在伪终端中执行命令，通过WebSocket转发输入输出，客户端断开连接时结束进程
+func (m *ModuleShell) handlePty(ctx *web.Context, caller Caller) {
+	if ctx.Req.Method != "GET" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	query := ctx.Req.URL.Query()
+	command := query.Get("command")
+	if len(command) < 1 {
+		common.ResponseApiError(ctx, "missing command", nil)
+		return
+	}
+	if !containsString(m.AllowPtyCommands, command) {
+		common.ResponseApiErrorWithStatusCode(ctx, 403, fmt.Sprintf("command [%s] not allowed", command), nil)
+		return
+	}
+	cols, rows, err := parseTerminalSize(query.Get("cols"), query.Get("rows"))
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	info := ExecInfo{
+		CWD:    query.Get("cwd"),
+		Run:    CommandSteps(strings.Join(append([]string{command}, query["arg"]...), " ")),
+		caller: caller,
+	}
+	s, err := m.newSession(ctx.Req.Context(), info, nil)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	_, dir, err := resolveRealPath(m.Root, "/", s.cwd)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	term := query.Get("term")
+	if len(term) < 1 {
+		term = "xterm"
+	}
+
+	cmd := exec.Command(command, query["arg"]...)
+	cmd.Dir = dir
+	cmd.Env = append(s.env(), "TERM="+term)
+	if s.credential != nil {
+		setCredential(cmd, s.credential)
+	}
+	if s.limits.hasRlimit() {
+		if err := setResourceLimits(cmd, s.limits); err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+	}
+	// 伪终端与其他执行一样占用执行数量，由于需要交互，不能立即执行时不排队而是返回409
+	t, err := m.queue.enqueue("", false)
+	if err != nil {
+		responseExecError(ctx, err)
+		return
+	}
+	defer t.release()
+	state := newJobState(newJobId(), info)
+	f, err := pty.StartWithSize(cmd, &pty.Winsize{Cols: cols, Rows: rows})
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	defer f.Close()
+	now := time.Now()
+	state.StartTime = &now
+	state.Status = JobStatusRunning
+	done := make(chan struct{})
+
+	// 结束进程的原因，为空表示进程自行退出
+	var stopMu sync.Mutex
+	var stopReason string
+	stop := func(reason string) {
+		stopMu.Lock()
+		if len(stopReason) < 1 {
+			stopReason = reason
+		}
+		stopMu.Unlock()
+		select {
+		case <-done:
+		default:
+			s.terminate(cmd.Process, done)
+		}
+	}
+	if m.MaxTimeout > 0 {
+		timer := time.AfterFunc(m.MaxTimeout, func() { stop(ptyStopTimeout) })
+		defer timer.Stop()
+	}
+
+	conn, err := ptyUpgrader.Upgrade(ctx.Res, ctx.Req, nil)
+	if err != nil {
+		ctx.Log.Warnf("upgrade to websocket failed: %s", err)
+		killProcessGroup(cmd.Process)
+		cmd.Wait()
+		close(done)
+		m.savePtyHistory(state, -1, err.Error(), JobStatusCanceled)
+		return
+	}
+	defer conn.Close()
+	ctx.Log.WithFields(logrus.Fields{"command": command, "pid": cmd.Process.Pid, "ip": caller.IP, "job": state.ID}).Info("pty started")
+
+	var writeMu sync.Mutex
+	writeMessage := func(messageType int, data []byte) error {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		return conn.WriteMessage(messageType, data)
+	}
+
+	// 转发客户端的输入，连接断开或无法写入终端时结束进程
+	go func() {
+		for {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				stop(ptyStopClosed)
+				return
+			}
+			switch messageType {
+			case websocket.BinaryMessage:
+				if _, err := f.Write(data); err != nil {
+					stop(ptyStopClosed)
+					return
+				}
+			case websocket.TextMessage:
+				msg := PtyMessage{}
+				if err := json.Unmarshal(data, &msg); err != nil {
+					ctx.Log.Debugf("invalid pty message: %s", err)
+					continue
+				}
+				if msg.Type == PtyMessageResize && msg.Cols > 0 && msg.Rows > 0 {
+					pty.Setsize(f, &pty.Winsize{Cols: msg.Cols, Rows: msg.Rows})
+				}
+			}
+		}
+	}()
+
+	// 转发终端的输出，进程退出后读取会返回错误
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if err := writeMessage(websocket.BinaryMessage, buf[:n]); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	exit := PtyMessage{Type: PtyMessageExit}
+	if err := cmd.Wait(); err != nil {
+		exit.ExitCode = -1
+		if e, ok := err.(*exec.ExitError); ok && e.ExitCode() >= 0 {
+			exit.ExitCode = e.ExitCode()
+		} else {
+			exit.Error = err.Error()
+		}
+	}
+	close(done)
+	stopMu.Lock()
+	reason := stopReason
+	stopMu.Unlock()
+	status := JobStatusSuccess
+	switch {
+	case reason == ptyStopTimeout:
+		exit.ExitCode = -1
+		exit.Error = "killed after timeout"
+		status = JobStatusFailed
+	case reason == ptyStopClosed:
+		status = JobStatusCanceled
+	case exit.ExitCode != 0:
+		status = JobStatusFailed
+	}
+	m.savePtyHistory(state, exit.ExitCode, exit.Error, status)
+	ctx.Log.WithField("exitCode", exit.ExitCode).Info("pty exited")
+	if b, err := json.Marshal(exit); err == nil {
+		writeMessage(websocket.TextMessage, b)
+	}
+	writeMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+}
+
+// 保存伪终端的执行记录，交互的输入输出可能包含敏感信息，因此不保存输出
+func (m *ModuleShell) savePtyHistory(state JobState, exitCode int, err string, status string) {
+	now := time.Now()
+	state.EndTime = &now
+	state.ExitCode = exitCode
+	state.Status = status
+	state.Steps = []StepResult{{Stage: StageRun, Command: state.Info.Run[0].Command, ExitCode: exitCode, Error: err, StartTime: state.StartTime, EndTime: &now}}
+	m.saveHistory(state, state.Info.caller)
+}
+
+// 终端大小，未指定时为80x24
+func parseTerminalSize(cols string, rows string) (uint16, uint16, error) {
+	c, r := uint64(80), uint64(24)
+	var err error
+	if len(cols) > 0 {
+		if c, err = strconv.ParseUint(cols, 10, 16); err != nil || c == 0 {
+			return 0, 0, fmt.Errorf("invalid cols [%s]", cols)
+		}
+	}
+	if len(rows) > 0 {
+		if r, err = strconv.ParseUint(rows, 10, 16); err != nil || r == 0 {
+			return 0, 0, fmt.Errorf("invalid rows [%s]", rows)
+		}
+	}
+	return uint16(c), uint16(r), nil
+}
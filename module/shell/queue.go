@@ -0,0 +1,142 @@
+package shell
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// 无法立即执行且不等待时返回的错误
+type busyError string
+
+func (e busyError) Error() string {
+	return string(e)
+}
+
+// 按提交顺序调度执行，同时执行的数量不超过max，持有相同锁的执行不会同时进行
+type scheduler struct {
+	mu      sync.Mutex
+	max     int             // 最多同时执行的数量，0表示不限制
+	running int             // 正在执行的数量
+	locks   map[string]bool // 已被持有的锁
+	waiting []*ticket       // 等待执行的队列
+}
+
+// 一次执行的排队凭证
+type ticket struct {
+	s        *scheduler
+	lock     string
+	ready    chan struct{}
+	acquired bool
+}
+
+func newScheduler(max int) *scheduler {
+	return &scheduler{max: max, locks: make(map[string]bool)}
+}
+
+// 申请执行，如果不能立即执行则进入队列末尾，wait为false时不进入队列而是返回busyError
+func (s *scheduler) enqueue(lock string, wait bool) (*ticket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := &ticket{s: s, lock: lock, ready: make(chan struct{})}
+	if s.available(lock) {
+		s.take(t)
+		return t, nil
+	}
+	if !wait {
+		if len(lock) > 0 && s.locks[lock] {
+			return nil, busyError(fmt.Sprintf("lock [%s] is held by another execution", lock))
+		}
+		return nil, busyError("too many concurrent executions")
+	}
+	s.waiting = append(s.waiting, t)
+	return t, nil
+}
+
+func (s *scheduler) available(lock string) bool {
+	if s.max > 0 && s.running >= s.max {
+		return false
+	}
+	return len(lock) < 1 || !s.locks[lock]
+}
+
+func (s *scheduler) take(t *ticket) {
+	s.running++
+	if len(t.lock) > 0 {
+		s.locks[t.lock] = true
+	}
+	t.acquired = true
+	close(t.ready)
+}
+
+// 按顺序启动队列中可以执行的项，先提交的优先
+func (s *scheduler) dispatch() {
+	waiting := s.waiting[:0]
+	for _, t := range s.waiting {
+		if s.available(t.lock) {
+			s.take(t)
+		} else {
+			waiting = append(waiting, t)
+		}
+	}
+	for i := len(waiting); i < len(s.waiting); i++ {
+		s.waiting[i] = nil
+	}
+	s.waiting = waiting
+}
+
+// 等待轮到执行，ctx结束时离开队列并返回error
+func (t *ticket) wait(ctx context.Context) error {
+	select {
+	case <-t.ready:
+		return nil
+	case <-ctx.Done():
+	}
+	s := t.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t.acquired {
+		// 在ctx结束的同时轮到执行
+		t.releaseLocked()
+		return ctx.Err()
+	}
+	for i, v := range s.waiting {
+		if v == t {
+			s.waiting = append(s.waiting[:i], s.waiting[i+1:]...)
+			break
+		}
+	}
+	s.dispatch()
+	return ctx.Err()
+}
+
+// 执行结束后释放，使队列中的下一项得以执行
+func (t *ticket) release() {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	t.releaseLocked()
+}
+
+func (t *ticket) releaseLocked() {
+	if !t.acquired {
+		return
+	}
+	t.acquired = false
+	t.s.running--
+	if len(t.lock) > 0 {
+		delete(t.s.locks, t.lock)
+	}
+	t.s.dispatch()
+}
+
+// 在队列中的位置，从1开始，已开始执行时为0
+func (t *ticket) position() int {
+	t.s.mu.Lock()
+	defer t.s.mu.Unlock()
+	for i, v := range t.s.waiting {
+		if v == t {
+			return i + 1
+		}
+	}
+	return 0
+}
@@ -0,0 +1,83 @@
+package shell
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const rlimitNproc = 6
+
+// 通过此环境变量通知重新执行的当前程序先设置资源限制，再执行真正的命令
+const rlimitEnvName = "TORA_SHELL_RLIMIT"
+
+// 是否已调用RunResourceLimitHelper，未调用时重新执行当前程序无法设置资源限制
+var resourceLimitHelperReady bool
+
+// 设置资源限制需要重新执行当前程序，使用资源限制的程序需要在main函数的开头调用此函数：
+// 如果当前进程是为设置资源限制而重新执行的，设置后直接exec真正的命令，不会返回
+func RunResourceLimitHelper() {
+	if v, ok := os.LookupEnv(rlimitEnvName); ok {
+		execWithResourceLimits(v)
+	}
+	resourceLimitHelperReady = true
+}
+
+func checkResourceLimitsSupported(l ResourceLimits) error {
+	if l.hasRlimit() && !resourceLimitHelperReady {
+		return fmt.Errorf("resource limits require calling shell.RunResourceLimitHelper() at the beginning of main")
+	}
+	if l.AddressSpace > 0 && l.AddressSpace < MinAddressSpace {
+		return fmt.Errorf("address space limit must be at least %d bytes", MinAddressSpace)
+	}
+	return nil
+}
+
+// 由于Go无法在fork和exec之间设置资源限制，因此改为执行当前程序本身，
+// 由其设置资源限制后再exec真正的命令，以保证命令从启动时即受到限制
+func setResourceLimits(cmd *exec.Cmd, l ResourceLimits) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	value := fmt.Sprintf("%d:%d:%d:%d", l.CPUSeconds, l.AddressSpace, l.OpenFiles, l.MaxProcesses)
+	cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+	cmd.Path = self
+	cmd.Env = append(cmd.Env, rlimitEnvName+"="+value)
+	return nil
+}
+
+func execWithResourceLimits(value string) {
+	fail := func(err error) {
+		fmt.Fprintf(os.Stderr, "set resource limits failed: %s\n", err)
+		os.Exit(127)
+	}
+	parts := strings.Split(value, ":")
+	if len(parts) != 4 || len(os.Args) < 3 {
+		fail(fmt.Errorf("invalid arguments"))
+	}
+	// 设置资源限制前准备好环境变量，避免之后申请内存时超出虚拟内存的限制
+	env := make([]string, 0, len(os.Environ()))
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, rlimitEnvName+"=") {
+			env = append(env, v)
+		}
+	}
+	resources := []int{syscall.RLIMIT_CPU, syscall.RLIMIT_AS, syscall.RLIMIT_NOFILE, rlimitNproc}
+	for i, resource := range resources {
+		n, err := strconv.ParseUint(parts[i], 10, 64)
+		if err != nil {
+			fail(err)
+		}
+		if n == 0 {
+			continue
+		}
+		if err := syscall.Setrlimit(resource, &syscall.Rlimit{Cur: n, Max: n}); err != nil {
+			fail(err)
+		}
+	}
+	fail(syscall.Exec(os.Args[1], os.Args[2:], env))
+}
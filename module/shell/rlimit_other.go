@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package shell
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+)
+
+// 仅Linux支持资源限制，其他系统无需处理
+func RunResourceLimitHelper() {}
+
+func checkResourceLimitsSupported(l ResourceLimits) error {
+	if l.hasRlimit() {
+		return fmt.Errorf("resource limits are not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+func setResourceLimits(cmd *exec.Cmd, l ResourceLimits) error {
+	return checkResourceLimitsSupported(l)
+}
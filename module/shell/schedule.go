@@ -0,0 +1,198 @@
+package shell
+
+import (
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"github.com/robfig/cron/v3"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// 定时执行的任务
+type Schedule struct {
+	Task         string            // 执行的任务名称，需要在Tasks中定义
+	Cron         string            // cron表达式，格式为：分 时 日 月 周，支持 @hourly、@every 1h 等写法，以及 CRON_TZ=Asia/Shanghai 前缀指定时区
+	Params       map[string]string // 传递给任务的参数
+	Jitter       time.Duration     // 每次执行前随机延迟的最长时间，用于避免多台服务器同时执行
+	AllowOverlap bool              // 是否允许上一次执行未结束时开始新的执行，默认跳过本次执行
+}
+
+type schedule struct {
+	Schedule
+	name     string
+	spec     cron.Schedule
+	mu       sync.Mutex
+	next     time.Time // 下次触发的时间
+	last     *Job      // 最近一次执行的任务
+	skipped  int       // 因上一次执行未结束而跳过的次数
+	lastSkip *time.Time
+}
+
+// 定时任务的运行状态，Start后开始执行，Close后停止
+type scheduleRunner struct {
+	mu      sync.Mutex
+	started bool
+	closed  chan struct{}
+	wg      sync.WaitGroup
+}
+
+// 检查定时任务的定义
+func (m *ModuleShell) initSchedules() error {
+	m.schedules = make(map[string]*schedule)
+	for name, v := range m.Schedules {
+		if _, ok := m.tasks[v.Task]; !ok {
+			return fmt.Errorf("schedule [%s]: task [%s] not found", name, v.Task)
+		}
+		spec, err := cron.ParseStandard(v.Cron)
+		if err != nil {
+			return fmt.Errorf("schedule [%s]: invalid cron [%s]: %s", name, v.Cron, err)
+		}
+		if _, err := m.TaskExecInfo(v.Task, v.Params); err != nil {
+			return fmt.Errorf("schedule [%s]: %s", name, err)
+		}
+		if err := checkWholeSeconds("jitter", v.Jitter); err != nil {
+			return fmt.Errorf("schedule [%s]: %s", name, err)
+		}
+		m.schedules[name] = &schedule{Schedule: v, name: name, spec: spec}
+	}
+	return nil
+}
+
+// 开始按计划执行定时任务，需要在Init之后调用，Close时停止，已经调用过Close时不再开始
+func (m *ModuleShell) Start() {
+	r := m.runner
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.started {
+		return
+	}
+	r.started = true
+	select {
+	case <-r.closed:
+		return
+	default:
+	}
+	for _, s := range m.schedules {
+		r.wg.Add(1)
+		go func(s *schedule) {
+			defer r.wg.Done()
+			m.runSchedule(s)
+		}(s)
+	}
+}
+
+// 停止定时任务，已经开始的执行不受影响
+func (m *ModuleShell) Close() {
+	r := m.runner
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	select {
+	case <-r.closed:
+	default:
+		close(r.closed)
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+}
+
+func (m *ModuleShell) runSchedule(s *schedule) {
+	for {
+		now := time.Now()
+		next := s.spec.Next(now)
+		if next.IsZero() {
+			m.logger().Warnf("schedule [%s] will never run", s.name)
+			return
+		}
+		s.mu.Lock()
+		s.next = next
+		s.mu.Unlock()
+		delay := next.Sub(now)
+		if s.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(s.Jitter)))
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-m.runner.closed:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		m.triggerSchedule(s)
+	}
+}
+
+// 执行一次定时任务，上一次执行未结束时跳过
+func (m *ModuleShell) triggerSchedule(s *schedule) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	log := m.logger().WithField("schedule", s.name)
+	if !s.AllowOverlap && s.last != nil {
+		if status := s.last.State().Status; status == JobStatusQueued || status == JobStatusRunning {
+			now := time.Now()
+			s.skipped++
+			s.lastSkip = &now
+			log.Warnf("skip schedule because the previous job [%s] is %s", s.last.ID, status)
+			return
+		}
+	}
+	info, err := m.TaskExecInfo(s.Task, s.Params)
+	if err != nil {
+		log.Errorf("start schedule failed: %s", err)
+		return
+	}
+	info.caller = Caller{Schedule: s.name}
+	job, err := m.StartJob(info)
+	if err != nil {
+		log.Errorf("start schedule failed: %s", err)
+		return
+	}
+	s.last = job
+	log.Infof("schedule started job [%s]", job.ID)
+}
+
+func (m *ModuleShell) handleScheduleList(ctx *web.Context) {
+	if ctx.Req.Method != "GET" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	names := make([]string, 0, len(m.schedules))
+	for name := range m.schedules {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]common.JSON, 0, len(names))
+	for _, name := range names {
+		s := m.schedules[name]
+		s.mu.Lock()
+		item := common.JSON{
+			"name":         name,
+			"task":         s.Task,
+			"cron":         s.Cron,
+			"params":       s.Params,
+			"jitter":       int(s.Jitter / time.Second),
+			"allowOverlap": s.AllowOverlap,
+			"nextTime":     s.next,
+			"skipped":      s.skipped,
+			"lastSkipTime": s.lastSkip,
+			"lastJob":      nil,
+		}
+		if s.last != nil {
+			state := s.last.State()
+			item["lastJob"] = common.JSON{
+				"id":        state.ID,
+				"status":    state.Status,
+				"startTime": state.StartTime,
+				"endTime":   state.EndTime,
+				"exitCode":  state.ExitCode,
+			}
+		}
+		s.mu.Unlock()
+		list = append(list, item)
+	}
+	common.ResponseApiOk(ctx, common.JSON{"schedules": list})
+}
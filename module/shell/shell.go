@@ -1,41 +1,456 @@
 package shell
 
 import (
+	"encoding/json"
 	"fmt"
 	"github.com/leizongmin/tora/common"
 	"github.com/leizongmin/tora/web"
 	"github.com/sirupsen/logrus"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type ModuleShell struct {
-	Log                   *logrus.Logger // 日志模块
-	Root                  string         // 文件根目录
-	AllowInternalCommands []string       // 允许执行的内部命令
-	AllowExternalCommands []string       // 允许执行的外部命令
+	Log                   *logrus.Logger      // 日志模块
+	Root                  string              // 文件根目录
+	AllowInternalCommands []string            // 允许执行的内部命令
+	AllowExternalCommands []string            // 允许执行的外部命令
+	KillGracePeriod       time.Duration       // 取消执行时，发送SIGTERM信号后等待进程退出的时间，超时后发送SIGKILL信号
+	MaxFinishedJobs       int                 // 保留的已结束异步任务数量
+	MaxTimeout            time.Duration       // run和onSuccess阶段的最大总超时时间，0表示不限制
+	MaxStepTimeout        time.Duration       // 单条命令的最大超时时间，0表示不限制
+	CleanupTimeout        time.Duration       // onError和onEnd阶段的总超时时间
+	Tasks                 map[string]Task     // 预先定义的任务
+	Schedules             map[string]Schedule // 定时执行的任务
+	RunAsUser             string              // 以指定用户身份执行外部命令，需要tora-server以root身份运行
+	RunAsGroup            string              // 以指定组身份执行外部命令，不指定则使用RunAsUser的主组
+	Limits                ResourceLimits      // 外部命令的资源限制
+	MaxConcurrent         int                 // 最多同时执行的数量，超过后按提交顺序排队，0表示不限制
+	HistoryDir            string              // 保存执行记录的目录，为空表示不保存
+	HistoryMaxAge         time.Duration       // 执行记录的最长保留时间，0表示使用默认值，小于0表示不限制
+	HistoryMaxSize        int64               // 执行记录的最大总字节数，0表示使用默认值，小于0表示不限制
+	HistoryOutputSize     int                 // 执行记录中每条命令保留的输出字节数，超出部分仅保留末尾
+	AllowPtyCommands      []string            // 允许在伪终端中执行的命令
+	CleanEnv              bool                // 外部命令不继承tora-server的环境变量，仅保留AllowEnv中的变量
+	AllowEnv              []string            // CleanEnv时仍然继承的环境变量名称，支持*通配符
+	Env                   map[string]string   // 所有外部命令的环境变量
+	Secrets               map[string]string   // 密钥名称和保存密钥的文件，执行时读取并以环境变量传递给外部命令，输出中的密钥会被替换为****
+	ArtifactsRoot         string              // 保存产物的根目录，通常为file模块的根目录，为空表示不支持保存产物
+	ArtifactsDirPerm      os.FileMode         // 保存产物时创建的目录权限
+	ArtifactsFilePerm     os.FileMode         // 保存产物时创建的文件权限
+
+	jobs       *jobManager
+	history    *historyStore
+	queue      *scheduler
+	tasks      map[string]*task
+	credential *credential
+	schedules  map[string]*schedule
+	runner     *scheduleRunner
 }
 
 var DefaultAllowInternalCommands = []string{"list", "cd", "cat", "exit", "run"}
 var DefaultAllowExternalCommands = []string{}
 
+// 默认发送SIGTERM信号后等待进程退出的时间
+const DefaultKillGracePeriod = 10 * time.Second
+
+// 默认onError和onEnd阶段的总超时时间
+const DefaultCleanupTimeout = 10 * time.Minute
+
+// 初始化模块，需要在设置好各配置项后、处理请求前调用
+func (m *ModuleShell) Init() error {
+	if m.AllowExternalCommands == nil {
+		m.AllowExternalCommands = DefaultAllowExternalCommands
+	}
+	if m.AllowInternalCommands == nil {
+		m.AllowInternalCommands = DefaultAllowInternalCommands
+	}
+	if !(m.KillGracePeriod > 0) {
+		m.KillGracePeriod = DefaultKillGracePeriod
+	}
+	if !(m.CleanupTimeout > 0) {
+		m.CleanupTimeout = DefaultCleanupTimeout
+	}
+	if !(m.MaxFinishedJobs > 0) {
+		m.MaxFinishedJobs = DefaultMaxFinishedJobs
+	}
+	m.jobs = newJobManager(m.MaxFinishedJobs)
+	m.queue = newScheduler(m.MaxConcurrent)
+	if !(m.ArtifactsDirPerm > 0) {
+		m.ArtifactsDirPerm = DefaultArtifactsDirPerm
+	}
+	if !(m.ArtifactsFilePerm > 0) {
+		m.ArtifactsFilePerm = DefaultArtifactsFilePerm
+	}
+	if !(m.HistoryOutputSize > 0) {
+		m.HistoryOutputSize = DefaultHistoryOutputSize
+	}
+	if m.HistoryMaxAge == 0 {
+		m.HistoryMaxAge = DefaultHistoryMaxAge
+	}
+	if m.HistoryMaxSize == 0 {
+		m.HistoryMaxSize = DefaultHistoryMaxSize
+	}
+	if len(m.HistoryDir) > 0 {
+		history, err := newHistoryStore(m.HistoryDir, m.HistoryMaxAge, m.HistoryMaxSize, m.HistoryOutputSize)
+		if err != nil {
+			return err
+		}
+		m.history = history
+	}
+	if err := checkSecrets(m.Secrets); err != nil {
+		return err
+	}
+	credential, err := initCredential(m.RunAsUser, m.RunAsGroup)
+	if err != nil {
+		return err
+	}
+	m.credential = credential
+	if err := checkResourceLimitsSupported(m.Limits); err != nil {
+		return err
+	}
+	if err := m.initTasks(); err != nil {
+		return err
+	}
+	if err := m.initSchedules(); err != nil {
+		return err
+	}
+	m.runner = &scheduleRunner{closed: make(chan struct{})}
+	return nil
+}
+
+func (m *ModuleShell) logger() logrus.FieldLogger {
+	if m.Log != nil {
+		return m.Log
+	}
+	return logrus.StandardLogger()
+}
+
+func initCredential(username string, groupname string) (*credential, error) {
+	if len(username) < 1 && len(groupname) < 1 {
+		return nil, nil
+	}
+	if err := checkCredentialSupported(); err != nil {
+		return nil, err
+	}
+	return lookupCredential(username, groupname)
+}
+
 type ExecInfo struct {
-	CWD       string            `json:"cwd"`
-	Define    map[string]string `json:"define"`
-	Run       []string          `json:"run"`
-	OnSuccess []string          `json:"onSuccess"`
-	OnError   []string          `json:"onError"`
-	OnEnd     []string          `json:"onEnd"`
+	CWD         string            `json:"cwd"`
+	Define      map[string]string `json:"define"`
+	Run         []Step            `json:"run"`
+	OnSuccess   []Step            `json:"onSuccess"`
+	OnError     []Step            `json:"onError"`
+	OnEnd       []Step            `json:"onEnd"`
+	Timeout     int               `json:"timeout"`               // run和onSuccess阶段的总超时时间（秒）
+	StepTimeout int               `json:"stepTimeout"`           // 单条命令的超时时间（秒）
+	Task        string            `json:"task,omitempty"`        // 任务名称，仅当执行预先定义的任务时有值
+	Lock        string            `json:"lock,omitempty"`        // 锁名称，持有相同锁的执行会依次进行
+	Artifacts   []string          `json:"artifacts,omitempty"`   // 执行后收集的产物，相对于cwd，以/开头则相对于根目录
+	ArtifactsTo string            `json:"artifactsTo,omitempty"` // 执行成功后将产物保存到file模块根目录下的此目录中
+
+	task   *task     // 预先定义的任务，此时不受允许执行的命令列表限制
+	noWait bool      // 不能立即执行时不排队而是直接返回错误
+	caller Caller    // 发起执行的客户端
+	stdin  io.Reader // 第一条命令的标准输入
+}
+
+func (m *ModuleShell) Handle(ctx *web.Context, caller Caller) {
+	p := ctx.Req.URL.Path
+	switch {
+	case p == "/exec":
+		m.handleExec(ctx, caller)
+	case p == "/jobs":
+		m.handleJobList(ctx, caller)
+	case strings.HasPrefix(p, "/jobs/"):
+		m.handleJob(ctx, caller, p[len("/jobs/"):])
+	case p == "/pty":
+		m.handlePty(ctx, caller)
+	case p == "/tasks":
+		m.handleTaskList(ctx)
+	case strings.HasPrefix(p, "/tasks/"):
+		m.handleTask(ctx, caller, p[len("/tasks/"):])
+	case p == "/schedules":
+		m.handleScheduleList(ctx)
+	default:
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("not supported path [%s]", ctx.Req.URL.Path), nil)
+	}
 }
 
-func (m *ModuleShell) Handle(ctx *web.Context) {
+func (m *ModuleShell) handleExec(ctx *web.Context, caller Caller) {
 	if ctx.Req.Method != "POST" {
 		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
 		return
 	}
 	info := ExecInfo{}
-	if err := ctx.Util.ParseBodyJson(&info); err != nil {
+	if strings.HasPrefix(ctx.Req.Header.Get("content-type"), "multipart/form-data") {
+		if err := parseMultipartExecInfo(ctx, &info); err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+	} else if err := ctx.Util.ParseBodyJson(&info); err != nil {
 		common.ResponseApiError(ctx, err.Error(), nil)
 		return
 	}
+	info.Task = ""
+	info.caller = caller
+	m.handleExecInfo(ctx, info)
+}
+
+// 解析multipart请求，第一部分为JSON格式的info，可选的第二部分stdin作为第一条命令的标准输入，不在内存中缓存
+func parseMultipartExecInfo(ctx *web.Context, info *ExecInfo) error {
+	r, err := ctx.Req.MultipartReader()
+	if err != nil {
+		return err
+	}
+	part, err := r.NextPart()
+	if err != nil {
+		return fmt.Errorf("missing part [info]")
+	}
+	if part.FormName() != "info" {
+		return fmt.Errorf("the first part should be [info], got [%s]", part.FormName())
+	}
+	if err := json.NewDecoder(part).Decode(info); err != nil {
+		return err
+	}
+	part, err = r.NextPart()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if part.FormName() != "stdin" {
+		return fmt.Errorf("unexpected part [%s]", part.FormName())
+	}
+	info.stdin = part
+	return nil
+}
 
-	ctx.Util.ResponseJson(info)
+// 根据请求参数选择异步执行、实时输出或同步执行
+func (m *ModuleShell) handleExecInfo(ctx *web.Context, info ExecInfo) {
+	info.noWait = ctx.Req.URL.Query().Get("wait") == "0"
+	if ctx.Req.URL.Query().Get("async") == "1" {
+		if info.stdin != nil {
+			common.ResponseApiError(ctx, "stdin is not supported in async mode", nil)
+			return
+		}
+		m.handleExecAsync(ctx, info)
+		return
+	}
+	if ctx.Util.AcceptEventStream() {
+		m.handleExecStream(ctx, info)
+		return
+	}
+
+	if ctx.Req.URL.Query().Get("artifacts") == "tar" {
+		m.handleExecArtifactsTar(ctx, info)
+		return
+	}
+
+	result, err := m.Exec(ctx.Req.Context(), info, nil)
+	if err != nil {
+		responseExecError(ctx, err)
+		return
+	}
+	responseExecResult(ctx, result)
+}
+
+func responseExecResult(ctx *web.Context, result ExecResult) {
+	data := common.JSON{
+		"success":  result.Success,
+		"exitCode": result.ExitCode,
+		"steps":    result.Steps,
+	}
+	if len(result.Artifacts) > 0 {
+		data["artifacts"] = result.Artifacts
+	}
+	if len(result.Error) > 0 {
+		data["error"] = result.Error
+	}
+	common.ResponseApiOk(ctx, data)
+}
+
+// 同步执行，成功后以tar格式返回产物，执行失败时返回与同步执行相同的JSON结果
+func (m *ModuleShell) handleExecArtifactsTar(ctx *web.Context, info ExecInfo) {
+	if len(info.Artifacts) < 1 {
+		common.ResponseApiError(ctx, "missing artifacts", nil)
+		return
+	}
+	result, err := m.Exec(ctx.Req.Context(), info, nil)
+	if err != nil {
+		responseExecError(ctx, err)
+		return
+	}
+	if !result.Success {
+		responseExecResult(ctx, result)
+		return
+	}
+	files, err := m.collectArtifacts(info)
+	if err != nil {
+		result.Success = false
+		result.ExitCode = -1
+		result.Error = err.Error()
+		responseExecResult(ctx, result)
+		return
+	}
+	ctx.Res.Header().Set("content-type", "application/x-tar")
+	ctx.Res.Header().Set("x-exec-success", strconv.FormatBool(result.Success))
+	ctx.Res.Header().Set("x-exec-exit-code", strconv.Itoa(result.ExitCode))
+	ctx.Res.WriteHeader(200)
+	if err := writeArtifactsTar(ctx.Res, files); err != nil {
+		ctx.Log.Warnf("write artifacts failed: %s", err)
+	}
+}
+
+// 以 Server-Sent Events 的方式实时输出执行过程
+func (m *ModuleShell) handleExecStream(ctx *web.Context, info ExecInfo) {
+	started := false
+	result, err := m.Exec(ctx.Req.Context(), info, func(e Event) {
+		if !started {
+			ctx.Util.ResponseEventStreamHeader()
+			started = true
+		}
+		if err := ctx.Util.ResponseEvent(e.Type, e); err != nil {
+			ctx.Log.Debugf("write event failed: %s", err)
+		}
+	})
+	if err != nil {
+		if started {
+			ctx.Log.Infof("exec failed: %s", err)
+			return
+		}
+		responseExecError(ctx, err)
+		return
+	}
+	ctx.Log.WithField("exitCode", result.ExitCode).Info("OK")
+}
+
+// 异步执行，立即返回任务ID
+func (m *ModuleShell) handleExecAsync(ctx *web.Context, info ExecInfo) {
+	job, err := m.StartJob(info)
+	if err != nil {
+		responseExecError(ctx, err)
+		return
+	}
+	state := job.State()
+	ctx.Log.WithField("job", job.ID).Infof("job %s", state.Status)
+	common.ResponseApiOk(ctx, common.JSON{"id": job.ID, "status": state.Status, "queuePosition": state.QueuePosition})
+}
+
+// 不能立即执行且不排队时返回409
+func responseExecError(ctx *web.Context, err error) {
+	if _, ok := err.(busyError); ok {
+		common.ResponseApiErrorWithStatusCode(ctx, 409, err.Error(), nil)
+		return
+	}
+	common.ResponseApiError(ctx, err.Error(), nil)
+}
+
+func (m *ModuleShell) handleJobList(ctx *web.Context, caller Caller) {
+	if ctx.Req.Method != "GET" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	var since time.Time
+	if v := ctx.Req.URL.Query().Get("since"); len(v) > 0 {
+		t, err := parseTime(v)
+		if err != nil {
+			common.ResponseApiError(ctx, fmt.Sprintf("invalid since [%s]", v), nil)
+			return
+		}
+		since = t
+	}
+	// 使用token的客户端仅能查看自己和定时任务发起的任务，通过IP白名单授权的客户端可以通过token参数过滤
+	token := ctx.Req.URL.Query().Get("token")
+	if !caller.privileged() {
+		token = caller.Token
+	}
+	states, err := m.ListJobStates(since, token, !caller.privileged())
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	list := make([]common.JSON, 0, len(states))
+	for _, state := range states {
+		list = append(list, common.JSON{
+			"id":            state.ID,
+			"status":        state.Status,
+			"queuePosition": state.QueuePosition,
+			"task":          state.Info.Task,
+			"token":         state.Token,
+			"ip":            state.IP,
+			"schedule":      state.Schedule,
+			"createTime":    state.CreateTime,
+			"startTime":     state.StartTime,
+			"endTime":       state.EndTime,
+			"exitCode":      state.ExitCode,
+		})
+	}
+	common.ResponseApiOk(ctx, common.JSON{"jobs": list})
+}
+
+// 使用token的客户端只能查看和取消自己或者定时任务发起的任务，其他任务按不存在处理
+func (m *ModuleShell) handleJob(ctx *web.Context, caller Caller, id string) {
+	job := m.GetJob(id)
+	if job == nil {
+		m.handleJobHistory(ctx, caller, id)
+		return
+	}
+	if !caller.canAccess(job.state.Info.caller.Token, job.state.Schedule) {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("job [%s] not found", id), nil)
+		return
+	}
+	switch ctx.Req.Method {
+	case "GET":
+		common.ResponseApiOk(ctx, common.JSON{"job": job.State()})
+	case "DELETE":
+		if !job.Cancel() {
+			common.ResponseApiError(ctx, fmt.Sprintf("job [%s] is not running", id), nil)
+			return
+		}
+		ctx.Log.WithField("job", job.ID).Info("job canceled")
+		common.ResponseApiOk(ctx, common.JSON{"id": job.ID, "canceled": true})
+	default:
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+	}
+}
+
+// 查询已不在内存中的任务的执行记录
+func (m *ModuleShell) handleJobHistory(ctx *web.Context, caller Caller, id string) {
+	var state *JobState
+	if m.history != nil {
+		r, err := m.history.get(id)
+		if err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+		if r != nil && caller.canAccessRecord(r) {
+			state = &r.JobState
+		}
+	}
+	if state == nil {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("job [%s] not found", id), nil)
+		return
+	}
+	switch ctx.Req.Method {
+	case "GET":
+		common.ResponseApiOk(ctx, common.JSON{"job": state})
+	case "DELETE":
+		common.ResponseApiError(ctx, fmt.Sprintf("job [%s] is not running", id), nil)
+	default:
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+	}
+}
+
+// 时间可以为RFC3339格式或者Unix时间戳（秒）
+func parseTime(v string) (time.Time, error) {
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
 }
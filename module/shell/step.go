@@ -0,0 +1,191 @@
+package shell
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// 重试等待时间最多加倍的次数
+const maxBackoffShift = 10
+
+// 一个执行步骤，可以是单条命令或者并行执行的一组命令，
+// 仅包含command时在JSON中可以直接写为字符串
+type Step struct {
+	Command         string   `json:"command,omitempty"`         // 单条命令
+	Parallel        []string `json:"parallel,omitempty"`        // 并行执行的一组命令
+	FailFast        bool     `json:"failFast,omitempty"`        // 并行执行时有命令失败则结束其他命令，否则等待全部结束
+	Retries         int      `json:"retries,omitempty"`         // 失败后的重试次数，并行执行时重新执行整组命令
+	Backoff         int      `json:"backoff,omitempty"`         // 第一次重试前等待的秒数，之后每次重试等待时间加倍
+	ContinueOnError bool     `json:"continueOnError,omitempty"` // 失败后是否继续执行后续命令
+}
+
+type stepJSON Step
+
+func (s *Step) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		*s = Step{}
+		return json.Unmarshal(b, &s.Command)
+	}
+	v := stepJSON{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*s = Step(v)
+	return nil
+}
+
+func (s Step) MarshalJSON() ([]byte, error) {
+	if s.isCommand() {
+		return json.Marshal(s.Command)
+	}
+	return json.Marshal(stepJSON(s))
+}
+
+// 是否仅包含一条命令，没有其他选项
+func (s Step) isCommand() bool {
+	return len(s.Parallel) < 1 && !s.FailFast && s.Retries == 0 && s.Backoff == 0 && !s.ContinueOnError
+}
+
+func (s Step) check() error {
+	if (len(s.Command) > 0) == (len(s.Parallel) > 0) {
+		return fmt.Errorf("either command or parallel should be specified")
+	}
+	for _, line := range s.Parallel {
+		if len(line) < 1 {
+			return fmt.Errorf("empty command in parallel")
+		}
+	}
+	if s.Retries < 0 {
+		return fmt.Errorf("invalid retries [%d]", s.Retries)
+	}
+	if s.Backoff < 0 {
+		return fmt.Errorf("invalid backoff [%d]", s.Backoff)
+	}
+	return nil
+}
+
+// 第attempt次执行失败后，重试前的等待时间
+func (s Step) backoff(attempt int) time.Duration {
+	shift := attempt - 1
+	if shift > maxBackoffShift {
+		shift = maxBackoffShift
+	}
+	return time.Duration(s.Backoff) * time.Second << uint(shift)
+}
+
+// 将命令列表转换为步骤列表
+func CommandSteps(lines ...string) []Step {
+	steps := make([]Step, len(lines))
+	for i, line := range lines {
+		steps[i] = Step{Command: line}
+	}
+	return steps
+}
+
+func checkSteps(stage string, steps []Step) error {
+	for i, v := range steps {
+		if err := v.check(); err != nil {
+			return fmt.Errorf("invalid %s step [%d]: %s", stage, i, err)
+		}
+	}
+	return nil
+}
+
+// 检查所有阶段的步骤
+func checkExecSteps(run, onSuccess, onError, onEnd []Step) error {
+	if err := checkSteps(StageRun, run); err != nil {
+		return err
+	}
+	if err := checkSteps(StageOnSuccess, onSuccess); err != nil {
+		return err
+	}
+	if err := checkSteps(StageOnError, onError); err != nil {
+		return err
+	}
+	return checkSteps(StageOnEnd, onEnd)
+}
+
+// 执行一个步骤，失败时按retries重试，返回最后一次执行的退出码
+func (s *session) runStepWithRetries(ctx context.Context, stage string, step Step) int {
+	for attempt := 1; ; attempt++ {
+		first := len(s.steps)
+		var exitCode int
+		if len(step.Parallel) > 0 {
+			exitCode = s.runParallel(ctx, stage, step, attempt)
+		} else {
+			index := s.startStep(stage, step.Command, step.attempt(attempt), 0)
+			s.runStep(ctx, index)
+			exitCode = s.steps[index].ExitCode
+		}
+		if exitCode == 0 || s.exited {
+			return exitCode
+		}
+		if attempt > step.Retries || ctx.Err() != nil {
+			if step.ContinueOnError {
+				for i := first; i < len(s.steps); i++ {
+					if s.steps[i].ExitCode != 0 {
+						s.steps[i].Ignored = true
+					}
+				}
+			}
+			return exitCode
+		}
+		delay := step.backoff(attempt)
+		s.log.Debugf("retry [%s] after %s", stage, delay)
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+// 设置了重试时记录第几次执行
+func (s Step) attempt(n int) int {
+	if s.Retries > 0 {
+		return n
+	}
+	return 0
+}
+
+// 并行执行一组命令，返回第一个失败的命令的退出码
+func (s *session) runParallel(ctx context.Context, stage string, step Step, attempt int) int {
+	s.groups++
+	group := s.groups
+	// 标准输入仅传递给单独执行的第一条命令
+	s.stdin = nil
+	indexes := make([]int, len(step.Parallel))
+	for i, line := range step.Parallel {
+		indexes[i] = s.startStep(stage, line, step.attempt(attempt), group)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	exitCode := 0
+	for _, index := range indexes {
+		wg.Add(1)
+		go func(index int) {
+			defer wg.Done()
+			s.runStep(ctx, index)
+			if code := s.steps[index].ExitCode; code != 0 {
+				mu.Lock()
+				defer mu.Unlock()
+				if exitCode == 0 {
+					exitCode = code
+					if step.FailFast {
+						cancel()
+					}
+				}
+			}
+		}(index)
+	}
+	wg.Wait()
+	return exitCode
+}
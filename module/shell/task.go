@@ -0,0 +1,197 @@
+package shell
+
+import (
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/web"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// 在配置中预先定义的任务，客户端仅能传递参数，
+// 任务中的命令由管理员定义，因此不受AllowInternalCommands和AllowExternalCommands限制
+type Task struct {
+	CWD         string               // 工作目录，相对于Root
+	Env         map[string]string    // 环境变量，同时可以作为变量在命令中使用
+	Params      map[string]TaskParam // 允许客户端传递的参数，可以作为变量在命令中使用
+	Run         []Step               // 依次执行的步骤
+	OnSuccess   []Step               // run全部执行成功后执行的步骤
+	OnError     []Step               // run执行失败后执行的步骤
+	OnEnd       []Step               // 最后执行的步骤
+	Timeout     time.Duration        // run和onSuccess阶段的总超时时间
+	StepTimeout time.Duration        // 单条命令的超时时间
+	RunAsUser   string               // 以指定用户身份执行外部命令，不指定则使用模块的配置
+	RunAsGroup  string               // 以指定组身份执行外部命令
+	Limits      ResourceLimits       // 外部命令的资源限制，为0的项使用模块的配置
+	Lock        string               // 锁名称，持有相同锁的执行会依次进行
+	Secrets     map[string]string    // 密钥名称和保存密钥的文件，与模块配置的密钥合并，同名时优先使用任务的配置
+}
+
+// 任务参数
+type TaskParam struct {
+	Pattern  string // 参数值需要完整匹配的正则表达式
+	Default  string // 默认值
+	Required bool   // 是否必须由客户端传递
+}
+
+type task struct {
+	Task
+	patterns   map[string]*regexp.Regexp
+	credential *credential
+	limits     ResourceLimits
+	secrets    map[string]string // 合并后的密钥文件
+}
+
+// 检查任务定义并编译参数的正则表达式
+func (m *ModuleShell) initTasks() error {
+	m.tasks = make(map[string]*task)
+	for name, t := range m.Tasks {
+		if len(t.Run) < 1 {
+			return fmt.Errorf("task [%s]: missing run commands", name)
+		}
+		if err := checkExecSteps(t.Run, t.OnSuccess, t.OnError, t.OnEnd); err != nil {
+			return fmt.Errorf("task [%s]: %s", name, err)
+		}
+		if err := checkWholeSeconds("timeout", t.Timeout); err != nil {
+			return fmt.Errorf("task [%s]: %s", name, err)
+		}
+		if err := checkWholeSeconds("stepTimeout", t.StepTimeout); err != nil {
+			return fmt.Errorf("task [%s]: %s", name, err)
+		}
+		patterns := make(map[string]*regexp.Regexp)
+		for k, p := range t.Params {
+			if len(p.Pattern) < 1 {
+				return fmt.Errorf("task [%s]: missing pattern of param [%s]", name, k)
+			}
+			re, err := regexp.Compile("^(?:" + p.Pattern + ")$")
+			if err != nil {
+				return fmt.Errorf("task [%s]: invalid pattern of param [%s]: %s", name, k, err)
+			}
+			patterns[k] = re
+		}
+		credential := m.credential
+		if len(t.RunAsUser) > 0 || len(t.RunAsGroup) > 0 {
+			c, err := initCredential(t.RunAsUser, t.RunAsGroup)
+			if err != nil {
+				return fmt.Errorf("task [%s]: %s", name, err)
+			}
+			credential = c
+		}
+		limits := t.Limits.merge(m.Limits)
+		if err := checkResourceLimitsSupported(limits); err != nil {
+			return fmt.Errorf("task [%s]: %s", name, err)
+		}
+		secrets := mergeSecrets(m.Secrets, t.Secrets)
+		if err := checkSecrets(secrets); err != nil {
+			return fmt.Errorf("task [%s]: %s", name, err)
+		}
+		m.tasks[name] = &task{Task: t, patterns: patterns, credential: credential, limits: limits, secrets: secrets}
+	}
+	return nil
+}
+
+// 根据任务定义和客户端传递的参数生成ExecInfo
+func (m *ModuleShell) TaskExecInfo(name string, params map[string]string) (ExecInfo, error) {
+	t, ok := m.tasks[name]
+	if !ok {
+		return ExecInfo{}, fmt.Errorf("task [%s] not found", name)
+	}
+	define := make(map[string]string)
+	for k, v := range t.Env {
+		define[k] = v
+	}
+	for k := range params {
+		if _, ok := t.Params[k]; !ok {
+			return ExecInfo{}, fmt.Errorf("unknown param [%s]", k)
+		}
+	}
+	for k, p := range t.Params {
+		v, ok := params[k]
+		if !ok {
+			if p.Required {
+				return ExecInfo{}, fmt.Errorf("missing param [%s]", k)
+			}
+			v = p.Default
+		}
+		if !t.patterns[k].MatchString(v) {
+			return ExecInfo{}, fmt.Errorf("invalid param [%s]: must match %s", k, p.Pattern)
+		}
+		define[k] = v
+	}
+	return ExecInfo{
+		CWD:         t.CWD,
+		Define:      define,
+		Run:         t.Run,
+		OnSuccess:   t.OnSuccess,
+		OnError:     t.OnError,
+		OnEnd:       t.OnEnd,
+		Timeout:     int(t.Timeout / time.Second),
+		StepTimeout: int(t.StepTimeout / time.Second),
+		Task:        name,
+		Lock:        t.Lock,
+		task:        t,
+	}, nil
+}
+
+func (m *ModuleShell) handleTaskList(ctx *web.Context) {
+	if ctx.Req.Method != "GET" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	names := make([]string, 0, len(m.tasks))
+	for name := range m.tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := make([]common.JSON, 0, len(names))
+	for _, name := range names {
+		t := m.tasks[name]
+		params := make(common.JSON)
+		for k, p := range t.Params {
+			params[k] = common.JSON{"pattern": p.Pattern, "default": p.Default, "required": p.Required}
+		}
+		list = append(list, common.JSON{
+			"name":        name,
+			"cwd":         t.CWD,
+			"params":      params,
+			"run":         t.Run,
+			"onSuccess":   t.OnSuccess,
+			"onError":     t.OnError,
+			"onEnd":       t.OnEnd,
+			"timeout":     int(t.Timeout / time.Second),
+			"stepTimeout": int(t.StepTimeout / time.Second),
+			"lock":        t.Lock,
+		})
+	}
+	common.ResponseApiOk(ctx, common.JSON{"tasks": list})
+}
+
+// 执行任务，请求体格式为 {"params": {"NAME": "value"}}，同样支持异步执行和实时输出
+func (m *ModuleShell) handleTask(ctx *web.Context, caller Caller, name string) {
+	if ctx.Req.Method != "POST" {
+		common.ResponseApiError(ctx, fmt.Sprintf("method [%s] not allowed", ctx.Req.Method), nil)
+		return
+	}
+	if _, ok := m.tasks[name]; !ok {
+		common.ResponseApiErrorWithStatusCode(ctx, 404, fmt.Sprintf("task [%s] not found", name), nil)
+		return
+	}
+	body := struct {
+		Params map[string]string `json:"params"`
+	}{}
+	if ctx.Req.ContentLength != 0 {
+		if err := ctx.Util.ParseBodyJson(&body); err != nil {
+			common.ResponseApiError(ctx, err.Error(), nil)
+			return
+		}
+	}
+	info, err := m.TaskExecInfo(name, body.Params)
+	if err != nil {
+		common.ResponseApiError(ctx, err.Error(), nil)
+		return
+	}
+	info.caller = caller
+	ctx.Log = ctx.Log.WithField("task", name)
+	m.handleExecInfo(ctx, info)
+}
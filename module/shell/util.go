@@ -3,8 +3,11 @@ package shell
 import (
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
+	"unicode"
 )
 
 func resolveFilePath(root string, url string) (string, error) {
@@ -15,8 +18,149 @@ func resolveFilePath(root string, url string) (string, error) {
 	if err != nil {
 		return p, err
 	}
-	if strings.Index(p, root+string(os.PathSeparator)) >= 0 {
+	if p == root || strings.Index(p, root+string(os.PathSeparator)) >= 0 {
 		return p, nil
 	}
 	return p, fmt.Errorf("cannot access to %s", url)
 }
+
+// 将相对于root的工作目录转换为以/开头的路径，包含超出root的 .. 时返回错误
+func cleanWorkDir(dir string) (string, error) {
+	rel := path.Clean(strings.TrimLeft(dir, "/"))
+	if rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("cannot access to %s", dir)
+	}
+	return path.Join("/", rel), nil
+}
+
+// 将相对于cwd的路径p（以/开头则相对于root）转换为虚拟路径和实际路径，
+// 实际路径经过符号链接后也不能超出root，不存在时检查最近的已存在的上级目录
+func resolveRealPath(root string, cwd string, p string) (string, string, error) {
+	if !strings.HasPrefix(p, "/") {
+		p = path.Join(cwd, p)
+	}
+	p = path.Join("/", p)
+	f, err := resolveFilePath(root, p)
+	if err != nil {
+		return p, f, err
+	}
+	real, err := filepath.EvalSymlinks(f)
+	for dir := f; os.IsNotExist(err) && dir != filepath.Dir(dir); {
+		dir = filepath.Dir(dir)
+		real, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return p, f, err
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return p, f, err
+	}
+	if real != realRoot && !strings.HasPrefix(real, realRoot+string(os.PathSeparator)) {
+		return p, f, fmt.Errorf("cannot access to %s", p)
+	}
+	return p, f, nil
+}
+
+// 检查以秒为单位传递的时间是否为整数秒，避免小于1秒的部分被忽略
+func checkWholeSeconds(name string, d time.Duration) error {
+	if d < 0 || d%time.Second != 0 {
+		return fmt.Errorf("invalid %s [%s]: must be whole seconds", name, d)
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// 解析命令行为参数列表，支持单引号、双引号和反斜杠转义，
+// 并将 ${NAME} 或 $NAME 替换为 define 中定义的变量（单引号内不替换）
+func parseCommandLine(line string, define map[string]string) ([]string, error) {
+	args := make([]string, 0)
+	runes := []rune(line)
+	var buf strings.Builder
+	var quote rune
+	inWord := false
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				buf.WriteRune(c)
+			}
+		case c == '\\':
+			if i+1 >= len(runes) {
+				return nil, fmt.Errorf("unexpected end of line after \\")
+			}
+			i++
+			buf.WriteRune(runes[i])
+			inWord = true
+		case c == '$':
+			name, n, err := parseVariableName(runes[i+1:])
+			if err != nil {
+				return nil, err
+			}
+			inWord = true
+			if n == 0 {
+				buf.WriteRune(c)
+				continue
+			}
+			v, ok := define[name]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable [%s]", name)
+			}
+			buf.WriteString(v)
+			i += n
+		case quote == '"':
+			if c == '"' {
+				quote = 0
+			} else {
+				buf.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+		case unicode.IsSpace(c):
+			if inWord {
+				args = append(args, buf.String())
+				buf.Reset()
+				inWord = false
+			}
+		default:
+			buf.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote %c", quote)
+	}
+	if inWord {
+		args = append(args, buf.String())
+	}
+	return args, nil
+}
+
+// 解析 $ 之后的变量名，返回变量名及其占用的字符数，如果不是变量则返回0
+func parseVariableName(runes []rune) (string, int, error) {
+	if len(runes) > 0 && runes[0] == '{' {
+		for i := 1; i < len(runes); i++ {
+			if runes[i] == '}' {
+				return string(runes[1:i]), i + 1, nil
+			}
+		}
+		return "", 0, fmt.Errorf("unterminated variable ${%s", string(runes[1:]))
+	}
+	n := 0
+	for n < len(runes) && (runes[n] == '_' || unicode.IsLetter(runes[n]) || unicode.IsDigit(runes[n])) {
+		n++
+	}
+	return string(runes[:n]), n, nil
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/leizongmin/tora/common"
+	"github.com/leizongmin/tora/module/log"
+	"github.com/leizongmin/tora/web"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 审计日志在log模块中默认的日志源名称
+const DefaultAuditSource = "audit"
+
+type AuditOptions struct {
+	Path     string // 审计日志文件路径，为空时不记录审计日志
+	MaxSize  int64  // 文件的最大字节数，超过时轮转为 Path.1、Path.2 等文件
+	MaxFiles int    // 保留的轮转后的文件数量
+	Source   string // 开启了log模块时作为日志源的名称，默认为audit
+	Sync     bool   // 每行写入后同步到磁盘，默认由操作系统决定写入磁盘的时机
+}
+
+// 审计日志中需要脱敏的查询参数，如 shell 模块 GET /jobs?token=<token>
+var auditMaskedParams = map[string]bool{"token": true}
+
+// 审计日志的一行，每个请求结束后写入一行JSON
+type AuditEntry struct {
+	Time     string `json:"time"`     // 请求开始的时间
+	Remote   string `json:"remote"`   // 客户端地址
+	Method   string `json:"method"`   // 请求方法
+	Url      string `json:"url"`      // 请求地址
+	Module   string `json:"module"`   // 请求的模块
+	Status   int    `json:"status"`   // 响应状态码
+	Bytes    int64  `json:"bytes"`    // 响应的字节数
+	Duration int64  `json:"duration"` // 处理请求的毫秒数
+	AuthOk   bool   `json:"authOk"`   // 是否通过授权
+	AuthType string `json:"authType"` // 授权类型，如 token 或者 ip
+	Token    string `json:"token"`    // 脱敏后的 token
+	Ip       string `json:"ip"`       // 客户端ip
+}
+
+// 将审计日志添加为log模块的日志源，不修改调用方传入的Sources
+func (s *Server) initAuditSource(options *Options) error {
+	name := options.Audit.Source
+	if len(name) < 1 {
+		name = DefaultAuditSource
+	}
+	if _, ok := options.LogOptions.Sources[name]; ok {
+		return fmt.Errorf("audit source [%s] conflicts with log source", name)
+	}
+	sources := make(map[string]log.Source)
+	for k, v := range options.LogOptions.Sources {
+		sources[k] = v
+	}
+	sources[name] = log.Source{Path: options.Audit.Path}
+	options.LogOptions.Sources = sources
+	return nil
+}
+
+// 写入一个请求的审计日志，写入失败时仅输出到日志
+func (s *Server) writeAudit(ctx *web.Context, res *auditResponseWriter, start time.Time, module string, auth AuthInfo, ok bool) {
+	status := res.status
+	if status == 0 {
+		status = 200
+	}
+	entry := AuditEntry{
+		Time:     start.Format(time.RFC3339Nano),
+		Remote:   ctx.Req.RemoteAddr,
+		Method:   ctx.Req.Method,
+		Url:      auditUrl(ctx.Req),
+		Module:   module,
+		Status:   status,
+		Bytes:    res.bytes,
+		Duration: int64(time.Since(start) / time.Millisecond),
+		AuthOk:   ok,
+		AuthType: auth.Type,
+		Token:    common.MaskToken(auth.Token),
+		Ip:       getIpFromAddr(ctx.Req.RemoteAddr),
+	}
+	b, err := json.Marshal(entry)
+	if err != nil {
+		ctx.Log.Errorf("marshal audit entry failed: %s", err)
+		return
+	}
+	if err := s.audit.Write(append(b, '\n')); err != nil {
+		ctx.Log.Errorf("write audit log failed: %s", err)
+	}
+}
+
+// 请求地址，auditMaskedParams 中的查询参数只保留首尾部分，其他部分保持原样
+func auditUrl(req *http.Request) string {
+	i := strings.Index(req.RequestURI, "?")
+	if i < 0 {
+		return req.RequestURI
+	}
+	parts := strings.Split(req.RequestURI[i+1:], "&")
+	for j, part := range parts {
+		kv := strings.SplitN(part, "=", 2)
+		key, err := url.QueryUnescape(kv[0])
+		if err != nil || len(kv) < 2 || !auditMaskedParams[key] {
+			continue
+		}
+		value, err := url.QueryUnescape(kv[1])
+		if err != nil {
+			value = kv[1]
+		}
+		// 保留脱敏后的 * 号，便于按 token 字段相同的方式查找
+		parts[j] = kv[0] + "=" + strings.Replace(url.QueryEscape(common.MaskToken(value)), "%2A", "*", -1)
+	}
+	return req.RequestURI[:i+1] + strings.Join(parts, "&")
+}
+
+// 记录响应状态码和字节数的ResponseWriter
+type auditResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *auditResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = 200
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// 跟踪日志和执行命令时需要及时输出
+func (w *auditResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 终端会话需要升级为websocket连接
+func (w *auditResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response does not support hijacking")
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
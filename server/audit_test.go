@@ -0,0 +1,151 @@
+package server
+
+import (
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServerAudit(t *testing.T) {
+	name := fmt.Sprintf("tora-%d-%d", time.Now().Unix(), rand.Uint32())
+	root := filepath.Join(os.TempDir(), name)
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+	auditLog := filepath.Join(root, "audit", "audit.log")
+
+	{
+		// 审计日志的日志源名称不能与已有的日志源相同
+		_, err := NewServer(Options{
+			Enable: []string{"log"},
+			LogOptions: LogOptions{
+				Sources: map[string]LogSource{"audit": {Path: filepath.Join(root, "app.log")}},
+			},
+			Audit: AuditOptions{Path: auditLog},
+		})
+		assert.Equal(t, "audit source [audit] conflicts with log source", err.Error())
+	}
+
+	addr, url := getRandomPort()
+	sources := map[string]LogSource{"app": {Path: filepath.Join(root, "app.log")}}
+	s, err := NewServer(Options{
+		Log:    logrus.New(),
+		Addr:   addr,
+		Enable: []string{"log", "file"},
+		FileOptions: FileOptions{
+			Root:        filepath.Join(root, "files"),
+			AllowPut:    true,
+			AllowDelete: true,
+		},
+		LogOptions: LogOptions{
+			Sources: sources,
+		},
+		Audit: AuditOptions{Path: auditLog},
+		Auth: Auth{
+			Token: map[string]AuthItem{
+				"logtoken": {
+					Allow:   true,
+					Modules: []string{"log"},
+				},
+				"filetoken": {
+					Allow:   true,
+					Modules: []string{"file"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// 不修改调用方传入的日志源
+	assert.Equal(t, 1, len(sources))
+	go s.Start()
+	defer s.Close()
+	time.Sleep(time.Second)
+
+	request := func(method string, path string, module string, token string, body string) *http.Response {
+		req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", token)
+		req.Header.Set("x-module", module)
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		defer res.Body.Close()
+		ioutil.ReadAll(res.Body)
+		return res
+	}
+	query := func(path string) jsoniter.Any {
+		req, err := http.NewRequest("GET", url+path, nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "logtoken")
+		req.Header.Set("x-module", "log")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 200, res.StatusCode)
+		return jsoniter.Get(b)
+	}
+
+	{
+		// 每个请求结束后写入一行审计日志，不记录健康检查
+		assert.Equal(t, 200, request("PUT", "/a.txt", "file", "filetoken", "hello").StatusCode)
+		assert.Equal(t, 200, request("DELETE", "/a.txt", "file", "filetoken", "").StatusCode)
+		assert.Equal(t, 403, request("DELETE", "/a.txt", "file", "badtoken", "").StatusCode)
+		assert.Equal(t, 403, request("GET", "/app", "log", "filetoken", "").StatusCode)
+		assert.Equal(t, 200, request("GET", "/", "watchdog", "", "").StatusCode)
+		lines := strings.Split(strings.TrimSpace(readFile(auditLog)), "\n")
+		assert.Equal(t, 4, len(lines))
+		entry := jsoniter.Get([]byte(lines[0]))
+		assert.Equal(t, "PUT", entry.Get("method").ToString())
+		assert.Equal(t, "/a.txt", entry.Get("url").ToString())
+		assert.Equal(t, "file", entry.Get("module").ToString())
+		assert.Equal(t, 200, entry.Get("status").ToInt())
+		assert.Equal(t, true, entry.Get("authOk").ToBool())
+		assert.Equal(t, "token", entry.Get("authType").ToString())
+		assert.Equal(t, "fi****en", entry.Get("token").ToString())
+		assert.Equal(t, "127.0.0.1", entry.Get("ip").ToString())
+		assert.Equal(t, true, entry.Get("bytes").ToInt() > 0)
+		_, err := time.Parse(time.RFC3339Nano, entry.Get("time").ToString())
+		assert.Equal(t, nil, err)
+	}
+	{
+		// 通过log模块查询审计日志
+		data := query("/")
+		assert.Equal(t, "app", data.Get("data", "sources", 0, "name").ToString())
+		assert.Equal(t, "audit", data.Get("data", "sources", 1, "name").ToString())
+		assert.Equal(t, auditLog, data.Get("data", "sources", 1, "file").ToString())
+
+		data = query("/audit?field=method=DELETE&field=status=200")
+		assert.Equal(t, 1, data.Get("data", "lines").Size())
+		entry := jsoniter.Get([]byte(data.Get("data", "lines", 0).ToString()))
+		assert.Equal(t, "/a.txt", entry.Get("url").ToString())
+		assert.Equal(t, "fi****en", entry.Get("token").ToString())
+
+		data = query("/audit?field=status=403")
+		assert.Equal(t, 2, data.Get("data", "lines").Size())
+
+		data = query("/audit?field=token=fi****en&field=module=file")
+		assert.Equal(t, 2, data.Get("data", "lines").Size())
+	}
+	{
+		// 查询参数中的token只保留首尾部分
+		request("GET", "/a.txt?x=1&token=secrettoken&token=", "file", "filetoken", "")
+		lines := strings.Split(strings.TrimSpace(readFile(auditLog)), "\n")
+		entry := jsoniter.Get([]byte(lines[len(lines)-1]))
+		assert.Equal(t, "/a.txt?x=1&token=se****en&token=", entry.Get("url").ToString())
+		assert.NotContains(t, readFile(auditLog), "secrettoken")
+	}
+}
@@ -5,10 +5,19 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"github.com/leizongmin/tora/module/shell"
 	"math/rand"
+	"os"
 	"strconv"
+	"testing"
 )
 
+func TestMain(m *testing.M) {
+	// 资源限制需要重新执行测试程序本身
+	shell.RunResourceLimitHelper()
+	os.Exit(m.Run())
+}
+
 type JSON map[string]interface{}
 
 func jsonStringify(data interface{}) string {
@@ -1,17 +1,27 @@
 package server
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"github.com/cespare/xxhash/v2"
 	"github.com/json-iterator/go"
+	"github.com/leizongmin/tora/common"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"io"
 	"io/ioutil"
+	"lukechampine.com/blake3"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -132,6 +142,51 @@ func TestModuleFile(t *testing.T) {
 		body, err := ioutil.ReadAll(res.Body)
 		assert.Equal(t, nil, err)
 		assert.Equal(t, file1Content, body)
+		assert.Equal(t, strconv.Itoa(len(file1Content)), res.Header.Get("x-file-size"))
+		assert.Equal(t, strconv.Itoa(len(file1Content)), res.Header.Get("content-length"))
+		assert.Equal(t, "bytes", res.Header.Get("accept-ranges"))
+		assert.Equal(t, true, len(res.Header.Get("etag")) > 0)
+	}
+	{
+		// 获取文件的一部分
+		rangeRequest := func(header map[string]string) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", url+"/"+filepath.Base(file1), nil)
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			defer res.Body.Close()
+			body, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, body
+		}
+		res, body := rangeRequest(map[string]string{"range": "bytes=1-3"})
+		assert.Equal(t, 206, res.StatusCode)
+		assert.Equal(t, "bytes 1-3/5", res.Header.Get("content-range"))
+		assert.Equal(t, "3", res.Header.Get("content-length"))
+		assert.Equal(t, []byte("ell"), body)
+		etag := res.Header.Get("etag")
+
+		res, body = rangeRequest(map[string]string{"range": "bytes=2-"})
+		assert.Equal(t, 206, res.StatusCode)
+		assert.Equal(t, []byte("llo"), body)
+
+		// If-Range与文件的ETag相同时返回部分内容，否则返回完整的文件
+		res, body = rangeRequest(map[string]string{"range": "bytes=2-", "if-range": etag})
+		assert.Equal(t, 206, res.StatusCode)
+		assert.Equal(t, []byte("llo"), body)
+		res, body = rangeRequest(map[string]string{"range": "bytes=2-", "if-range": `"changed"`})
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, file1Content, body)
+
+		// 超出文件大小的范围
+		res, _ = rangeRequest(map[string]string{"range": "bytes=10-"})
+		assert.Equal(t, 416, res.StatusCode)
+		assert.Equal(t, "bytes */5", res.Header.Get("content-range"))
 	}
 	file3 := filepath.Join(root, "file3.txt")
 	file3Content := []byte("dajdjklfjdksjflkjds")
@@ -320,7 +375,9 @@ func TestModuleFile(t *testing.T) {
 			assert.Equal(t, 200, res.StatusCode)
 			assert.Equal(t, "true", res.Header.Get("x-ok"))
 			assert.Equal(t, "file", res.Header.Get("x-file-type"))
-			assert.Equal(t, string(len(file1Content)), res.Header.Get("x-file-size"))
+			assert.Equal(t, strconv.Itoa(len(file1Content)), res.Header.Get("x-file-size"))
+			assert.Equal(t, strconv.Itoa(len(file1Content)), res.Header.Get("content-length"))
+			assert.Equal(t, "bytes", res.Header.Get("accept-ranges"))
 			assert.Equal(t, file1Stat.ModTime().UTC().String(), res.Header.Get("x-last-modified"))
 		}
 		{
@@ -396,5 +453,491 @@ func TestModuleFile(t *testing.T) {
 			assert.Equal(t, true, data.Get("data", "success").ToBool())
 		}
 	}
+	{
+		// 摘要
+		request := func(method string, path string, header map[string]string, body string) (*http.Response, jsoniter.Any) {
+			req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, jsoniter.Get(b)
+		}
+		content := []byte("checksum content")
+		sha := sha256.Sum256(content)
+		sha256Hex := hex.EncodeToString(sha[:])
+		b3 := blake3.Sum256(content)
+		blake3Hex := hex.EncodeToString(b3[:])
+		xxhashHex := fmt.Sprintf("%016x", xxhash.Sum64(content))
+
+		// 上传时校验sha256和blake3
+		res, data := request("PUT", "/sum/a.txt", map[string]string{"x-content-sha256": "bad"}, string(content))
+		assert.Equal(t, fmt.Sprintf("sha256 check failed: expected bad but got %s", sha256Hex), data.Get("error").ToString())
+		res, data = request("PUT", "/sum/a.txt", map[string]string{"x-content-sha256": strings.ToUpper(sha256Hex), "x-content-blake3": blake3Hex}, string(content))
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, false, data.Get("data", "checkedMd5").ToBool())
+		assert.Equal(t, `["blake3","sha256"]`, data.Get("data", "checked").ToString())
+		assert.Equal(t, sha256Hex, data.Get("data", "checksums", "sha256").ToString())
+
+		// HEAD和GET时通过x-checksum指定返回的摘要
+		res, _ = request("HEAD", "/sum/a.txt", map[string]string{"x-checksum": "sha256, blake3,xxhash,md5"}, "")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, sha256Hex, res.Header.Get("x-content-sha256"))
+		assert.Equal(t, blake3Hex, res.Header.Get("x-content-blake3"))
+		assert.Equal(t, xxhashHex, res.Header.Get("x-content-xxhash"))
+		assert.Equal(t, getMd5(content), res.Header.Get("x-content-md5"))
+		res, _ = request("HEAD", "/sum/a.txt", map[string]string{"x-checksum": "crc32"}, "")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "unsupported checksum [crc32]", res.Header.Get("x-error"))
+		res, _ = request("GET", "/sum/a.txt", map[string]string{"x-checksum": "xxhash"}, "")
+		assert.Equal(t, xxhashHex, res.Header.Get("x-content-xxhash"))
+		assert.Equal(t, "", res.Header.Get("x-content-sha256"))
+
+		// 列出目录时返回每个文件的摘要
+		res, data = request("GET", "/sum", map[string]string{"x-checksum": "sha256"}, "")
+		assert.Equal(t, sha256Hex, data.Get("data", "files", 0, "checksums", "sha256").ToString())
+		res, data = request("GET", "/sum", nil, "")
+		assert.Equal(t, jsoniter.InvalidValue, data.Get("data", "files", 0, "checksums").ValueType())
+
+		// 文件改变后重新计算
+		res, data = request("PUT", "/sum/a.txt", nil, "changed")
+		res, _ = request("HEAD", "/sum/a.txt", map[string]string{"x-checksum": "md5"}, "")
+		assert.Equal(t, getMd5([]byte("changed")), res.Header.Get("x-content-md5"))
+	}
+	{
+		// 打包下载目录
+		dir := filepath.Join(root, "arch")
+		if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("aaa"), 0640); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("bbb"), 0600); err != nil {
+			panic(err)
+		}
+		if err := os.Symlink("../file1.txt", filepath.Join(dir, "link")); err != nil {
+			panic(err)
+		}
+		// 上传和解压过程中的临时文件不打包
+		if err := ioutil.WriteFile(filepath.Join(dir, ".a.txt.0123456789abcdef0123456789abcdef.upload"), []byte("part"), 0600); err != nil {
+			panic(err)
+		}
+		for _, v := range []string{".app.1603000000-42.extract", ".app.1603000000-42.old"} {
+			if err := os.MkdirAll(filepath.Join(dir, v), 0755); err != nil {
+				panic(err)
+			}
+			if err := ioutil.WriteFile(filepath.Join(dir, v, "c.txt"), []byte("ccc"), 0644); err != nil {
+				panic(err)
+			}
+		}
+		mtime := time.Date(2020, 10, 18, 9, 47, 57, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(dir, "a.txt"), mtime, mtime); err != nil {
+			panic(err)
+		}
+		archive := func(path string) (*http.Response, []byte) {
+			req, err := http.NewRequest("GET", url+path, nil)
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, b
+		}
+
+		res, body := archive("/arch?archive=tar.gz")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "archive", res.Header.Get("x-file-type"))
+		assert.Equal(t, `attachment; filename="arch.tar.gz"`, res.Header.Get("content-disposition"))
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		assert.Equal(t, nil, err)
+		tr := tar.NewReader(gz)
+		names := make([]string, 0)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			assert.Equal(t, nil, err)
+			names = append(names, h.Name)
+			switch h.Name {
+			case "a.txt":
+				b, _ := ioutil.ReadAll(tr)
+				assert.Equal(t, "aaa", string(b))
+				assert.Equal(t, int64(0640), h.Mode&0777)
+				assert.Equal(t, mtime.Unix(), h.ModTime.Unix())
+			case "sub/b.txt":
+				b, _ := ioutil.ReadAll(tr)
+				assert.Equal(t, "bbb", string(b))
+				assert.Equal(t, int64(0600), h.Mode&0777)
+			case "link":
+				assert.Equal(t, byte(tar.TypeSymlink), h.Typeflag)
+				assert.Equal(t, "../file1.txt", h.Linkname)
+			}
+		}
+		assert.Equal(t, []string{"a.txt", "link", "sub/", "sub/b.txt"}, names)
+
+		res, body = archive("/arch?archive=zip")
+		assert.Equal(t, 200, res.StatusCode)
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		assert.Equal(t, nil, err)
+		names = make([]string, 0)
+		for _, f := range zr.File {
+			names = append(names, f.Name)
+			if f.Name == "sub/b.txt" {
+				r, err := f.Open()
+				assert.Equal(t, nil, err)
+				b, _ := ioutil.ReadAll(r)
+				r.Close()
+				assert.Equal(t, "bbb", string(b))
+				assert.Equal(t, os.FileMode(0600), f.Mode().Perm())
+			}
+			if f.Name == "a.txt" {
+				assert.Equal(t, mtime.Unix(), f.Modified.Unix())
+			}
+		}
+		assert.Equal(t, []string{"a.txt", "link", "sub/", "sub/b.txt"}, names)
+
+		res, body = archive("/arch?archive=rar")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "unsupported archive format [rar]", jsoniter.Get(body).Get("error").ToString())
+		res, body = archive("/../?archive=tar")
+		assert.Equal(t, 500, res.StatusCode)
+
+		// 不允许列出目录时也不允许打包
+		s.moduleFile.AllowListDir = false
+		res, body = archive("/arch?archive=tar")
+		assert.Equal(t, "not allowed [archive] dir", jsoniter.Get(body).Get("error").ToString())
+		s.moduleFile.AllowListDir = true
+		os.RemoveAll(dir)
+	}
+	{
+		// 上传打包的目录并解压
+		extract := func(path string, header map[string]string, body []byte) (*http.Response, jsoniter.Any) {
+			req, err := http.NewRequest("PUT", url+path, bytes.NewReader(body))
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, jsoniter.Get(b)
+		}
+		// 生成tar包，entries中的每一项为：名称、符号链接目标、内容
+		makeTar := func(entries [][3]string) []byte {
+			buf := bytes.NewBuffer(nil)
+			tw := tar.NewWriter(buf)
+			for _, v := range entries {
+				h := &tar.Header{Name: v[0], Mode: 0644, Size: int64(len(v[2])), Typeflag: tar.TypeReg}
+				if len(v[1]) > 0 {
+					h = &tar.Header{Name: v[0], Mode: 0777, Linkname: v[1], Typeflag: tar.TypeSymlink}
+				}
+				if err := tw.WriteHeader(h); err != nil {
+					panic(err)
+				}
+				if _, err := tw.Write([]byte(v[2])); err != nil {
+					panic(err)
+				}
+			}
+			if err := tw.Close(); err != nil {
+				panic(err)
+			}
+			return buf.Bytes()
+		}
+		// 检查根目录下没有遗留的临时目录
+		noTmpDir := func() {
+			list, err := ioutil.ReadDir(root)
+			assert.Equal(t, nil, err)
+			for _, v := range list {
+				assert.False(t, strings.HasSuffix(v.Name(), ".extract") || strings.HasSuffix(v.Name(), ".old"), v.Name())
+			}
+		}
+
+		src, err := ioutil.TempDir("", "tora-extract")
+		assert.Equal(t, nil, err)
+		defer os.RemoveAll(src)
+		if err := os.MkdirAll(filepath.Join(src, "sub"), 0755); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "a.txt"), []byte("aaa"), 0640); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "sub", "b.sh"), []byte("bbb"), 0755); err != nil {
+			panic(err)
+		}
+		if err := os.Symlink("../a.txt", filepath.Join(src, "sub", "link")); err != nil {
+			panic(err)
+		}
+		mtime := time.Date(2020, 10, 18, 9, 47, 57, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(src, "a.txt"), mtime, mtime); err != nil {
+			panic(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		assert.Equal(t, nil, common.WriteArchive(buf, "tar.gz", src, nil))
+		sha := sha256.Sum256(buf.Bytes())
+
+		s.moduleFile.AllowDelete = true
+		res, data := extract("/deploy/app?extract=1", map[string]string{"x-content-sha256": hex.EncodeToString(sha[:])}, buf.Bytes())
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "tar.gz", data.Get("data", "format").ToString())
+		assert.Equal(t, 2, data.Get("data", "files").ToInt())
+		assert.Equal(t, []string{"sha256"}, []string{data.Get("data", "checked", 0).ToString()})
+		dir := filepath.Join(root, "deploy", "app")
+		b, err := ioutil.ReadFile(filepath.Join(dir, "a.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "aaa", string(b))
+		info, err := os.Stat(filepath.Join(dir, "a.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+		assert.Equal(t, mtime.Unix(), info.ModTime().Unix())
+		info, err = os.Stat(filepath.Join(dir, "sub", "b.sh"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, os.FileMode(0755), info.Mode().Perm())
+		link, err := os.Readlink(filepath.Join(dir, "sub", "link"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "../a.txt", link)
+		noTmpDir()
+
+		// 替换已存在的目录
+		buf = bytes.NewBuffer(nil)
+		zw := zip.NewWriter(buf)
+		w, err := zw.Create("c.txt")
+		assert.Equal(t, nil, err)
+		w.Write([]byte("ccc"))
+		assert.Equal(t, nil, zw.Close())
+		res, data = extract("/deploy/app?extract=1", nil, buf.Bytes())
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "zip", data.Get("data", "format").ToString())
+		_, err = os.Stat(filepath.Join(dir, "a.txt"))
+		assert.True(t, os.IsNotExist(err))
+		b, err = ioutil.ReadFile(filepath.Join(dir, "c.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "ccc", string(b))
+		list, err := ioutil.ReadDir(filepath.Join(root, "deploy"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(list))
+
+		// 出错时不改变目标目录
+		tarFile := makeTar([][3]string{{"d.txt", "", "ddd"}})
+		res, data = extract("/deploy/app?extract=tar", map[string]string{"x-content-md5": getMd5([]byte("x"))}, tarFile)
+		assert.Equal(t, 500, res.StatusCode)
+		assert.True(t, strings.HasPrefix(data.Get("error").ToString(), "md5 check failed"))
+		res, data = extract("/deploy/app?extract=tar", nil, makeTar([][3]string{{"d.txt", "", "ddd"}, {"../evil.txt", "", "evil"}}))
+		assert.Equal(t, "invalid path [../evil.txt] in archive", data.Get("error").ToString())
+		res, data = extract("/deploy/app?extract=tar", nil, makeTar([][3]string{{"etc", "/etc", ""}}))
+		assert.Equal(t, "symlink [etc] points outside of archive", data.Get("error").ToString())
+		res, data = extract("/deploy/app?extract=tar", nil, makeTar([][3]string{{"up", "../..", ""}}))
+		assert.Equal(t, "symlink [up] points outside of archive", data.Get("error").ToString())
+		// 符号链接的目标在字面上位于目录之内，但通过其他链接解析后在目录之外
+		res, data = extract("/deploy/app?extract=tar", nil, makeTar([][3]string{{"sub/x.txt", "", "x"}, {"sub/parent", "..", ""}, {"up", "sub/parent/..", ""}}))
+		assert.Equal(t, "symlink [up] points outside of archive", data.Get("error").ToString())
+		// 经过包中其他符号链接的路径，不能在检查前删除或替换临时目录之外的文件
+		victim := filepath.Join(root, "deploy", "victim.txt")
+		if err := ioutil.WriteFile(victim, []byte("keep"), 0644); err != nil {
+			panic(err)
+		}
+		nested := makeTar([][3]string{{"a", "..", ""}, {"a/victim.txt", "pwned", ""}})
+		res, data = extract("/deploy/app?extract=tar", nil, nested)
+		assert.Equal(t, "symlink [a] points outside of archive", data.Get("error").ToString())
+		assert.Equal(t, "keep", readFile(victim))
+		// 不限制链接目标时（tora-cli get -archive）也不能经过链接写入目录之外
+		local := filepath.Join(root, "deploy", "local")
+		_, err = common.ExtractArchive(bytes.NewReader(makeTar([][3]string{{"a", "..", ""}, {"a/victim.txt", "pwned", ""}})), "tar", local, false)
+		assert.Equal(t, "invalid path [a/victim.txt] in archive", fmt.Sprint(err))
+		assert.Equal(t, "keep", readFile(victim))
+		os.RemoveAll(local)
+		os.Remove(victim)
+		res, data = extract("/deploy/app?extract=rar", nil, tarFile)
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "unsupported archive format [rar]", data.Get("error").ToString())
+		s.moduleFile.AllowDelete = false
+		res, data = extract("/deploy/app?extract=tar", nil, tarFile)
+		assert.Equal(t, "not allowed [DELETE] file", data.Get("error").ToString())
+		s.moduleFile.AllowDelete = true
+		_, err = os.Stat(filepath.Join(dir, "c.txt"))
+		assert.Equal(t, nil, err)
+		_, err = os.Stat(filepath.Join(dir, "d.txt"))
+		assert.True(t, os.IsNotExist(err))
+		_, err = os.Stat(filepath.Join(root, "evil.txt"))
+		assert.True(t, os.IsNotExist(err))
+		list, err = ioutil.ReadDir(filepath.Join(root, "deploy"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(list))
+		noTmpDir()
+
+		res, data = extract("/deploy/app/c.txt?extract=tar", nil, tarFile)
+		assert.Equal(t, "/deploy/app/c.txt is not a dir", data.Get("error").ToString())
+		res, data = extract("/?extract=tar", nil, tarFile)
+		assert.Equal(t, "cannot extract to /", data.Get("error").ToString())
+
+		// 包含不可访问的目录时，校验失败和替换后都能删除临时目录
+		buf = bytes.NewBuffer(nil)
+		tw := tar.NewWriter(buf)
+		tw.WriteHeader(&tar.Header{Name: "locked/", Mode: 0, Typeflag: tar.TypeDir})
+		tw.WriteHeader(&tar.Header{Name: "locked/x.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg})
+		tw.Write([]byte("x"))
+		assert.Equal(t, nil, tw.Close())
+		res, data = extract("/deploy/app?extract=tar", map[string]string{"x-content-md5": getMd5([]byte("x"))}, buf.Bytes())
+		assert.Equal(t, 500, res.StatusCode)
+		list, err = ioutil.ReadDir(filepath.Join(root, "deploy"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(list))
+		res, data = extract("/deploy/app?extract=tar", map[string]string{"x-content-md5": getMd5(buf.Bytes())}, buf.Bytes())
+		assert.Equal(t, 200, res.StatusCode)
+		info, err = os.Stat(filepath.Join(dir, "locked"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, os.FileMode(0), info.Mode().Perm())
+		res, data = extract("/deploy/app?extract=tar", nil, tarFile)
+		assert.Equal(t, 200, res.StatusCode)
+		_, err = os.Stat(filepath.Join(dir, "d.txt"))
+		assert.Equal(t, nil, err)
+		list, err = ioutil.ReadDir(filepath.Join(root, "deploy"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 1, len(list))
+		os.RemoveAll(filepath.Join(root, "deploy"))
+	}
+	{
+		// 分段上传
+		upload := func(method string, path string, header map[string]string, body string) (*http.Response, jsoniter.Any) {
+			req, err := http.NewRequest(method, url+path, strings.NewReader(body))
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			for k, v := range header {
+				req.Header.Set(k, v)
+			}
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			defer res.Body.Close()
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, jsoniter.Get(b)
+		}
+		res, data := upload("POST", "/upload/a.bin?upload", nil, "")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "missing or invalid [x-file-size] header", data.Get("error").ToString())
+
+		res, data = upload("POST", "/upload/a.bin?upload", map[string]string{"x-file-size": "10"}, "")
+		assert.Equal(t, 200, res.StatusCode)
+		id := data.Get("data", "id").ToString()
+		assert.Equal(t, 32, len(id))
+		assert.Equal(t, `[]`, data.Get("data", "received").ToString())
+		dataFile := filepath.Join(root, "upload", ".a.bin."+id+".upload")
+		_, err := os.Stat(dataFile)
+		assert.Equal(t, nil, err)
+
+		// 按任意顺序上传各部分
+		res, data = upload("PUT", "/upload/a.bin?upload="+id+"&offset=5", nil, "56789")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, `[[5,10]]`, data.Get("data", "received").ToString())
+		res, data = upload("POST", "/upload/a.bin?upload="+id, nil, "")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "upload incomplete: received 5 of 10 bytes", data.Get("error").ToString())
+		res, data = upload("PUT", "/upload/a.bin?upload="+id+"&offset=0", nil, "0123")
+		assert.Equal(t, `[[0,4],[5,10]]`, data.Get("data", "received").ToString())
+		res, data = upload("GET", "/upload/a.bin?upload="+id, nil, "")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, `[[0,4],[5,10]]`, data.Get("data", "received").ToString())
+		assert.Equal(t, false, data.Get("data", "complete").ToBool())
+		res, data = upload("PUT", "/upload/a.bin?upload="+id+"&offset=3", nil, "34")
+		assert.Equal(t, `[[0,10]]`, data.Get("data", "received").ToString())
+		assert.Equal(t, true, data.Get("data", "complete").ToBool())
+
+		// 超出文件大小
+		res, data = upload("PUT", "/upload/a.bin?upload="+id+"&offset=10", nil, "x")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "chunk exceeds file size 10", data.Get("error").ToString())
+		res, data = upload("PUT", "/upload/a.bin?upload="+id+"&offset=11", nil, "x")
+		assert.Equal(t, "invalid offset [11]", data.Get("error").ToString())
+		// 会话与文件路径不对应
+		res, data = upload("GET", "/upload/b.bin?upload="+id, nil, "")
+		assert.Equal(t, 404, res.StatusCode)
+
+		// 提交时校验md5
+		res, data = upload("POST", "/upload/a.bin?upload="+id, map[string]string{"x-content-md5": getMd5([]byte("bad"))}, "")
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		res, data = upload("POST", "/upload/a.bin?upload="+id, map[string]string{"x-content-md5": getMd5([]byte("0123456789"))}, "")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, true, data.Get("data", "checkedMd5").ToBool())
+		assert.Equal(t, "0123456789", readFile(filepath.Join(root, "upload", "a.bin")))
+		_, err = os.Stat(dataFile)
+		assert.Equal(t, true, os.IsNotExist(err))
+		res, data = upload("GET", "/upload/a.bin?upload="+id, nil, "")
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, "upload ["+id+"] not found", data.Get("error").ToString())
+
+		// 不允许直接访问会话状态目录
+		res, data = upload("GET", "/.tora-uploads", nil, "")
+		assert.Equal(t, "cannot access to /.tora-uploads", data.Get("error").ToString())
+
+		// 取消上传
+		_, data = upload("POST", "/upload/c.bin?upload", map[string]string{"x-file-size": "3"}, "")
+		id = data.Get("data", "id").ToString()
+		res, data = upload("DELETE", "/upload/c.bin?upload="+id, nil, "")
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		_, err = os.Stat(filepath.Join(root, "upload", ".c.bin."+id+".upload"))
+		assert.Equal(t, true, os.IsNotExist(err))
+
+		// 无效的会话id
+		res, data = upload("GET", "/upload/a.bin?upload=xyz", nil, "")
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, "upload [xyz] not found", data.Get("error").ToString())
+
+		// 有正在写入的部分时不能提交
+		_, data = upload("POST", "/upload/e.bin?upload", map[string]string{"x-file-size": "6"}, "")
+		id = data.Get("data", "id").ToString()
+		pr, pw := io.Pipe()
+		done := make(chan int)
+		go func() {
+			req, _ := http.NewRequest("PUT", url+"/upload/e.bin?upload="+id+"&offset=0", pr)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "file")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				done <- 0
+				return
+			}
+			res.Body.Close()
+			done <- res.StatusCode
+		}()
+		pw.Write([]byte("abc"))
+		for i := 0; i < 100 && readFile(filepath.Join(root, "upload", ".e.bin."+id+".upload")) != "abc"; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		upload("PUT", "/upload/e.bin?upload="+id+"&offset=3", nil, "def")
+		res, data = upload("POST", "/upload/e.bin?upload="+id, nil, "")
+		assert.Equal(t, 409, res.StatusCode)
+		assert.Equal(t, "upload ["+id+"] has chunks being written", data.Get("error").ToString())
+		pw.Close()
+		assert.Equal(t, 200, <-done)
+		res, data = upload("POST", "/upload/e.bin?upload="+id, nil, "")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, "abcdef", readFile(filepath.Join(root, "upload", "e.bin")))
+
+		// 过期的会话被删除
+		_, data = upload("POST", "/upload/d.bin?upload", map[string]string{"x-file-size": "3"}, "")
+		id = data.Get("data", "id").ToString()
+		s.moduleFile.UploadExpire = time.Millisecond
+		time.Sleep(10 * time.Millisecond)
+		res, data = upload("PUT", "/upload/d.bin?upload="+id+"&offset=0", nil, "abc")
+		assert.Equal(t, 404, res.StatusCode)
+		_, err = os.Stat(filepath.Join(root, "upload", ".d.bin."+id+".upload"))
+		assert.Equal(t, true, os.IsNotExist(err))
+	}
 	s.Close()
 }
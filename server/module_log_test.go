@@ -0,0 +1,616 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"github.com/json-iterator/go"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	neturl "net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModuleLog(t *testing.T) {
+	name := fmt.Sprintf("tora-%d-%d", time.Now().Unix(), rand.Uint32())
+	root := filepath.Join(os.TempDir(), name)
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+	appLog := filepath.Join(root, "app.log")
+	{
+		// 新建测试用的日志文件，最后一行未写完
+		lines := make([]string, 0)
+		for i := 1; i <= 200; i++ {
+			lines = append(lines, fmt.Sprintf("line %d", i))
+		}
+		if err := ioutil.WriteFile(appLog, []byte(strings.Join(lines, "\n")+"\npartial"), 0666); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "dated-1.log"), []byte("old\n"), 0666); err != nil {
+			panic(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "dated-2.log"), []byte("new\n"), 0666); err != nil {
+			panic(err)
+		}
+		jsonLines := []string{
+			`{"time":"2020-10-18T10:00:00Z","level":"info","msg":"a"}`,
+			`{"time":"2020-10-18T10:01:00Z","level":"error","msg":"b","user":{"id":1}}`,
+			`{"time":"2020-10-18T10:02:00Z","level":"WARN","msg":"c"}`,
+			`{"time":"2020-10-18T10:03:00Z","level":"error","msg":"d","user":{"id":2}}`,
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "json.log"), []byte(strings.Join(jsonLines, "\n")+"\n"), 0666); err != nil {
+			panic(err)
+		}
+		textLines := []string{
+			"2020-10-18 10:00:00 INFO start",
+			"2020-10-18 10:01:00 ERROR failed",
+			"  at foo",
+			"  at bar",
+			"2020-10-18 10:02:00 INFO done",
+		}
+		if err := ioutil.WriteFile(filepath.Join(root, "text.log"), []byte(strings.Join(textLines, "\n")+"\n"), 0666); err != nil {
+			panic(err)
+		}
+		// 轮转后的文件，包括压缩的文件
+		rotated := filepath.Join(root, "rotated")
+		if err := os.Mkdir(rotated, 0755); err != nil {
+			panic(err)
+		}
+		files := []struct {
+			name    string
+			content string
+			mtime   string
+		}{
+			{"svc.log.3.zst", "2020-10-18 09:00:00 three-a\n2020-10-18 09:00:30 three-b\n", "2020-10-18 09:00:30"},
+			{"svc.log.2.gz", "2020-10-18 10:00:00 two-a\n", "2020-10-18 10:00:00"},
+			{"svc.log.1", "  one-trace\n2020-10-18 11:00:00 one-a\n", "2020-10-18 11:00:00"},
+			{"svc.log", "2020-10-18 12:00:00 zero-a\n", ""},
+			{"svc.log.lock", "lock\n", ""},
+		}
+		for _, v := range files {
+			var buf bytes.Buffer
+			switch filepath.Ext(v.name) {
+			case ".gz":
+				w := gzip.NewWriter(&buf)
+				w.Write([]byte(v.content))
+				w.Close()
+			case ".zst":
+				w, _ := zstd.NewWriter(&buf)
+				w.Write([]byte(v.content))
+				w.Close()
+			default:
+				buf.WriteString(v.content)
+			}
+			file := filepath.Join(rotated, v.name)
+			if err := ioutil.WriteFile(file, buf.Bytes(), 0666); err != nil {
+				panic(err)
+			}
+			if len(v.mtime) > 0 {
+				mtime, _ := time.ParseInLocation("2006-01-02 15:04:05", v.mtime, time.Local)
+				if err := os.Chtimes(file, mtime, mtime); err != nil {
+					panic(err)
+				}
+			}
+		}
+		if err := os.Mkdir(filepath.Join(root, "ship"), 0755); err != nil {
+			panic(err)
+		}
+		past := time.Now().Add(-time.Hour)
+		if err := os.Chtimes(filepath.Join(root, "dated-1.log"), past, past); err != nil {
+			panic(err)
+		}
+	}
+
+	addr, url := getRandomPort()
+	s, err := NewServer(Options{
+		Log:    logrus.New(),
+		Addr:   addr,
+		Enable: []string{"log", "file"},
+		FileOptions: FileOptions{
+			Root: root,
+		},
+		LogOptions: LogOptions{
+			Sources: map[string]LogSource{
+				"app":     {Path: appLog},
+				"dated":   {Path: filepath.Join(root, "dated-*.log")},
+				"missing": {Path: filepath.Join(root, "missing.log")},
+				"json":    {Path: filepath.Join(root, "json.log")},
+				"text":    {Path: filepath.Join(root, "text.log")},
+				"svc":     {Path: filepath.Join(root, "rotated", "svc.log")},
+				"ship":    {Path: filepath.Join(root, "ship", "ship.log")},
+			},
+			PollInterval: 50 * time.Millisecond,
+			Streams: map[string]LogStream{
+				"jobs": {Path: filepath.Join(root, "streams", "jobs.log"), MaxSize: 20, MaxFiles: 2, Allow: []string{"testtoken"}},
+			},
+			MaxBodySize: 1024,
+		},
+		Auth: Auth{
+			Token: map[string]AuthItem{
+				"testtoken": {
+					Allow:   true,
+					Modules: []string{"log"},
+				},
+				"filetoken": {
+					Allow:   true,
+					Modules: []string{"file"},
+				},
+				"readtoken": {
+					Allow:   true,
+					Modules: []string{"log"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	go s.Start()
+	defer s.Close()
+	time.Sleep(time.Second)
+
+	request := func(path string, token string) (*http.Response, jsoniter.Any) {
+		req, err := http.NewRequest("GET", url+path, nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", token)
+		req.Header.Set("x-module", "log")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		return res, jsoniter.Get(body)
+	}
+	postWithToken := func(path string, token string, contentType string, body string) (*http.Response, jsoniter.Any) {
+		req, err := http.NewRequest("POST", url+path, strings.NewReader(body))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", token)
+		req.Header.Set("x-module", "log")
+		req.Header.Set("content-type", contentType)
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		return res, jsoniter.Get(b)
+	}
+	post := func(path string, contentType string, body string) (*http.Response, jsoniter.Any) {
+		return postWithToken(path, "testtoken", contentType, body)
+	}
+	// 跟踪日志，返回逐行读取响应内容的通道
+	follow := func(path string, header map[string]string) (chan string, context.CancelFunc) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, err := http.NewRequest("GET", url+path, nil)
+		assert.Equal(t, nil, err)
+		req = req.WithContext(ctx)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "log")
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 200, res.StatusCode)
+		ch := make(chan string, 100)
+		go func() {
+			defer res.Body.Close()
+			defer close(ch)
+			r := bufio.NewReader(res.Body)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				ch <- strings.TrimSuffix(line, "\n")
+			}
+		}()
+		return ch, cancel
+	}
+	next := func(ch chan string) string {
+		select {
+		case line, ok := <-ch:
+			if !ok {
+				return "<closed>"
+			}
+			return line
+		case <-time.After(5 * time.Second):
+			return "<timeout>"
+		}
+	}
+	sse := map[string]string{"accept": "text/event-stream"}
+	// 读取一个 Server-Sent Events 事件
+	nextEvent := func(ch chan string) (id string, event string, data jsoniter.Any) {
+		for {
+			line := next(ch)
+			switch {
+			case strings.HasPrefix(line, "id: "):
+				id = line[4:]
+			case strings.HasPrefix(line, "event: "):
+				event = line[7:]
+			case strings.HasPrefix(line, "data: "):
+				data = jsoniter.Get([]byte(line[6:]))
+			default:
+				if data == nil {
+					data = jsoniter.Get(nil)
+				}
+				return
+			}
+		}
+	}
+	appendFile := func(file string, data string) {
+		f, err := os.OpenFile(file, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0666)
+		if err != nil {
+			panic(err)
+		}
+		defer f.Close()
+		if _, err := f.WriteString(data); err != nil {
+			panic(err)
+		}
+	}
+
+	{
+		// 列出日志源
+		res, data := request("/", "testtoken")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, 8, data.Get("data", "sources").Size())
+		assert.Equal(t, "app", data.Get("data", "sources", 0, "name").ToString())
+		assert.Equal(t, appLog, data.Get("data", "sources", 0, "file").ToString())
+		assert.Equal(t, "dated", data.Get("data", "sources", 1, "name").ToString())
+		assert.Equal(t, filepath.Join(root, "dated-2.log"), data.Get("data", "sources", 1, "file").ToString())
+		assert.Equal(t, "missing", data.Get("data", "sources", 4, "name").ToString())
+		assert.Equal(t, "", data.Get("data", "sources", 4, "file").ToString())
+		assert.Equal(t, "jobs", data.Get("data", "sources", 2, "name").ToString())
+		assert.Equal(t, true, data.Get("data", "sources", 2, "stream").ToBool())
+		assert.Equal(t, false, data.Get("data", "sources", 0, "stream").ToBool())
+		assert.Equal(t, "svc", data.Get("data", "sources", 6, "name").ToString())
+		assert.Equal(t, 3, data.Get("data", "sources", 6, "rotated").Size())
+		assert.Equal(t, filepath.Join(root, "rotated", "svc.log.3.zst"), data.Get("data", "sources", 6, "rotated", 0, "file").ToString())
+		assert.Equal(t, filepath.Join(root, "rotated", "svc.log.1"), data.Get("data", "sources", 6, "rotated", 2, "file").ToString())
+	}
+	{
+		// 读取末尾的行，包括未写完的最后一行
+		res, data := request("/app?lines=3", "testtoken")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, appLog, data.Get("data", "file").ToString())
+		assert.Equal(t, `["line 199","line 200","partial"]`, data.Get("data", "lines").ToString())
+	}
+	{
+		// 默认返回100行
+		_, data := request("/app", "testtoken")
+		assert.Equal(t, 100, data.Get("data", "lines").Size())
+		assert.Equal(t, "line 102", data.Get("data", "lines", 0).ToString())
+	}
+	{
+		// 匹配多个文件时作为一个日志，按最后修改时间排列
+		_, data := request("/dated?lines=10", "testtoken")
+		assert.Equal(t, `["old","new"]`, data.Get("data", "lines").ToString())
+		_, data = request("/dated?lines=1", "testtoken")
+		assert.Equal(t, `["new"]`, data.Get("data", "lines").ToString())
+	}
+	{
+		// 参数错误
+		res, data := request("/app?lines=abc", "testtoken")
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		assert.Equal(t, "invalid lines [abc]", data.Get("error").ToString())
+	}
+	{
+		// 日志源不存在
+		res, data := request("/unknown", "testtoken")
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, "source [unknown] not found", data.Get("error").ToString())
+	}
+	{
+		// 日志文件不存在
+		res, data := request("/missing", "testtoken")
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, fmt.Sprintf("no such file [%s]", filepath.Join(root, "missing.log")), data.Get("error").ToString())
+	}
+	{
+		// 没有权限
+		res, _ := request("/app", "filetoken")
+		assert.Equal(t, 403, res.StatusCode)
+	}
+	{
+		// 写入日志，忽略空行
+		jobsLog := filepath.Join(root, "streams", "jobs.log")
+		_, data := request("/jobs", "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+		res, data := post("/jobs", "text/plain", "hello\r\n\nworld")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, jobsLog, data.Get("data", "file").ToString())
+		assert.Equal(t, 2, data.Get("data", "lines").ToInt())
+		assert.Equal(t, 12, data.Get("data", "bytes").ToInt())
+		_, data = request("/jobs", "testtoken")
+		assert.Equal(t, `["hello","world"]`, data.Get("data", "lines").ToString())
+
+		// 每行需要是一个JSON
+		res, data = post("/jobs", "application/x-ndjson", "{\"a\":1}\n{\"a\":")
+		assert.Equal(t, 400, res.StatusCode)
+		assert.Equal(t, "invalid json at line 2", data.Get("error").ToString())
+		// 超过大小时先轮转
+		res, data = post("/jobs", "application/x-ndjson", "{\"a\":1}\n{\"a\":2}\n")
+		assert.Equal(t, 200, res.StatusCode)
+		assert.Equal(t, 2, data.Get("data", "lines").ToInt())
+		assert.Equal(t, "hello\nworld\n", readFile(jobsLog+".1"))
+		assert.Equal(t, "{\"a\":1}\n{\"a\":2}\n", readFile(jobsLog))
+		// 仅保留 MaxFiles 个轮转后的文件
+		for i := 3; i <= 6; i++ {
+			post("/jobs", "application/x-ndjson", fmt.Sprintf("{\"a\":%d,\"padding\":\"xxxxxxxxxxxx\"}", i))
+		}
+		assert.Equal(t, "{\"a\":6,\"padding\":\"xxxxxxxxxxxx\"}\n", readFile(jobsLog))
+		assert.Equal(t, "{\"a\":5,\"padding\":\"xxxxxxxxxxxx\"}\n", readFile(jobsLog+".1"))
+		assert.Equal(t, "{\"a\":4,\"padding\":\"xxxxxxxxxxxx\"}\n", readFile(jobsLog+".2"))
+		_, err := os.Stat(jobsLog + ".3")
+		assert.Equal(t, true, os.IsNotExist(err))
+		_, data = request("/jobs?field=a=5&field=a=6", "testtoken")
+		assert.Equal(t, 2, data.Get("data", "lines").Size())
+
+		res, data = post("/jobs", "text/plain", strings.Repeat("x", 1025))
+		assert.Equal(t, 413, res.StatusCode)
+		assert.Equal(t, "request body too large, max size is 1024", data.Get("error").ToString())
+		res, data = post("/app", "text/plain", "hello")
+		assert.Equal(t, 404, res.StatusCode)
+		assert.Equal(t, "stream [app] not found", data.Get("error").ToString())
+	}
+	{
+		// 不在写入流的 allow 中的 token 可以读取但不能写入
+		jobsLog := filepath.Join(root, "streams", "jobs.log")
+		before := readFile(jobsLog)
+		res, data := postWithToken("/jobs", "readtoken", "text/plain", "hello")
+		assert.Equal(t, 403, res.StatusCode)
+		assert.Equal(t, "permission denied for stream [jobs]", data.Get("error").ToString())
+		assert.Equal(t, before, readFile(jobsLog))
+		res, _ = request("/jobs", "readtoken")
+		assert.Equal(t, 200, res.StatusCode)
+	}
+	{
+		// 读取轮转后的文件，包括压缩的文件
+		_, data := request("/svc", "testtoken")
+		assert.Equal(t, filepath.Join(root, "rotated", "svc.log"), data.Get("data", "file").ToString())
+		assert.Equal(t, `["2020-10-18 09:00:00 three-a","2020-10-18 09:00:30 three-b","2020-10-18 10:00:00 two-a","  one-trace","2020-10-18 11:00:00 one-a","2020-10-18 12:00:00 zero-a"]`, data.Get("data", "lines").ToString())
+		_, data = request("/svc?lines=3", "testtoken")
+		assert.Equal(t, `["  one-trace","2020-10-18 11:00:00 one-a","2020-10-18 12:00:00 zero-a"]`, data.Get("data", "lines").ToString())
+		_, data = request("/svc?grep=three", "testtoken")
+		assert.Equal(t, `["2020-10-18 09:00:00 three-a","2020-10-18 09:00:30 three-b"]`, data.Get("data", "lines").ToString())
+		// 文件开头没有时间的行使用前一个文件最后的时间
+		_, data = request("/svc?since="+neturl.QueryEscape("2020-10-18 10:00:00")+"&until="+neturl.QueryEscape("2020-10-18 10:30:00"), "testtoken")
+		assert.Equal(t, `["2020-10-18 10:00:00 two-a","  one-trace"]`, data.Get("data", "lines").ToString())
+		_, data = request("/svc?since="+neturl.QueryEscape("2020-10-18 09:00:10")+"&until="+neturl.QueryEscape("2020-10-18 11:00:00"), "testtoken")
+		assert.Equal(t, `["2020-10-18 09:00:30 three-b","2020-10-18 10:00:00 two-a","  one-trace","2020-10-18 11:00:00 one-a"]`, data.Get("data", "lines").ToString())
+	}
+	{
+		// 按正则表达式过滤
+		_, data := request("/app?lines=3&grep="+neturl.QueryEscape(`^line 1\d$`), "testtoken")
+		assert.Equal(t, `["line 17","line 18","line 19"]`, data.Get("data", "lines").ToString())
+		_, data = request("/app?grep=^line&invert=1", "testtoken")
+		assert.Equal(t, `["partial"]`, data.Get("data", "lines").ToString())
+		res, data := request("/app?grep=(", "testtoken")
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, true, strings.HasPrefix(data.Get("error").ToString(), "invalid grep [(]: "))
+	}
+	{
+		// 按JSON格式日志的字段过滤，同一字段指定多次时匹配任意一个值，不区分大小写
+		msgs := func(data jsoniter.Any) []string {
+			list := make([]string, 0)
+			for i := 0; i < data.Get("data", "lines").Size(); i++ {
+				list = append(list, jsoniter.Get([]byte(data.Get("data", "lines", i).ToString()), "msg").ToString())
+			}
+			return list
+		}
+		_, data := request("/json?field=level=error", "testtoken")
+		assert.Equal(t, []string{"b", "d"}, msgs(data))
+		_, data = request("/json?field=level=error&field=level=warn", "testtoken")
+		assert.Equal(t, []string{"b", "c", "d"}, msgs(data))
+		_, data = request("/json?field=user.id=2", "testtoken")
+		assert.Equal(t, []string{"d"}, msgs(data))
+		_, data = request("/json?field=level=error&lines=1", "testtoken")
+		assert.Equal(t, []string{"d"}, msgs(data))
+		_, data = request("/json?since=2020-10-18T10:01:30Z&until=2020-10-18T10:02:30Z", "testtoken")
+		assert.Equal(t, []string{"c"}, msgs(data))
+		_, data = request("/text?field=level=error", "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+		res, data := request("/json?field=level", "testtoken")
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, "invalid field [level]", data.Get("error").ToString())
+		res, data = request("/json?since=yesterday", "testtoken")
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, "invalid since [yesterday]", data.Get("error").ToString())
+	}
+	{
+		// 按时间过滤，没有时间的行使用前面最近的有时间的行的时间
+		query := "since=" + neturl.QueryEscape("2020-10-18 10:00:30") + "&until=" + neturl.QueryEscape("2020-10-18 10:01:30")
+		_, data := request("/text?"+query, "testtoken")
+		assert.Equal(t, `["2020-10-18 10:01:00 ERROR failed","  at foo","  at bar"]`, data.Get("data", "lines").ToString())
+		_, data = request("/text?lines=2&"+query, "testtoken")
+		assert.Equal(t, `["  at foo","  at bar"]`, data.Get("data", "lines").ToString())
+		_, data = request("/text?grep=at&"+query, "testtoken")
+		assert.Equal(t, `["  at foo","  at bar"]`, data.Get("data", "lines").ToString())
+		_, data = request("/text?since=10m", "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+	}
+	{
+		// 跟踪时过滤
+		textLog := filepath.Join(root, "text.log")
+		ch, cancel := follow("/text?follow=1&lines=10&grep=ERROR", nil)
+		assert.Equal(t, "2020-10-18 10:01:00 ERROR failed", next(ch))
+		appendFile(textLog, "2020-10-18 10:03:00 INFO x\n2020-10-18 10:04:00 ERROR y\n")
+		assert.Equal(t, "2020-10-18 10:04:00 ERROR y", next(ch))
+		cancel()
+	}
+	{
+		// 跟踪时日志时间晚于until后结束
+		jsonLog := filepath.Join(root, "json.log")
+		ch, _ := follow("/json?follow=1&until=2020-10-18T10:05:00Z", nil)
+		appendFile(jsonLog, `{"time":"2020-10-18T10:04:00Z","msg":"e"}`+"\n")
+		assert.Equal(t, `{"time":"2020-10-18T10:04:00Z","msg":"e"}`, next(ch))
+		appendFile(jsonLog, `{"time":"2020-10-18T10:06:00Z","msg":"f"}`+"\n")
+		assert.Equal(t, "<closed>", next(ch))
+	}
+	{
+		// 以文本方式跟踪，未写完的行在写完后输出
+		ch, cancel := follow("/app?follow=1&lines=2", nil)
+		assert.Equal(t, "line 199", next(ch))
+		assert.Equal(t, "line 200", next(ch))
+		appendFile(appLog, " line\nline 201\n")
+		assert.Equal(t, "partial line", next(ch))
+		assert.Equal(t, "line 201", next(ch))
+		cancel()
+	}
+	{
+		// 以 Server-Sent Events 方式跟踪，包括日志轮转和截断
+		ch, cancel := follow("/app?follow=1", sse)
+		appendFile(appLog, "line 202\n")
+		id, event, data := nextEvent(ch)
+		assert.Equal(t, "line", event)
+		assert.Equal(t, appLog, data.Get("file").ToString())
+		assert.Equal(t, fileSize(appLog)-9, data.Get("offset").ToInt64())
+		assert.Equal(t, "line 202", data.Get("text").ToString())
+		assert.Equal(t, id, data.Get("cursor").ToString())
+
+		// 重命名后重新创建文件（logrotate）
+		if err := os.Rename(appLog, appLog+".1"); err != nil {
+			panic(err)
+		}
+		appendFile(appLog+".1", "line 203\n")
+		appendFile(appLog, "rotated 1\n")
+		_, event, data = nextEvent(ch)
+		assert.Equal(t, "line", event)
+		// 旧文件中剩余的行仍使用打开时的文件名
+		assert.Equal(t, appLog, data.Get("file").ToString())
+		assert.Equal(t, fileSize(appLog+".1")-9, data.Get("offset").ToInt64())
+		assert.Equal(t, "line 203", data.Get("text").ToString())
+		_, event, data = nextEvent(ch)
+		assert.Equal(t, "rotate", event)
+		assert.Equal(t, fmt.Sprintf(`{"file":%s}`, jsonStringify(appLog)), data.ToString())
+		_, event, data = nextEvent(ch)
+		assert.Equal(t, "line", event)
+		assert.Equal(t, int64(0), data.Get("offset").ToInt64())
+		assert.Equal(t, "rotated 1", data.Get("text").ToString())
+
+		// 截断文件（copytruncate）
+		if err := os.Truncate(appLog, 0); err != nil {
+			panic(err)
+		}
+		time.Sleep(200 * time.Millisecond)
+		appendFile(appLog, "truncated\n")
+		_, event, data = nextEvent(ch)
+		assert.Equal(t, "truncate", event)
+		assert.Equal(t, fmt.Sprintf(`{"file":%s}`, jsonStringify(appLog)), data.ToString())
+		_, event, data = nextEvent(ch)
+		assert.Equal(t, "line", event)
+		assert.Equal(t, int64(0), data.Get("offset").ToInt64())
+		assert.Equal(t, "truncated", data.Get("text").ToString())
+		cancel()
+	}
+	{
+		// 通过游标继续读取
+		_, data := request("/svc?lines=2", "testtoken")
+		assert.Equal(t, `["2020-10-18 11:00:00 one-a","2020-10-18 12:00:00 zero-a"]`, data.Get("data", "lines").ToString())
+		assert.Equal(t, 2, data.Get("data", "cursors").Size())
+		end := data.Get("data", "cursor").ToString()
+		assert.Equal(t, data.Get("data", "cursors", 1).ToString(), end)
+		_, data = request("/svc?after="+data.Get("data", "cursors", 0).ToString(), "testtoken")
+		assert.Equal(t, `["2020-10-18 12:00:00 zero-a"]`, data.Get("data", "lines").ToString())
+		assert.Equal(t, end, data.Get("data", "cursor").ToString())
+		_, data = request("/svc?after="+end, "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+		assert.Equal(t, end, data.Get("data", "cursor").ToString())
+
+		// 从压缩的文件中的游标继续读取
+		_, data = request("/svc?grep=three-a", "testtoken")
+		_, data = request("/svc?lines=2&after="+data.Get("data", "cursors", 0).ToString(), "testtoken")
+		assert.Equal(t, `["2020-10-18 09:00:30 three-b","2020-10-18 10:00:00 two-a"]`, data.Get("data", "lines").ToString())
+		_, data = request("/svc?after="+data.Get("data", "cursor").ToString(), "testtoken")
+		assert.Equal(t, `["  one-trace","2020-10-18 11:00:00 one-a","2020-10-18 12:00:00 zero-a"]`, data.Get("data", "lines").ToString())
+		assert.Equal(t, end, data.Get("data", "cursor").ToString())
+		_, data = request("/svc?grep=two&after="+data.Get("data", "cursor").ToString(), "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+
+		res, data := request("/svc?after=xyz", "testtoken")
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, "invalid cursor [xyz]", data.Get("error").ToString())
+	}
+	{
+		// 文件被轮转和压缩后仍然可以通过游标继续读取
+		shipLog := filepath.Join(root, "ship", "ship.log")
+		appendFile(shipLog, "a\nb\n")
+		_, data := request("/ship?lines=2", "testtoken")
+		after := data.Get("data", "cursors", 0).ToString()
+		if err := os.Rename(shipLog, shipLog+".1"); err != nil {
+			panic(err)
+		}
+		appendFile(shipLog, "c\n")
+		_, data = request("/ship?after="+after, "testtoken")
+		assert.Equal(t, `["b","c"]`, data.Get("data", "lines").ToString())
+		assert.Equal(t, false, data.Get("data", "reset").ToBool())
+
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		w.Write([]byte("a\nb\n"))
+		w.Close()
+		if err := ioutil.WriteFile(shipLog+".1.gz", buf.Bytes(), 0666); err != nil {
+			panic(err)
+		}
+		past := time.Now().Add(-time.Minute)
+		if err := os.Chtimes(shipLog+".1.gz", past, past); err != nil {
+			panic(err)
+		}
+		if err := os.Remove(shipLog + ".1"); err != nil {
+			panic(err)
+		}
+		_, data = request("/ship?after="+after, "testtoken")
+		assert.Equal(t, `["b","c"]`, data.Get("data", "lines").ToString())
+
+		// 断开连接后通过 Last-Event-ID 继续跟踪
+		ch, cancel := follow("/ship?follow=1", map[string]string{"accept": "text/event-stream", "last-event-id": after})
+		_, _, data = nextEvent(ch)
+		assert.Equal(t, shipLog+".1.gz", data.Get("file").ToString())
+		assert.Equal(t, "b", data.Get("text").ToString())
+		_, _, data = nextEvent(ch)
+		assert.Equal(t, shipLog, data.Get("file").ToString())
+		assert.Equal(t, "c", data.Get("text").ToString())
+		appendFile(shipLog, "d\n")
+		id, _, data := nextEvent(ch)
+		assert.Equal(t, "d", data.Get("text").ToString())
+		cancel()
+		_, data = request("/ship?after="+id, "testtoken")
+		assert.Equal(t, `[]`, data.Get("data", "lines").ToString())
+
+		// 游标所在的文件不存在时从最早的文件开始读取
+		_, data = request("/text?lines=1", "testtoken")
+		_, data = request("/ship?after="+data.Get("data", "cursor").ToString(), "testtoken")
+		assert.Equal(t, true, data.Get("data", "reset").ToBool())
+		assert.Equal(t, `["a","b","c","d"]`, data.Get("data", "lines").ToString())
+	}
+}
+
+func readFile(file string) string {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+func fileSize(file string) int64 {
+	info, err := os.Stat(file)
+	if err != nil {
+		panic(err)
+	}
+	return info.Size()
+}
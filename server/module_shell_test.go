@@ -0,0 +1,1054 @@
+package server
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"github.com/json-iterator/go"
+	"github.com/leizongmin/tora/module/shell"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestModuleShell(t *testing.T) {
+	name := fmt.Sprintf("tora-%d-%d", time.Now().Unix(), rand.Uint32())
+	root := filepath.Join(os.TempDir(), name)
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+	historyDir := root + "-history"
+	defer os.RemoveAll(historyDir)
+	fileRoot := root + "-file"
+	if err := os.Mkdir(fileRoot, 0755); err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(fileRoot)
+	secretFile := root + "-secret"
+	if err := ioutil.WriteFile(secretFile, []byte("s3cr3t-value\n"), 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(secretFile)
+	taskSecretFile := root + "-task-secret"
+	if err := ioutil.WriteFile(taskSecretFile, []byte("task-secret"), 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(taskSecretFile)
+	multilineSecretFile := root + "-multiline-secret"
+	if err := ioutil.WriteFile(multilineSecretFile, []byte("-----BEGIN KEY-----\nfirst-line-secret\nsecond-line-secret\n-----END KEY-----\n"), 0600); err != nil {
+		panic(err)
+	}
+	defer os.Remove(multilineSecretFile)
+	os.Setenv("TORA_TEST_HIDDEN", "hidden")
+	defer os.Unsetenv("TORA_TEST_HIDDEN")
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		panic(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "hello.txt"), []byte("hello"), 0644); err != nil {
+		panic(err)
+	}
+	if err := os.Symlink("/", filepath.Join(root, "link")); err != nil {
+		panic(err)
+	}
+
+	tasks := map[string]shell.Task{
+		"hello": {
+			CWD: "sub",
+			Env: map[string]string{"GREETING": "hello"},
+			Params: map[string]shell.TaskParam{
+				"NAME":  {Pattern: "[a-z]+", Default: "world"},
+				"TIMES": {Pattern: "[0-9]", Required: true},
+			},
+			Run: shell.CommandSteps("printf '%s %s %s' $GREETING ${NAME} ${TIMES}", "cat hello.txt"),
+		},
+		"output": {
+			Run:    shell.CommandSteps("yes"),
+			Limits: shell.ResourceLimits{OutputSize: 1000},
+		},
+	}
+	tasks["secret"] = shell.Task{
+		Run:     shell.CommandSteps(`sh -c 'echo $API_TOKEN $TASK_SECRET'`),
+		Secrets: map[string]string{"TASK_SECRET": taskSecretFile},
+	}
+	tasks["multiline-secret"] = shell.Task{
+		Run:     shell.CommandSteps(`sh -c 'echo "$KEY"'`),
+		Secrets: map[string]string{"KEY": multilineSecretFile},
+	}
+	if runtime.GOOS == "linux" {
+		tasks["ulimit"] = shell.Task{
+			Run:    shell.CommandSteps(`sh -c "ulimit -n"`),
+			Limits: shell.ResourceLimits{OpenFiles: 64},
+		}
+		tasks["ulimit-as"] = shell.Task{
+			Run:    shell.CommandSteps(`sh -c "ulimit -v"`),
+			Limits: shell.ResourceLimits{AddressSpace: shell.MinAddressSpace},
+		}
+	}
+	if os.Getuid() == 0 {
+		tasks["nobody"] = shell.Task{
+			Run:       shell.CommandSteps("id -u", `sh -c 'echo $USER'`),
+			RunAsUser: "nobody",
+		}
+		tasks["nobody-cat"] = shell.Task{
+			Run:       shell.CommandSteps("cat /"),
+			RunAsUser: "nobody",
+		}
+	}
+
+	addr, url := getRandomPort()
+	s, err := NewServer(Options{
+		Log:    logrus.New(),
+		Addr:   addr,
+		Enable: []string{"shell", "file"},
+		FileOptions: FileOptions{
+			Root: fileRoot,
+		},
+		ShellOptions: ShellOptions{
+			Root:                  root,
+			AllowExternalCommands: []string{"echo", "pwd", "false", "sleep", "sh"},
+			Tasks:                 tasks,
+			HistoryDir:            historyDir,
+			HistoryOutputSize:     100,
+			AllowPtyCommands:      []string{"sh"},
+			CleanEnv:              true,
+			AllowEnv:              []string{"PATH", "LANG", "LC_*"},
+			Env:                   map[string]string{"TORA_ENV": "test"},
+			Secrets:               map[string]string{"API_TOKEN": secretFile},
+		},
+		Auth: Auth{
+			Token: map[string]AuthItem{
+				"testtoken": {
+					Allow:   true,
+					Modules: []string{"shell"},
+				},
+				"filetoken": {
+					Allow:   true,
+					Modules: []string{"file"},
+				},
+				"bothtoken": {
+					Allow:   true,
+					Modules: []string{"shell", "file"},
+				},
+			},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	go s.Start()
+	time.Sleep(time.Second)
+
+	exec := func(token string, info JSON) (*http.Response, jsoniter.Any) {
+		req, err := http.NewRequest("POST", url+"/exec", bytes.NewReader([]byte(jsonStringify(info))))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", token)
+		req.Header.Set("x-module", "shell")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		return res, jsoniter.Get(body)
+	}
+
+	{
+		// 没有shell模块的访问权限
+		res, data := exec("filetoken", JSON{"run": []string{"echo hello"}})
+		assert.Equal(t, 403, res.StatusCode)
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		assert.Equal(t, "permission denied for module [shell]", data.Get("error").ToString())
+	}
+	{
+		// 执行成功，变量替换
+		_, data := exec("testtoken", JSON{
+			"cwd":       "sub",
+			"define":    JSON{"NAME": "tora world"},
+			"run":       []string{"echo hello ${NAME}", "pwd"},
+			"onSuccess": []string{"echo 'ok $NAME'"},
+			"onError":   []string{"echo error"},
+			"onEnd":     []string{"echo end"},
+		})
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, 0, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, 4, data.Get("data", "steps").Size())
+		assert.Equal(t, "run", data.Get("data", "steps", 0, "stage").ToString())
+		assert.Equal(t, "hello tora world\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, filepath.Join(root, "sub")+"\n", data.Get("data", "steps", 1, "stdout").ToString())
+		assert.Equal(t, "onSuccess", data.Get("data", "steps", 2, "stage").ToString())
+		assert.Equal(t, "ok $NAME\n", data.Get("data", "steps", 2, "stdout").ToString())
+		assert.Equal(t, "onEnd", data.Get("data", "steps", 3, "stage").ToString())
+		assert.Equal(t, "end\n", data.Get("data", "steps", 3, "stdout").ToString())
+	}
+	{
+		// 执行失败，跳过后续命令并执行onError
+		_, data := exec("testtoken", JSON{
+			"run":       []string{"echo a", "false", "echo b"},
+			"onSuccess": []string{"echo ok"},
+			"onError":   []string{"echo error"},
+			"onEnd":     []string{"echo end"},
+		})
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, 1, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, 4, data.Get("data", "steps").Size())
+		assert.Equal(t, "false", data.Get("data", "steps", 1, "command").ToString())
+		assert.Equal(t, 1, data.Get("data", "steps", 1, "exitCode").ToInt())
+		assert.Equal(t, "onError", data.Get("data", "steps", 2, "stage").ToString())
+		assert.Equal(t, "error\n", data.Get("data", "steps", 2, "stdout").ToString())
+		assert.Equal(t, "onEnd", data.Get("data", "steps", 3, "stage").ToString())
+	}
+	{
+		// 不允许执行的命令和未定义的变量
+		_, data := exec("testtoken", JSON{
+			"run":     []string{"rm -rf /"},
+			"onError": []string{"echo ${UNKNOWN}"},
+		})
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, -1, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, "command [rm] not allowed", data.Get("data", "steps", 0, "error").ToString())
+		assert.Equal(t, "undefined variable [UNKNOWN]", data.Get("data", "steps", 1, "error").ToString())
+	}
+	{
+		// 工作目录不能超出根目录
+		res, data := exec("testtoken", JSON{"cwd": "../..", "run": []string{"pwd"}})
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, "cannot access to ../..", data.Get("error").ToString())
+		_, data = exec("testtoken", JSON{"cwd": "/sub/../../etc", "run": []string{"pwd"}})
+		assert.Equal(t, "cannot access to /sub/../../etc", data.Get("error").ToString())
+		_, data = exec("testtoken", JSON{"cwd": "/sub/..", "run": []string{"pwd"}})
+		assert.Equal(t, root+"\n", data.Get("data", "steps", 0, "stdout").ToString())
+		// 指向根目录以外的符号链接不能作为工作目录
+		res, data = exec("testtoken", JSON{"cwd": "link", "run": []string{"pwd"}})
+		assert.Equal(t, 500, res.StatusCode)
+		assert.Equal(t, "cannot access to /link", data.Get("error").ToString())
+		res, data = exec("testtoken", JSON{"cwd": "link/tmp", "run": []string{"pwd"}})
+		assert.Equal(t, "cannot access to /link/tmp", data.Get("error").ToString())
+		// 执行过程中工作目录被替换为符号链接后，外部命令不再在其中执行
+		if err := os.Mkdir(filepath.Join(root, "moving"), 0755); err != nil {
+			panic(err)
+		}
+		_, data = exec("testtoken", JSON{"cwd": "moving", "run": []string{`sh -c "cd .. && rmdir moving && ln -s / moving"`, "pwd"}})
+		assert.Equal(t, 0, data.Get("data", "steps", 0, "exitCode").ToInt())
+		assert.Equal(t, "cannot access to /moving", data.Get("data", "steps", 1, "error").ToString())
+		assert.Equal(t, "", data.Get("data", "steps", 1, "stdout").ToString())
+		os.Remove(filepath.Join(root, "moving"))
+	}
+	{
+		// 内部命令
+		_, data := exec("testtoken", JSON{
+			"run": []string{"cd sub", "list", "cat hello.txt", "list /", "cd ..", "run pwd"},
+		})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "hello.txt\n", data.Get("data", "steps", 1, "stdout").ToString())
+		assert.Equal(t, "hello", data.Get("data", "steps", 2, "stdout").ToString())
+		assert.Equal(t, "link\nsub/\n", data.Get("data", "steps", 3, "stdout").ToString())
+		assert.Equal(t, root+"\n", data.Get("data", "steps", 5, "stdout").ToString())
+	}
+	{
+		// 内部命令不能访问根目录以外的文件
+		_, data := exec("testtoken", JSON{
+			"run":     []string{"list link/etc"},
+			"onError": []string{"cd ../../..", "list"},
+		})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, 1, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, "cannot access to /link/etc", data.Get("data", "steps", 0, "error").ToString())
+		assert.Equal(t, "link\nsub/\n", data.Get("data", "steps", 2, "stdout").ToString())
+	}
+	{
+		// exit 命令停止执行后续命令，run 命令只能执行允许的外部命令
+		_, data := exec("testtoken", JSON{
+			"run":       []string{"run echo a", "exit", "echo b"},
+			"onSuccess": []string{"run rm -rf /", "echo c"},
+			"onError":   []string{"echo d"},
+			"onEnd":     []string{"exit 3", "echo e"},
+		})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, 3, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, 4, data.Get("data", "steps").Size())
+		assert.Equal(t, "a\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "exit", data.Get("data", "steps", 1, "command").ToString())
+		assert.Equal(t, "command [rm] not allowed", data.Get("data", "steps", 2, "error").ToString())
+		assert.Equal(t, "exit 3", data.Get("data", "steps", 3, "command").ToString())
+	}
+	{
+		// 以 Server-Sent Events 方式实时输出
+		info := JSON{"run": []string{"echo a", "false"}, "onError": []string{"echo b"}}
+		req, err := http.NewRequest("POST", url+"/exec", bytes.NewReader([]byte(jsonStringify(info))))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "shell")
+		req.Header.Set("accept", "text/event-stream")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "text/event-stream; charset=utf-8", res.Header.Get("content-type"))
+		body, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, strings.Join([]string{
+			`event: stepStart`,
+			`data: {"type":"stepStart","step":0,"stage":"run","command":"echo a"}`,
+			``,
+			`event: stdout`,
+			`data: {"type":"stdout","step":0,"data":"a\n"}`,
+			``,
+			`event: stepEnd`,
+			`data: {"type":"stepEnd","step":0,"stage":"run","command":"echo a"}`,
+			``,
+			`event: stepStart`,
+			`data: {"type":"stepStart","step":1,"stage":"run","command":"false"}`,
+			``,
+			`event: stepEnd`,
+			`data: {"type":"stepEnd","step":1,"stage":"run","command":"false","exitCode":1}`,
+			``,
+			`event: stepStart`,
+			`data: {"type":"stepStart","step":2,"stage":"onError","command":"echo b"}`,
+			``,
+			`event: stdout`,
+			`data: {"type":"stdout","step":2,"data":"b\n"}`,
+			``,
+			`event: stepEnd`,
+			`data: {"type":"stepEnd","step":2,"stage":"onError","command":"echo b"}`,
+			``,
+			`event: end`,
+			`data: {"type":"end","step":3,"exitCode":1}`,
+			``,
+			``,
+		}, "\n"), string(body))
+	}
+	request := func(method string, path string, body []byte) jsoniter.Any {
+		req, err := http.NewRequest(method, url+path, bytes.NewReader(body))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "shell")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		return jsoniter.Get(b)
+	}
+	waitJob := func(id string) jsoniter.Any {
+		for i := 0; i < 50; i++ {
+			data := request("GET", "/jobs/"+id, nil)
+			if status := data.Get("data", "job", "status").ToString(); status != "running" && status != "queued" {
+				return data
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		panic("wait job timeout")
+	}
+	{
+		// 异步执行
+		data := request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"sleep 0.2", "echo done"}})))
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, "running", data.Get("data", "status").ToString())
+		id := data.Get("data", "id").ToString()
+		assert.Equal(t, 16, len(id))
+
+		data = waitJob(id)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, id, data.Get("data", "job", "id").ToString())
+		assert.Equal(t, "success", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, 0, data.Get("data", "job", "exitCode").ToInt())
+		assert.Equal(t, "done\n", data.Get("data", "job", "steps", 1, "stdout").ToString())
+
+		// 同步执行的记录也包含在列表中，最后一个为刚提交的任务
+		data = request("GET", "/jobs", nil)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		last := data.Get("data", "jobs").Size() - 1
+		assert.Equal(t, id, data.Get("data", "jobs", last, "id").ToString())
+		assert.Equal(t, "success", data.Get("data", "jobs", last, "status").ToString())
+
+		data = request("DELETE", "/jobs/"+id, nil)
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		assert.Equal(t, fmt.Sprintf("job [%s] is not running", id), data.Get("error").ToString())
+	}
+	{
+		// 取消异步任务，取消后不再执行后续命令
+		data := request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"echo start", "sleep 30"}, "onEnd": []string{"echo end"}})))
+		id := data.Get("data", "id").ToString()
+		time.Sleep(200 * time.Millisecond)
+		data = request("GET", "/jobs/"+id, nil)
+		assert.Equal(t, "running", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, "start\n", data.Get("data", "job", "steps", 0, "stdout").ToString())
+
+		// 其他token不能查看或取消此任务
+		for _, method := range []string{"GET", "DELETE"} {
+			req, err := http.NewRequest(method, url+"/jobs/"+id, nil)
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "bothtoken")
+			req.Header.Set("x-module", "shell")
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			assert.Equal(t, 404, res.StatusCode)
+			assert.Equal(t, fmt.Sprintf("job [%s] not found", id), jsoniter.Get(b, "error").ToString())
+		}
+		data = request("GET", "/jobs/"+id, nil)
+		assert.Equal(t, "running", data.Get("data", "job", "status").ToString())
+
+		data = request("DELETE", "/jobs/"+id, nil)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, true, data.Get("data", "canceled").ToBool())
+
+		data = waitJob(id)
+		assert.Equal(t, "canceled", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, 2, data.Get("data", "job", "steps").Size())
+		assert.NotEqual(t, 0, data.Get("data", "job", "exitCode").ToInt())
+	}
+	{
+		// 持有相同锁的执行依次进行，后提交的进入队列
+		data := request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"sleep 0.5"}, "lock": "deploy"})))
+		assert.Equal(t, "running", data.Get("data", "status").ToString())
+		first := data.Get("data", "id").ToString()
+		data = request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"echo second"}, "lock": "deploy"})))
+		assert.Equal(t, "queued", data.Get("data", "status").ToString())
+		assert.Equal(t, 1, data.Get("data", "queuePosition").ToInt())
+		second := data.Get("data", "id").ToString()
+		data = request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"echo third"}, "lock": "deploy"})))
+		assert.Equal(t, 2, data.Get("data", "queuePosition").ToInt())
+		third := data.Get("data", "id").ToString()
+
+		// 不同的锁不受影响
+		_, data = exec("testtoken", JSON{"run": []string{"echo other"}, "lock": "other"})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+
+		// 不等待时返回409
+		req, err := http.NewRequest("POST", url+"/exec?wait=0", bytes.NewReader([]byte(jsonStringify(JSON{"run": []string{"echo x"}, "lock": "deploy"}))))
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "shell")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 409, res.StatusCode)
+		assert.Equal(t, "lock [deploy] is held by another execution", jsoniter.Get(b).Get("error").ToString())
+
+		// 取消排队中的任务
+		data = request("POST", "/exec?async=1", []byte(jsonStringify(JSON{"run": []string{"echo canceled"}, "lock": "deploy"})))
+		canceled := data.Get("data", "id").ToString()
+		data = request("DELETE", "/jobs/"+canceled, nil)
+		assert.Equal(t, true, data.Get("data", "canceled").ToBool())
+		data = waitJob(canceled)
+		assert.Equal(t, "canceled", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, 0, data.Get("data", "job", "steps").Size())
+
+		data = waitJob(first)
+		assert.Equal(t, "success", data.Get("data", "job", "status").ToString())
+		firstEnd := data.Get("data", "job", "endTime").ToString()
+		data = waitJob(second)
+		assert.Equal(t, "success", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, "second\n", data.Get("data", "job", "steps", 0, "stdout").ToString())
+		secondStart := data.Get("data", "job", "startTime").ToString()
+		firstEndTime, _ := time.Parse(time.RFC3339Nano, firstEnd)
+		secondStartTime, _ := time.Parse(time.RFC3339Nano, secondStart)
+		assert.Equal(t, false, secondStartTime.Before(firstEndTime))
+		data = waitJob(third)
+		assert.Equal(t, "success", data.Get("data", "job", "status").ToString())
+	}
+	{
+		// 任务不存在
+		data := request("GET", "/jobs/notfound", nil)
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		assert.Equal(t, "job [notfound] not found", data.Get("error").ToString())
+	}
+	{
+		// 总超时后结束命令，仍执行onError和onEnd
+		start := time.Now()
+		_, data := exec("testtoken", JSON{
+			"run":     []string{"echo a", "sleep 30"},
+			"onError": []string{"echo error"},
+			"onEnd":   []string{"echo end"},
+			"timeout": 1,
+		})
+		assert.Equal(t, true, time.Since(start) < 5*time.Second)
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, -1, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, 4, data.Get("data", "steps").Size())
+		assert.Equal(t, "killed after timeout", data.Get("data", "steps", 1, "error").ToString())
+		assert.Equal(t, "error\n", data.Get("data", "steps", 2, "stdout").ToString())
+		assert.Equal(t, "end\n", data.Get("data", "steps", 3, "stdout").ToString())
+	}
+	{
+		// 单条命令超时后结束其整个进程组，如果后台的 sleep 未被结束，则会因为仍占用标准输出而一直等待
+		start := time.Now()
+		_, data := exec("testtoken", JSON{
+			"run":         []string{`sh -c "sleep 30 & echo $!; wait"`},
+			"stepTimeout": 1,
+		})
+		assert.Equal(t, true, time.Since(start) < 5*time.Second)
+		assert.Equal(t, "killed after timeout", data.Get("data", "steps", 0, "error").ToString())
+	}
+	{
+		// onError 和 onEnd 阶段受 CleanupTimeout 限制
+		s.moduleShell.CleanupTimeout = time.Second
+		start := time.Now()
+		_, data := exec("testtoken", JSON{"run": []string{"false"}, "onEnd": []string{"sleep 30", "echo end"}})
+		assert.Equal(t, true, time.Since(start) < 5*time.Second)
+		assert.Equal(t, 2, data.Get("data", "steps").Size())
+		assert.Equal(t, "killed after timeout", data.Get("data", "steps", 1, "error").ToString())
+		s.moduleShell.CleanupTimeout = shell.DefaultCleanupTimeout
+	}
+	{
+		// 服务器端限制最大超时时间
+		s.moduleShell.MaxStepTimeout = time.Second
+		start := time.Now()
+		_, data := exec("testtoken", JSON{"run": []string{"sleep 30"}, "stepTimeout": 60})
+		assert.Equal(t, true, time.Since(start) < 5*time.Second)
+		assert.Equal(t, "killed after timeout", data.Get("data", "steps", 0, "error").ToString())
+		s.moduleShell.MaxStepTimeout = 0
+	}
+	{
+		// 任务列表
+		data := request("GET", "/tasks", nil)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, len(tasks), data.Get("data", "tasks").Size())
+		assert.Equal(t, "hello", data.Get("data", "tasks", 0, "name").ToString())
+		assert.Equal(t, "[a-z]+", data.Get("data", "tasks", 0, "params", "NAME", "pattern").ToString())
+	}
+	{
+		// 执行任务，任务中的命令不受允许执行的命令列表限制
+		data := request("POST", "/tasks/hello", []byte(jsonStringify(JSON{"params": JSON{"TIMES": "3"}})))
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "hello world 3", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "hello", data.Get("data", "steps", 1, "stdout").ToString())
+
+		data = request("POST", "/tasks/hello?async=1", []byte(jsonStringify(JSON{"params": JSON{"NAME": "tora", "TIMES": "1"}})))
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		data = waitJob(data.Get("data", "id").ToString())
+		assert.Equal(t, "hello", data.Get("data", "job", "info", "task").ToString())
+		assert.Equal(t, "hello tora 1", data.Get("data", "job", "steps", 0, "stdout").ToString())
+	}
+	{
+		// 参数校验
+		data := request("POST", "/tasks/hello", []byte(jsonStringify(JSON{"params": JSON{"NAME": "a b", "TIMES": "1"}})))
+		assert.Equal(t, false, data.Get("ok").ToBool())
+		assert.Equal(t, "invalid param [NAME]: must match [a-z]+", data.Get("error").ToString())
+		data = request("POST", "/tasks/hello", nil)
+		assert.Equal(t, "missing param [TIMES]", data.Get("error").ToString())
+		data = request("POST", "/tasks/hello", []byte(jsonStringify(JSON{"params": JSON{"TIMES": "1", "CMD": "rm"}})))
+		assert.Equal(t, "unknown param [CMD]", data.Get("error").ToString())
+		data = request("POST", "/tasks/notfound", nil)
+		assert.Equal(t, "task [notfound] not found", data.Get("error").ToString())
+	}
+	{
+		// 直接执行时不能冒充任务
+		_, data := exec("testtoken", JSON{"task": "hello", "run": []string{"printf hello"}})
+		assert.Equal(t, "command [printf] not allowed", data.Get("data", "steps", 0, "error").ToString())
+	}
+	{
+		// 输出超过限制时结束命令
+		data := request("POST", "/tasks/output", nil)
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, "output exceeds limit of 1000 bytes", data.Get("data", "steps", 0, "error").ToString())
+		assert.Equal(t, 1000, len(data.Get("data", "steps", 0, "stdout").ToString()))
+	}
+	{
+		// 执行记录
+		since := time.Now().Format(time.RFC3339Nano)
+		_, data := exec("testtoken", JSON{"run": []string{"sh -c 'yes | head -c 1000'", "false"}})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+
+		data = request("GET", "/jobs?since="+since+"&token=testtoken", nil)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, 1, data.Get("data", "jobs").Size())
+		assert.Equal(t, "failed", data.Get("data", "jobs", 0, "status").ToString())
+		assert.Equal(t, "te****en", data.Get("data", "jobs", 0, "token").ToString())
+		assert.Equal(t, "127.0.0.1", data.Get("data", "jobs", 0, "ip").ToString())
+		id := data.Get("data", "jobs", 0, "id").ToString()
+
+		data = request("GET", "/jobs/"+id, nil)
+		assert.Equal(t, true, data.Get("ok").ToBool())
+		assert.Equal(t, "failed", data.Get("data", "job", "status").ToString())
+		assert.Equal(t, 1, data.Get("data", "job", "exitCode").ToInt())
+		assert.Equal(t, "...(truncated 900 bytes)\n"+strings.Repeat("y\n", 50), data.Get("data", "job", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "", data.Get("data", "job", "tokenHash").ToString())
+		req, err := http.NewRequest("GET", url+"/jobs/"+id, nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "bothtoken")
+		req.Header.Set("x-module", "shell")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 404, res.StatusCode)
+		res.Body.Close()
+
+		// 使用token的客户端仅能查看自己发起的任务，token参数无效
+		data = request("GET", "/jobs?since="+since+"&token=othertoken", nil)
+		assert.Equal(t, 1, data.Get("data", "jobs").Size())
+		req, err = http.NewRequest("GET", url+"/jobs?since="+since+"&token=testtoken", nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "bothtoken")
+		req.Header.Set("x-module", "shell")
+		res, err = http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Equal(t, 0, jsoniter.Get(b, "data", "jobs").Size())
+		data = request("GET", "/jobs?since=abc", nil)
+		assert.Equal(t, "invalid since [abc]", data.Get("error").ToString())
+	}
+	{
+		// 伪终端
+		dial := func(token string, query string) (*websocket.Conn, *http.Response, error) {
+			header := http.Header{}
+			header.Set("x-token", token)
+			header.Set("x-module", "shell")
+			return websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(url, "http")+"/pty?"+query, header)
+		}
+		_, res, err := dial("filetoken", "command=sh")
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, 403, res.StatusCode)
+		_, res, err = dial("testtoken", "command=bash")
+		assert.Equal(t, websocket.ErrBadHandshake, err)
+		assert.Equal(t, 403, res.StatusCode)
+
+		since := time.Now().Format(time.RFC3339Nano)
+		conn, _, err := dial("testtoken", "command=sh&cwd=sub&cols=100&rows=30")
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		assert.Equal(t, nil, conn.WriteMessage(websocket.TextMessage, []byte(`{"type":"resize","cols":120,"rows":40}`)))
+		assert.Equal(t, nil, conn.WriteMessage(websocket.BinaryMessage, []byte("stty size; pwd; exit 3\n")))
+		var output bytes.Buffer
+		var exit jsoniter.Any
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for exit == nil {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if messageType == websocket.TextMessage {
+				exit = jsoniter.Get(data)
+			} else {
+				output.Write(data)
+			}
+		}
+		assert.Equal(t, "exit", exit.Get("type").ToString())
+		assert.Equal(t, 3, exit.Get("exitCode").ToInt())
+		assert.Contains(t, output.String(), "40 120\r\n")
+		assert.Contains(t, output.String(), filepath.Join(root, "sub")+"\r\n")
+
+		// 伪终端同样保存执行记录，但不保存输出
+		data := request("GET", "/jobs?since="+since, nil)
+		assert.Equal(t, 1, data.Get("data", "jobs").Size())
+		assert.Equal(t, "failed", data.Get("data", "jobs", 0, "status").ToString())
+		assert.Equal(t, 3, data.Get("data", "jobs", 0, "exitCode").ToInt())
+		data = request("GET", "/jobs/"+data.Get("data", "jobs", 0, "id").ToString(), nil)
+		assert.Equal(t, "sh", data.Get("data", "job", "steps", 0, "command").ToString())
+		assert.Equal(t, "", data.Get("data", "job", "steps", 0, "stdout").ToString())
+
+		// 超过最大超时时间时结束进程
+		s.moduleShell.MaxTimeout = time.Second
+		conn, _, err = dial("testtoken", "command=sh&arg=-c&arg=sleep%2030")
+		assert.Equal(t, nil, err)
+		defer conn.Close()
+		exit = nil
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for exit == nil {
+			messageType, data, err := conn.ReadMessage()
+			if err != nil {
+				break
+			}
+			if messageType == websocket.TextMessage {
+				exit = jsoniter.Get(data)
+			}
+		}
+		assert.Equal(t, -1, exit.Get("exitCode").ToInt())
+		assert.Equal(t, "killed after timeout", exit.Get("error").ToString())
+		s.moduleShell.MaxTimeout = 0
+	}
+	if _, ok := tasks["ulimit"]; ok {
+		// 资源限制
+		data := request("POST", "/tasks/ulimit", nil)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "64\n", data.Get("data", "steps", 0, "stdout").ToString())
+		// 最小的虚拟内存限制下仍能启动命令
+		data = request("POST", "/tasks/ulimit-as", nil)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "16384\n", data.Get("data", "steps", 0, "stdout").ToString())
+	}
+	if _, ok := tasks["nobody"]; ok {
+		// 以指定用户身份执行
+		data := request("POST", "/tasks/nobody", nil)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		u, err := user.Lookup("nobody")
+		assert.Equal(t, nil, err)
+		assert.Equal(t, u.Uid+"\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "nobody\n", data.Get("data", "steps", 1, "stdout").ToString())
+		// 读取文件的内部命令在进程内执行，指定运行身份时不允许执行
+		data = request("POST", "/tasks/nobody-cat", nil)
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, "internal command [cat] not allowed when running as another user", data.Get("data", "steps", 0, "error").ToString())
+	}
+	{
+		// 通过multipart上传标准输入
+		execMultipart := func(query string, info JSON, stdin string) (*http.Response, []byte) {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			part, err := w.CreateFormField("info")
+			assert.Equal(t, nil, err)
+			part.Write([]byte(jsonStringify(info)))
+			if len(stdin) > 0 {
+				part, err = w.CreateFormFile("stdin", "stdin")
+				assert.Equal(t, nil, err)
+				part.Write([]byte(stdin))
+			}
+			assert.Equal(t, nil, w.Close())
+			req, err := http.NewRequest("POST", url+"/exec"+query, &body)
+			assert.Equal(t, nil, err)
+			req.Header.Set("x-token", "testtoken")
+			req.Header.Set("x-module", "shell")
+			req.Header.Set("content-type", w.FormDataContentType())
+			res, err := http.DefaultClient.Do(req)
+			assert.Equal(t, nil, err)
+			b, err := ioutil.ReadAll(res.Body)
+			assert.Equal(t, nil, err)
+			return res, b
+		}
+		_, b := execMultipart("", JSON{"run": []string{"sh -c 'cat; echo'", "sh -c 'cat; echo end'"}}, "from stdin")
+		data := jsoniter.Get(b)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "from stdin\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "end\n", data.Get("data", "steps", 1, "stdout").ToString())
+
+		_, b = execMultipart("?async=1", JSON{"run": []string{"sh -c 'cat'"}}, "from stdin")
+		assert.Equal(t, "stdin is not supported in async mode", jsoniter.Get(b).Get("error").ToString())
+
+		// 以tar格式返回产物
+		res, b := execMultipart("?artifacts=tar", JSON{
+			"run":       []string{"sh -c 'mkdir -p build/out/lib && cat > build/out/app.txt && echo lib > build/out/lib/a.txt'"},
+			"artifacts": []string{"build/out", "/sub/hello.txt"},
+		}, "app")
+		assert.Equal(t, "application/x-tar", res.Header.Get("content-type"))
+		assert.Equal(t, "true", res.Header.Get("x-exec-success"))
+		assert.Equal(t, "0", res.Header.Get("x-exec-exit-code"))
+		files := make(map[string]string)
+		tr := tar.NewReader(bytes.NewReader(b))
+		for {
+			h, err := tr.Next()
+			if err != nil {
+				assert.Equal(t, io.EOF, err)
+				break
+			}
+			content, err := ioutil.ReadAll(tr)
+			assert.Equal(t, nil, err)
+			files[h.Name] = string(content)
+		}
+		assert.Equal(t, map[string]string{
+			"build/out/":          "",
+			"build/out/app.txt":   "app",
+			"build/out/lib/":      "",
+			"build/out/lib/a.txt": "lib\n",
+			"sub/hello.txt":       "hello",
+		}, files)
+
+		// 执行失败时返回JSON结果
+		res, b = execMultipart("?artifacts=tar", JSON{"run": []string{"false"}, "artifacts": []string{"out"}}, "")
+		assert.Equal(t, "application/json", res.Header.Get("content-type"))
+		assert.Equal(t, false, jsoniter.Get(b).Get("data", "success").ToBool())
+		_, b = execMultipart("?artifacts=tar", JSON{"run": []string{"echo"}, "artifacts": []string{"/missing"}}, "")
+		assert.Equal(t, false, jsoniter.Get(b).Get("data", "success").ToBool())
+		assert.Equal(t, "artifact [/missing]: no such file or directory", jsoniter.Get(b).Get("data", "error").ToString())
+		_, b = execMultipart("?artifacts=tar", JSON{"run": []string{"echo"}, "artifacts": []string{"../link/etc/passwd"}}, "")
+		assert.Equal(t, "cannot access to /link/etc/passwd", jsoniter.Get(b).Get("error").ToString())
+	}
+	{
+		// 保存产物到file模块的根目录
+		_, data := exec("testtoken", JSON{"cwd": "build", "run": []string{"echo"}, "artifacts": []string{"out"}, "artifactsTo": "dist"})
+		assert.Equal(t, "permission denied for module [file]", data.Get("error").ToString())
+
+		_, data = exec("bothtoken", JSON{"cwd": "build", "run": []string{"echo"}, "artifacts": []string{"out/app.txt"}, "artifactsTo": "../dist"})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "build/out/app.txt", data.Get("data", "artifacts", 0, "path").ToString())
+		assert.Equal(t, 3, data.Get("data", "artifacts", 0, "size").ToInt())
+		b, err := ioutil.ReadFile(filepath.Join(fileRoot, "dist", "build", "out", "app.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "app", string(b))
+
+		_, data = exec("bothtoken", JSON{"run": []string{"echo"}, "artifacts": []string{"missing"}, "artifactsTo": "dist"})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, -1, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, "artifact [missing]: no such file or directory", data.Get("data", "error").ToString())
+
+		// 已存在的符号链接被替换，而不是写入其指向的文件
+		outside, err := ioutil.TempDir("", "tora-outside")
+		assert.Equal(t, nil, err)
+		defer os.RemoveAll(outside)
+		assert.Equal(t, nil, ioutil.WriteFile(filepath.Join(outside, "app.txt"), []byte("outside"), 0644))
+		target := filepath.Join(fileRoot, "dist", "build", "out", "app.txt")
+		assert.Equal(t, nil, os.Remove(target))
+		assert.Equal(t, nil, os.Symlink(filepath.Join(outside, "app.txt"), target))
+		_, data = exec("bothtoken", JSON{"cwd": "build", "run": []string{"echo"}, "artifacts": []string{"out/app.txt"}, "artifactsTo": "/dist"})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		b, err = ioutil.ReadFile(filepath.Join(outside, "app.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "outside", string(b))
+		s, err := os.Lstat(target)
+		assert.Equal(t, nil, err)
+		assert.True(t, s.Mode().IsRegular())
+
+		// 保存位置经过符号链接后位于根目录之外
+		assert.Equal(t, nil, os.Symlink(outside, filepath.Join(fileRoot, "outside")))
+		_, data = exec("bothtoken", JSON{"cwd": "build", "run": []string{"echo"}, "artifacts": []string{"out/app.txt"}, "artifactsTo": "/outside/dist"})
+		assert.Equal(t, "cannot access to /outside/dist", data.Get("error").ToString())
+		// 保存位置之下的目录为指向根目录之外的符号链接
+		assert.Equal(t, nil, os.Remove(filepath.Join(fileRoot, "dist", "build", "out", "app.txt")))
+		assert.Equal(t, nil, os.Remove(filepath.Join(fileRoot, "dist", "build", "out")))
+		assert.Equal(t, nil, os.Symlink(outside, filepath.Join(fileRoot, "dist", "build", "out")))
+		_, data = exec("bothtoken", JSON{"cwd": "build", "run": []string{"echo"}, "artifacts": []string{"out/app.txt"}, "artifactsTo": "/dist"})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, "cannot access to /dist/build/out", data.Get("data", "error").ToString())
+		b, err = ioutil.ReadFile(filepath.Join(outside, "app.txt"))
+		assert.Equal(t, nil, err)
+		assert.Equal(t, "outside", string(b))
+	}
+	{
+		// 并行执行，等待全部结束
+		_, data := exec("testtoken", JSON{"run": []interface{}{
+			JSON{"parallel": []string{"sh -c 'sleep 1; echo a'", "sh -c 'sleep 1; echo b'"}},
+			"echo done",
+		}})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		// 根据命令的开始和结束时间判断同一组的命令同时执行，且下一步骤在全部结束后才开始
+		assert.True(t, stepTime(data, 0, "startTime").Before(stepTime(data, 1, "endTime")))
+		assert.True(t, stepTime(data, 1, "startTime").Before(stepTime(data, 0, "endTime")))
+		assert.False(t, stepTime(data, 2, "startTime").Before(stepTime(data, 0, "endTime")))
+		assert.False(t, stepTime(data, 2, "startTime").Before(stepTime(data, 1, "endTime")))
+		assert.Equal(t, 3, data.Get("data", "steps").Size())
+		assert.Equal(t, "a\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, 1, data.Get("data", "steps", 0, "group").ToInt())
+		assert.Equal(t, "b\n", data.Get("data", "steps", 1, "stdout").ToString())
+		assert.Equal(t, 1, data.Get("data", "steps", 1, "group").ToInt())
+		assert.Equal(t, 0, data.Get("data", "steps", 2, "group").ToInt())
+
+		_, data = exec("testtoken", JSON{"run": []interface{}{
+			JSON{"parallel": []string{"sh -c 'exit 3'", "sh -c 'sleep 1; echo ok'"}},
+			"echo skipped",
+		}})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, 3, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, 2, data.Get("data", "steps").Size())
+		assert.Equal(t, "ok\n", data.Get("data", "steps", 1, "stdout").ToString())
+		assert.Equal(t, 0, data.Get("data", "steps", 1, "exitCode").ToInt())
+	}
+	{
+		// 并行执行，有命令失败时结束其他命令，未结束的命令被结束后退出码为-1
+		_, data := exec("testtoken", JSON{"run": []interface{}{
+			JSON{"parallel": []string{"sh -c 'sleep 0.2; exit 3'", "sleep 5"}, "failFast": true},
+		}})
+		assert.Equal(t, 3, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, -1, data.Get("data", "steps", 1, "exitCode").ToInt())
+
+		_, data = exec("testtoken", JSON{"run": []interface{}{JSON{"parallel": []string{"cd sub", "echo a"}}}})
+		assert.Equal(t, "command [cd] is not supported in parallel", data.Get("data", "steps", 0, "error").ToString())
+	}
+	{
+		// 失败后重试
+		_, data := exec("testtoken", JSON{"cwd": "build", "run": []interface{}{
+			JSON{"command": "sh -c 'echo x >> count; test $(wc -l < count) -ge 3'", "retries": 5},
+		}})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, 3, data.Get("data", "steps").Size())
+		assert.Equal(t, 1, data.Get("data", "steps", 0, "attempt").ToInt())
+		assert.Equal(t, 1, data.Get("data", "steps", 0, "exitCode").ToInt())
+		assert.Equal(t, 3, data.Get("data", "steps", 2, "attempt").ToInt())
+		assert.Equal(t, 0, data.Get("data", "steps", 2, "exitCode").ToInt())
+
+		_, data = exec("testtoken", JSON{"run": []interface{}{
+			JSON{"command": "false", "retries": 1, "backoff": 1},
+		}})
+		assert.Equal(t, false, data.Get("data", "success").ToBool())
+		assert.Equal(t, 2, data.Get("data", "steps").Size())
+		assert.Equal(t, 2, data.Get("data", "steps", 1, "attempt").ToInt())
+		// 重试前等待backoff指定的时间
+		assert.True(t, stepTime(data, 1, "startTime").Sub(stepTime(data, 0, "endTime")) >= time.Second)
+	}
+	{
+		// 失败后继续执行
+		_, data := exec("testtoken", JSON{"run": []interface{}{
+			JSON{"command": "false", "continueOnError": true},
+			"echo next",
+		}})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, 0, data.Get("data", "exitCode").ToInt())
+		assert.Equal(t, true, data.Get("data", "steps", 0, "ignored").ToBool())
+		assert.Equal(t, "next\n", data.Get("data", "steps", 1, "stdout").ToString())
+
+		_, data = exec("testtoken", JSON{"run": []interface{}{JSON{"command": "echo", "parallel": []string{"echo"}}}})
+		assert.Equal(t, "invalid run step [0]: either command or parallel should be specified", data.Get("error").ToString())
+	}
+	{
+		// 环境变量和密钥
+		_, data := exec("testtoken", JSON{"run": []string{
+			`sh -c 'echo $TORA_ENV ${TORA_TEST_HIDDEN:-none}'`,
+			`sh -c 'echo token=$API_TOKEN; echo $API_TOKEN >&2; test ${#API_TOKEN} -eq 12'`,
+			`sh -c 'echo $API_TOKEN > secret.txt'`,
+			"cat secret.txt",
+		}})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "test none\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "token=****\n", data.Get("data", "steps", 1, "stdout").ToString())
+		assert.Equal(t, "****\n", data.Get("data", "steps", 1, "stderr").ToString())
+		assert.Equal(t, "****\n", data.Get("data", "steps", 3, "stdout").ToString())
+		os.Remove(filepath.Join(root, "secret.txt"))
+
+		// 直接执行时define仅用于替换命令中的变量，不作为环境变量传递，不能覆盖受控的变量
+		_, data = exec("testtoken", JSON{
+			"define": JSON{"LD_PRELOAD": "/nonexistent/evil.so", "TORA_ENV": "override", "PATH": "/nonexistent", "FOO": "foo"},
+			"run":    []string{`sh -c 'echo "[$LD_PRELOAD][$TORA_ENV][$FOO]"'`, "echo ${FOO}"},
+		})
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "[][test][]\n", data.Get("data", "steps", 0, "stdout").ToString())
+		assert.Equal(t, "", data.Get("data", "steps", 0, "stderr").ToString())
+		assert.Equal(t, "foo\n", data.Get("data", "steps", 1, "stdout").ToString())
+
+		data = request("POST", "/tasks/secret", nil)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "**** ****\n", data.Get("data", "steps", 0, "stdout").ToString())
+
+		// 多行的密钥在同步执行的结果中整体替换，在实时输出中逐行替换
+		data = request("POST", "/tasks/multiline-secret", nil)
+		assert.Equal(t, true, data.Get("data", "success").ToBool())
+		assert.Equal(t, "****\n", data.Get("data", "steps", 0, "stdout").ToString())
+		req, err := http.NewRequest("POST", url+"/tasks/multiline-secret", nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "shell")
+		req.Header.Set("accept", "text/event-stream")
+		res, err := http.DefaultClient.Do(req)
+		assert.Equal(t, nil, err)
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		assert.Contains(t, string(b), `"data":"****\n"`)
+		assert.NotContains(t, string(b), "line-secret")
+		assert.NotContains(t, string(b), "KEY-----")
+	}
+	s.Close()
+}
+
+// 执行结果中第i条命令的开始或结束时间
+func stepTime(data jsoniter.Any, i int, field string) time.Time {
+	t, err := time.Parse(time.RFC3339Nano, data.Get("data", "steps", i, field).ToString())
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func TestModuleShellSchedule(t *testing.T) {
+	name := fmt.Sprintf("tora-%d-%d", time.Now().Unix(), rand.Uint32())
+	root := filepath.Join(os.TempDir(), name)
+	err := os.Mkdir(root, 0755)
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(root)
+
+	newServer := func(addr string, schedules map[string]shell.Schedule) (*Server, error) {
+		return NewServer(Options{
+			Log:    logrus.New(),
+			Addr:   addr,
+			Enable: []string{"shell"},
+			ShellOptions: ShellOptions{
+				Root: root,
+				Tasks: map[string]shell.Task{
+					"tick": {
+						Params: map[string]shell.TaskParam{"NAME": {Pattern: "[a-z]+", Required: true}},
+						Run:    shell.CommandSteps("echo ${NAME}", "sleep 5"),
+					},
+				},
+				Schedules: schedules,
+			},
+			Auth: Auth{
+				Token: map[string]AuthItem{
+					"testtoken": {
+						Allow:   true,
+						Modules: []string{"shell"},
+					},
+				},
+			},
+		})
+	}
+	{
+		// 定时任务的定义不合法
+		_, err := newServer("", map[string]shell.Schedule{"a": {Task: "unknown", Cron: "@every 1s"}})
+		assert.Equal(t, "schedule [a]: task [unknown] not found", err.Error())
+		_, err = newServer("", map[string]shell.Schedule{"a": {Task: "tick", Cron: "* * *"}})
+		assert.Contains(t, err.Error(), "schedule [a]: invalid cron [* * *]")
+		_, err = newServer("", map[string]shell.Schedule{"a": {Task: "tick", Cron: "@every 1s"}})
+		assert.Equal(t, "schedule [a]: missing param [NAME]", err.Error())
+		_, err = newServer("", map[string]shell.Schedule{"a": {Task: "tick", Cron: "@every 1s", Params: map[string]string{"NAME": "a"}, Jitter: 1500 * time.Millisecond}})
+		assert.Equal(t, "schedule [a]: invalid jitter [1.5s]: must be whole seconds", err.Error())
+		// 以秒为单位的超时时间不能包含小于1秒的部分
+		m := shell.ModuleShell{Tasks: map[string]shell.Task{"a": {Run: shell.CommandSteps("echo a"), Timeout: 500 * time.Millisecond}}}
+		assert.Equal(t, "task [a]: invalid timeout [500ms]: must be whole seconds", m.Init().Error())
+	}
+
+	addr, url := getRandomPort()
+	s, err := newServer(addr, map[string]shell.Schedule{
+		"tick": {Task: "tick", Cron: "@every 1s", Params: map[string]string{"NAME": "tick"}},
+	})
+	if err != nil {
+		panic(err)
+	}
+	go s.Start()
+	defer s.Close()
+
+	request := func(method string, path string) jsoniter.Any {
+		req, err := http.NewRequest(method, url+path, nil)
+		assert.Equal(t, nil, err)
+		req.Header.Set("x-token", "testtoken")
+		req.Header.Set("x-module", "shell")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return jsoniter.Get(nil)
+		}
+		b, err := ioutil.ReadAll(res.Body)
+		assert.Equal(t, nil, err)
+		return jsoniter.Get(b)
+	}
+	{
+		// 上一次执行未结束时跳过，等待第一次执行开始并至少跳过一次，不依赖固定的等待时间
+		var data jsoniter.Any
+		for deadline := time.Now().Add(20 * time.Second); time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			data = request("GET", "/schedules")
+			if data.Get("data", "schedules", 0, "skipped").ToInt() >= 1 {
+				break
+			}
+		}
+		assert.Equal(t, 1, data.Get("data", "schedules").Size())
+		assert.Equal(t, "tick", data.Get("data", "schedules", 0, "name").ToString())
+		assert.Equal(t, "@every 1s", data.Get("data", "schedules", 0, "cron").ToString())
+		assert.Equal(t, "tick", data.Get("data", "schedules", 0, "params", "NAME").ToString())
+		assert.True(t, data.Get("data", "schedules", 0, "skipped").ToInt() >= 1)
+		assert.Equal(t, "running", data.Get("data", "schedules", 0, "lastJob", "status").ToString())
+
+		data = request("GET", "/jobs")
+		assert.Equal(t, 1, data.Get("data", "jobs").Size())
+		assert.Equal(t, "tick", data.Get("data", "jobs", 0, "schedule").ToString())
+		assert.Equal(t, "tick", data.Get("data", "jobs", 0, "task").ToString())
+		assert.Equal(t, "", data.Get("data", "jobs", 0, "token").ToString())
+
+		id := data.Get("data", "jobs", 0, "id").ToString()
+		data = request("GET", "/jobs/"+id)
+		assert.Equal(t, "tick\n", data.Get("data", "job", "steps", 0, "stdout").ToString())
+		data = request("DELETE", "/jobs/"+id)
+		assert.Equal(t, true, data.Get("data", "canceled").ToBool())
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"fmt"
 	"github.com/leizongmin/tora/common"
 	"github.com/leizongmin/tora/module/file"
+	"github.com/leizongmin/tora/module/log"
 	"github.com/leizongmin/tora/module/shell"
 	"github.com/leizongmin/tora/web"
 	"github.com/ryanuber/go-glob"
 	"github.com/sirupsen/logrus"
 	"path/filepath"
 	"strings"
+	"time"
 )
 
 // 当前版本号
@@ -30,6 +32,8 @@ type Server struct {
 	enableModuleLog   bool
 	moduleFile        *file.ModuleFile
 	moduleShell       *shell.ModuleShell
+	moduleLog         *log.ModuleLog
+	audit             *log.Writer
 }
 
 type Options struct {
@@ -38,11 +42,16 @@ type Options struct {
 	Enable       []string          // 开启的模块，可选：file, shell, log
 	FileOptions  file.ModuleFile   // 文件服务配置，如果开启了file模块，需要设置此项
 	ShellOptions shell.ModuleShell // 执行命令服务配置，如果开启了shell模块，需要设置此项
+	LogOptions   log.ModuleLog     // 日志服务配置，如果开启了log模块，需要设置此项
 	Auth         Auth              // 授权信息
+	Audit        AuditOptions      // 审计日志配置，记录每个请求的来源、授权和响应状态
 }
 
 type FileOptions = file.ModuleFile
 type ShellOptions = shell.ModuleShell
+type LogOptions = log.ModuleLog
+type LogSource = log.Source
+type LogStream = log.Stream
 
 type Auth struct {
 	Token     map[string]AuthItem // 允许指定token
@@ -113,6 +122,9 @@ func NewServer(options Options) (*Server, error) {
 		if !(options.FileOptions.FilePerm > 0) {
 			options.FileOptions.FilePerm = file.DefaultFilePerm
 		}
+		if err := options.FileOptions.Init(); err != nil {
+			return nil, err
+		}
 		s.log.Infof("enable module [file] root=%s perm=[dir:%d, file:%d]", root, options.FileOptions.DirPerm, options.FileOptions.FilePerm)
 	}
 
@@ -126,16 +138,42 @@ func NewServer(options Options) (*Server, error) {
 		}
 		options.ShellOptions.Log = s.log
 		options.ShellOptions.Root = root
-		s.moduleShell = &options.ShellOptions
-		if options.ShellOptions.AllowExternalCommands == nil {
-			options.ShellOptions.AllowExternalCommands = shell.DefaultAllowExternalCommands
+		// 产物保存到file模块的根目录中
+		if s.enableModuleFile && len(options.ShellOptions.ArtifactsRoot) < 1 {
+			options.ShellOptions.ArtifactsRoot = options.FileOptions.Root
+			options.ShellOptions.ArtifactsDirPerm = options.FileOptions.DirPerm
+			options.ShellOptions.ArtifactsFilePerm = options.FileOptions.FilePerm
 		}
-		if options.ShellOptions.AllowInternalCommands == nil {
-			options.ShellOptions.AllowInternalCommands = shell.DefaultAllowInternalCommands
+		s.moduleShell = &options.ShellOptions
+		if err := options.ShellOptions.Init(); err != nil {
+			return nil, err
 		}
 		s.log.Infof("enable module [shell] root=%s internalCommands=%s externalCommands=%s", root, options.ShellOptions.AllowInternalCommands, options.ShellOptions.AllowExternalCommands)
 	}
 
+	if len(options.Audit.Path) > 0 {
+		audit, err := log.NewWriter(log.Stream{Path: options.Audit.Path, MaxSize: options.Audit.MaxSize, MaxFiles: options.Audit.MaxFiles, NoSync: !options.Audit.Sync})
+		if err != nil {
+			return nil, fmt.Errorf("audit: %s", err)
+		}
+		s.audit = audit
+		if s.enableModuleLog {
+			if err := s.initAuditSource(&options); err != nil {
+				return nil, err
+			}
+		}
+		s.log.Infof("enable audit log path=%s", options.Audit.Path)
+	}
+
+	if s.enableModuleLog {
+		options.LogOptions.Log = s.log
+		s.moduleLog = &options.LogOptions
+		if err := options.LogOptions.Init(); err != nil {
+			return nil, err
+		}
+		s.log.Infof("enable module [log] sources=%d streams=%d", len(options.LogOptions.Sources), len(options.LogOptions.Streams))
+	}
+
 	options.Auth.TokenList = make([]string, 0)
 	for k, _ := range options.Auth.Token {
 		options.Auth.TokenList = append(options.Auth.TokenList, k)
@@ -150,13 +188,26 @@ func NewServer(options Options) (*Server, error) {
 }
 
 func (s *Server) Start() error {
+	if s.enableModuleShell {
+		s.moduleShell.Start()
+	}
 	s.log.Infof("%s listening on %s", PoweredBy, s.Options.Addr)
 	return s.httpServer.Listen(s.Options.Addr)
 }
 
 func (s *Server) Close() error {
 	s.log.Info("trying to close server...")
-	return s.httpServer.Close()
+	if s.enableModuleShell {
+		s.moduleShell.Close()
+	}
+	err := s.httpServer.Close()
+	if s.enableModuleLog {
+		s.moduleLog.Close()
+	}
+	if s.audit != nil {
+		s.audit.Close()
+	}
+	return err
 }
 
 func (s *Server) handleRequest(ctx *web.Context) {
@@ -175,13 +226,25 @@ func (s *Server) handleRequest(ctx *web.Context) {
 		return
 	}
 
+	// 请求结束后写入审计日志
+	var auth AuthInfo
+	var ok bool
+	if s.audit != nil {
+		res := &auditResponseWriter{ResponseWriter: ctx.Res}
+		ctx.Res = res
+		start := time.Now()
+		defer func() {
+			s.writeAudit(ctx, res, start, module, auth, ok)
+		}()
+	}
+
 	// 检查授权
-	auth, ok := s.checkAuth(ctx)
+	auth, ok = s.checkAuth(ctx)
 	ctx.Log = ctx.Log.WithFields(logrus.Fields{
 		"auth-ok":      ok,
 		"auth-type":    auth.Type,
 		"auth-ip":      auth.Ip,
-		"auth-token":   desensitizeToken(auth.Token),
+		"auth-token":   common.MaskToken(auth.Token),
 		"auth-allow":   auth.Allow,
 		"auth-modules": strings.Join(auth.Modules, ","),
 	})
@@ -193,11 +256,11 @@ func (s *Server) handleRequest(ctx *web.Context) {
 	// 处理请求
 	switch module {
 	case "file":
-		s.handleModuleFile(ctx)
+		s.handleModuleFile(ctx, auth)
 	case "shell":
-		s.handleModuleShell(ctx)
+		s.handleModuleShell(ctx, auth)
 	case "log":
-		s.handleModuleLog(ctx)
+		s.handleModuleLog(ctx, auth)
 	default:
 		s.handleModuleError(ctx, module)
 	}
@@ -266,28 +329,58 @@ func (s *Server) checkIp(ctx *web.Context, ip string) (AuthInfo, bool) {
 	return info, ok
 }
 
-func (s *Server) handleModuleFile(ctx *web.Context) {
+// 检查是否允许访问指定模块
+func (s *Server) checkModulePermission(ctx *web.Context, auth AuthInfo, name string) bool {
+	if auth.Allow {
+		for _, v := range auth.Modules {
+			if v == name {
+				return true
+			}
+		}
+	}
+	common.ResponseApiErrorWithStatusCode(ctx, 403, fmt.Sprintf("permission denied for module [%s]", name), nil)
+	return false
+}
+
+func (s *Server) handleModuleFile(ctx *web.Context, auth AuthInfo) {
 	if !s.enableModuleFile {
 		common.ResponseApiError(ctx, "currently not enable [file] module", nil)
 		return
 	}
+	if !s.checkModulePermission(ctx, auth, "file") {
+		return
+	}
 	s.moduleFile.Handle(ctx)
 }
 
-func (s *Server) handleModuleShell(ctx *web.Context) {
+func (s *Server) handleModuleShell(ctx *web.Context, auth AuthInfo) {
 	if !s.enableModuleShell {
 		common.ResponseApiError(ctx, "currently not enable [shell] module", nil)
 		return
 	}
-	common.ResponseApiError(ctx, "currently not supported [shell] module", nil)
+	if !s.checkModulePermission(ctx, auth, "shell") {
+		return
+	}
+	caller := shell.Caller{IP: getIpFromAddr(ctx.Req.RemoteAddr), Modules: auth.Modules}
+	if auth.Type == "token" {
+		caller.Token = ctx.Req.Header.Get("x-token")
+	}
+	s.moduleShell.Handle(ctx, caller)
 }
 
-func (s *Server) handleModuleLog(ctx *web.Context) {
+func (s *Server) handleModuleLog(ctx *web.Context, auth AuthInfo) {
 	if !s.enableModuleLog {
 		common.ResponseApiError(ctx, "currently not enable [log] module", nil)
 		return
 	}
-	common.ResponseApiError(ctx, "currently not supported [log] module", nil)
+	if !s.checkModulePermission(ctx, auth, "log") {
+		return
+	}
+	caller := log.Caller{IP: getIpFromAddr(ctx.Req.RemoteAddr)}
+	if auth.Type == "token" {
+		caller.Token = ctx.Req.Header.Get("x-token")
+	}
+	s.moduleLog.Handle(ctx, caller)
 }
 
 func (s *Server) handleModuleError(ctx *web.Context, name string) {
@@ -305,20 +398,3 @@ func getIpFromAddr(addr string) string {
 	s := strings.Split(addr, ":")
 	return s[0]
 }
-
-func desensitizeToken(token string) string {
-	size := len(token)
-	if size == 0 {
-		return ""
-	}
-	if size == 1 {
-		return "*"
-	}
-	if size == 2 {
-		return token[0:1] + "*"
-	}
-	if size < 4 {
-		return token[0:2] + "****"
-	}
-	return token[0:2] + "****" + token[len(token)-2:]
-}
@@ -1,8 +1,11 @@
 package web
 
 import (
+	"fmt"
 	"github.com/json-iterator/go"
 	"io/ioutil"
+	"net/http"
+	"strings"
 )
 
 type ContextUtil struct {
@@ -38,3 +41,52 @@ func (u *ContextUtil) ResponseJson(v interface{}) error {
 	_, err = u.ctx.Res.Write(b)
 	return err
 }
+
+// 开始输出 Server-Sent Events 响应
+func (u *ContextUtil) ResponseEventStreamHeader() {
+	u.ctx.Res.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	u.ctx.Res.Header().Set("Cache-Control", "no-cache")
+	u.ctx.Res.Header().Set("X-Accel-Buffering", "no")
+	u.ctx.Res.WriteHeader(200)
+	u.Flush()
+}
+
+// 输出一个 Server-Sent Events 事件，数据使用 JSON 格式
+func (u *ContextUtil) ResponseEvent(event string, v interface{}) error {
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(u.ctx.Res, "event: %s\ndata: %s\n\n", event, b)
+	if err != nil {
+		return err
+	}
+	u.Flush()
+	return nil
+}
+
+// 输出一个带有id的 Server-Sent Events 事件，客户端重新连接时会通过 Last-Event-ID 请求头发送最后收到的id
+func (u *ContextUtil) ResponseEventWithId(event string, id string, v interface{}) error {
+	b, err := jsoniter.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(u.ctx.Res, "id: %s\nevent: %s\ndata: %s\n\n", id, event, b)
+	if err != nil {
+		return err
+	}
+	u.Flush()
+	return nil
+}
+
+// 立即将已写入的响应内容发送给客户端
+func (u *ContextUtil) Flush() {
+	if f, ok := u.ctx.Res.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// 客户端是否接受 Server-Sent Events 响应
+func (u *ContextUtil) AcceptEventStream() bool {
+	return strings.Contains(u.ctx.Req.Header.Get("Accept"), "text/event-stream")
+}